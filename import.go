@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"todoapp/internal/app"
+)
+
+// runImport is the import subcommand, it creates posts for a user from a
+// zip of markdown files or a WordPress export and logs the report. The
+// exit code is 1 when an item failed.
+func runImport(application *app.Application, args []string) int {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	username := flags.String("user", "", "Username the posts are created for")
+	baseURL := flags.String("base-url", application.PublicURL, "Public url of the api, prefixes the links of uploaded images, root relative when empty")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: todoapp [flags] import -user <username> [-base-url <url>] <file.zip|file.xml>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *username == "" || flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	// an interrupt stops after the current item and still logs the report
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	user, err := application.Middleware.UserStore.GetUserByUsername(ctx, *username)
+	if err != nil {
+		application.Logger.Error("import user", "username", *username, "error", err)
+		return 1
+	}
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		application.Logger.Error("import open", "error", err)
+		return 1
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		application.Logger.Error("import stat", "error", err)
+		return 1
+	}
+	// imported images get their variants like uploads do, Close waits for
+	// the queued ones
+	application.ImageProcessor.Start()
+	report, err := application.Importer.Import(ctx, user.ID, file, info.Size(), *baseURL)
+	if err != nil {
+		application.Logger.Error("import", "error", err)
+		return 1
+	}
+	application.Importer.LogReport(report)
+	if report.Failed > 0 || report.Stopped != "" {
+		return 1
+	}
+	return 0
+}
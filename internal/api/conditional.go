@@ -0,0 +1,77 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"todoapp/internal/middleware"
+	"todoapp/internal/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// postETag is a strong validator, a post's representation only changes
+// together with UpdatedAt. The id keeps tags of posts saved in the same
+// microsecond apart.
+func postETag(post *store.Post) string {
+	return fmt.Sprintf(`"%v-%x"`, post.ID, post.UpdatedAt.UnixMicro())
+}
+
+func setPostValidators(c *gin.Context, post *store.Post) {
+	c.Header("ETag", postETag(post))
+	c.Header("Last-Modified", post.UpdatedAt.UTC().Format(http.TimeFormat))
+}
+
+// notModified reports whether the client's copy of post is current, per
+// If-None-Match or, when that is missing, If-Modified-Since.
+func notModified(c *gin.Context, post *store.Post) bool {
+	if header := c.GetHeader("If-None-Match"); header != "" {
+		return etagListMatches(header, postETag(post), false)
+	}
+	since, err := http.ParseTime(c.GetHeader("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	// Last-Modified only has second precision
+	return !post.UpdatedAt.Truncate(time.Second).After(since)
+}
+
+// requireIfMatch fails the request unless it carries an If-Match header
+// matching post, so an edit cannot silently overwrite one it never saw.
+func requireIfMatch(c *gin.Context, post *store.Post) bool {
+	header := c.GetHeader("If-Match")
+	if header == "" {
+		middleware.Fail(c, middleware.NewProblem(http.StatusPreconditionRequired, "precondition_required", "send the post's ETag in If-Match"))
+		return false
+	}
+	if !etagListMatches(header, postETag(post), true) {
+		middleware.Fail(c, postChanged())
+		return false
+	}
+	return true
+}
+
+func postChanged() error {
+	return middleware.NewProblem(http.StatusPreconditionFailed, "precondition_failed", "the post was changed since it was read")
+}
+
+// etagListMatches checks an If-Match or If-None-Match header. If-Match
+// compares strongly, weak tags never match, If-None-Match ignores the W/
+// prefix.
+func etagListMatches(header string, etag string, strong bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		weak := strings.HasPrefix(candidate, "W/")
+		if weak && strong {
+			continue
+		}
+		if strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+	"todoapp/internal/export"
+	"todoapp/internal/middleware"
+	"todoapp/internal/store"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type ExportHandler struct {
+	exportStore store.ExportStore
+	// archiveStore is the private blob store the exporter writes to
+	archiveStore store.BlobStore
+	exporter     *export.Exporter
+	// publicURL prefixes download links, they are root relative when empty.
+	publicURL string
+}
+
+func NewExportHandler(exportStore store.ExportStore, archiveStore store.BlobStore, exporter *export.Exporter, publicURL string) *ExportHandler {
+	return &ExportHandler{
+		exportStore:  exportStore,
+		archiveStore: archiveStore,
+		exporter:     exporter,
+		publicURL:    publicURL,
+	}
+}
+
+type ExportResponse struct {
+	store.Export
+	// DownloadURL is a signed link, only set once the archive is ready.
+	DownloadURL string `json:"download_url,omitempty"`
+}
+
+func (eh *ExportHandler) newExportResponse(e *store.Export) ExportResponse {
+	response := ExportResponse{Export: *e}
+	if e.Status == store.ExportReady {
+		response.DownloadURL = eh.publicURL + eh.exporter.DownloadPath(e)
+	}
+	return response
+}
+
+// HandleCreateExport queues an archive of the user's data, poll the returned
+// export or wait for the notification.
+func (eh *ExportHandler) HandleCreateExport(c *gin.Context) {
+	user := middleware.GetUser(c)
+	e, err := eh.exporter.Request(c.Request.Context(), user.ID)
+	if err != nil {
+		if errors.Is(err, export.ErrBusy) {
+			middleware.Fail(c, middleware.NewProblem(http.StatusServiceUnavailable, "busy", "too many exports queued, try again later"))
+			return
+		}
+		middleware.Fail(c, fmt.Errorf("handleCreateExport: %w", err))
+		return
+	}
+	c.Header("Location", "/user/exports/"+e.ID.String())
+	c.IndentedJSON(http.StatusAccepted, eh.newExportResponse(e))
+}
+
+func (eh *ExportHandler) HandleGetExport(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		middleware.Fail(c, middleware.NewProblem(http.StatusNotFound, "not_found", "resource not found"))
+		return
+	}
+	user := middleware.GetUser(c)
+	e, err := eh.exportStore.GetExportForUser(c.Request.Context(), id, user.ID)
+	if err != nil {
+		middleware.Fail(c, fmt.Errorf("handleGetExport: %w", err))
+		return
+	}
+	c.IndentedJSON(http.StatusOK, eh.newExportResponse(e))
+}
+
+// HandleDownloadExport serves the archive to whoever holds a valid signed
+// link, no session is needed so the link works from a notification.
+func (eh *ExportHandler) HandleDownloadExport(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		middleware.Fail(c, invalidLink())
+		return
+	}
+	linkExpires, ok := eh.exporter.VerifyDownload(id, c.Query("expires"), c.Query("signature"))
+	if !ok {
+		middleware.Fail(c, invalidLink())
+		return
+	}
+	e, err := eh.exportStore.GetExportByID(c.Request.Context(), id)
+	if err != nil {
+		middleware.Fail(c, fmt.Errorf("handleDownloadExport: %w", err))
+		return
+	}
+	if e.Status != store.ExportReady || time.Now().After(e.ExpiresAt) {
+		middleware.Fail(c, store.ErrNotFound)
+		return
+	}
+	c.Header("Cache-Control", "private, no-store")
+	// the redirect must not outlive the link it was reached through, the
+	// link never outlives the archive
+	expiry := min(time.Until(linkExpires), eh.exporter.LinkTTL(), store.MaxPresignExpiry)
+	url, err := eh.archiveStore.PresignedURL(e.BlobKey(), max(expiry, time.Second))
+	if err == nil {
+		c.Redirect(http.StatusTemporaryRedirect, url)
+		return
+	}
+	if !errors.Is(err, store.ErrPresignUnsupported) {
+		middleware.Fail(c, fmt.Errorf("handleDownloadExportPresign: %w", err))
+		return
+	}
+	blob, info, err := eh.archiveStore.Get(e.BlobKey())
+	if err != nil {
+		middleware.Fail(c, fmt.Errorf("handleDownloadExportGet: %w", err))
+		return
+	}
+	defer blob.Close()
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="export-%v.zip"`, e.CreatedAt.Format("2006-01-02")))
+	http.ServeContent(c.Writer, c.Request, "", info.ModTime, blob)
+}
+
+func invalidLink() error {
+	return middleware.NewProblem(http.StatusForbidden, "invalid_link", "the download link is invalid or expired")
+}
@@ -0,0 +1,195 @@
+package api
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"todoapp/internal/export"
+	"todoapp/internal/middleware"
+	"todoapp/internal/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// presigningBlobStore records the expiry of the presigned urls it hands out.
+type presigningBlobStore struct {
+	store.BlobStore
+	expiry time.Duration
+}
+
+func (ps *presigningBlobStore) PresignedURL(key string, expiry time.Duration) (string, error) {
+	ps.expiry = expiry
+	return "https://blobs.example.com/" + key, nil
+}
+
+type exportHandlerTest struct {
+	ctx      context.Context
+	stores   *store.MemoryStores
+	archives store.BlobStore
+	exporter *export.Exporter
+	engine   *gin.Engine
+}
+
+func newExportHandlerTest(t *testing.T, archives store.BlobStore, linkTTL time.Duration) *exportHandlerTest {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	stores := store.NewMemoryStores()
+	exporter := export.NewExporter(export.Stores{
+		Users:   stores.Users,
+		Posts:   stores.Posts,
+		Images:  stores.Images,
+		Tokens:  stores.Tokens,
+		Exports: stores.Exports,
+	}, archives, archives, &export.LogNotifier{}, slog.New(slog.NewTextHandler(io.Discard, nil)), []byte("signing key"), 24*time.Hour, linkTTL)
+	handler := NewExportHandler(stores.Exports, archives, exporter, "https://api.example.com")
+	engine := gin.New()
+	engine.Use(middleware.ErrorHandler())
+	engine.GET("/exports/:id/download", handler.HandleDownloadExport)
+	// the test signs users in by their username in the Authorization header
+	engine.GET("/user/exports/:id", func(c *gin.Context) {
+		user, err := stores.Users.GetUserByUsername(c.Request.Context(), c.GetHeader("Authorization"))
+		if err != nil {
+			middleware.Fail(c, err)
+			return
+		}
+		middleware.SetUser(user, c)
+	}, handler.HandleGetExport)
+	return &exportHandlerTest{
+		ctx:      context.Background(),
+		stores:   stores,
+		archives: archives,
+		exporter: exporter,
+		engine:   engine,
+	}
+}
+
+// createExport stores a ready archive of a new user expiring after ttl.
+func (eh *exportHandlerTest) createExport(t *testing.T, username string, ttl time.Duration) *store.Export {
+	t.Helper()
+	user := &store.User{Username: username, Email: username + "@example.com", PasswordHash: "hash"}
+	err := eh.stores.Users.CreateUser(eh.ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &store.Export{UserID: user.ID, Status: store.ExportReady, ExpiresAt: time.Now().Add(ttl)}
+	err = eh.stores.Exports.CreateExport(eh.ctx, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = eh.archives.Put(e.BlobKey(), strings.NewReader("archive of "+username), int64(len("archive of "+username)), "application/zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func (eh *exportHandlerTest) get(path string, headers ...string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodGet, path, nil)
+	for i := 0; i+1 < len(headers); i += 2 {
+		request.Header.Set(headers[i], headers[i+1])
+	}
+	recorder := httptest.NewRecorder()
+	eh.engine.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func newTestArchives(t *testing.T) store.BlobStore {
+	t.Helper()
+	archives, err := store.NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return archives
+}
+
+func TestHandleDownloadExport(t *testing.T) {
+	eh := newExportHandlerTest(t, newTestArchives(t), time.Hour)
+	e := eh.createExport(t, "downloader", 24*time.Hour)
+	other := eh.createExport(t, "otheruser", 24*time.Hour)
+	expiring := eh.createExport(t, "expiringuser", 24*time.Hour)
+	link := eh.exporter.DownloadPath(e)
+	expiringLink := eh.exporter.DownloadPath(expiring)
+	expiring.ExpiresAt = time.Now().Add(-time.Minute)
+	err := eh.stores.Exports.UpdateExport(eh.ctx, expiring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the link of an archive that expired is expired itself
+	expiredLink := eh.exporter.DownloadPath(expiring)
+
+	parsed, _ := url.Parse(link)
+	query := parsed.Query()
+	tampered := []byte(query.Get("signature"))
+	tampered[len(tampered)-1] ^= 1
+	tests := []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{"valid", link, http.StatusOK},
+		{"tampered signature", "/exports/" + e.ID.String() + "/download?expires=" + query.Get("expires") + "&signature=" + string(tampered), http.StatusForbidden},
+		{"expired link", expiredLink, http.StatusForbidden},
+		{"another export", "/exports/" + other.ID.String() + "/download?" + parsed.RawQuery, http.StatusForbidden},
+		{"invalid id", "/exports/not-an-id/download?" + parsed.RawQuery, http.StatusForbidden},
+		{"expired archive", expiringLink, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		recorder := eh.get(test.path)
+		if recorder.Code != test.status {
+			t.Errorf("%v: status = %v, want %v: %v", test.name, recorder.Code, test.status, recorder.Body)
+		}
+	}
+	recorder := eh.get(link)
+	if recorder.Body.String() != "archive of downloader" || recorder.Header().Get("Content-Type") != "application/zip" {
+		t.Errorf("download = %q with content type %q, want the user's archive", recorder.Body, recorder.Header().Get("Content-Type"))
+	}
+}
+
+func TestHandleGetExportOwnership(t *testing.T) {
+	eh := newExportHandlerTest(t, newTestArchives(t), time.Hour)
+	e := eh.createExport(t, "owneruser", 24*time.Hour)
+	eh.createExport(t, "otheruser", 24*time.Hour)
+
+	recorder := eh.get("/user/exports/"+e.ID.String(), "Authorization", "owneruser")
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"download_url": "https://api.example.com/exports/`+e.ID.String()) {
+		t.Errorf("owner's export = %v %v, want it with a download url", recorder.Code, recorder.Body)
+	}
+	recorder = eh.get("/user/exports/"+e.ID.String(), "Authorization", "otheruser")
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("another user's export = %v, want 404", recorder.Code)
+	}
+}
+
+func TestHandleDownloadExportPresignExpiry(t *testing.T) {
+	tests := []struct {
+		name       string
+		linkTTL    time.Duration
+		archiveTTL time.Duration
+		want       time.Duration
+	}{
+		{"link ttl", time.Hour, 24 * time.Hour, time.Hour},
+		{"archive expires first", time.Hour, 10 * time.Minute, 10 * time.Minute},
+		{"clamped", 30 * 24 * time.Hour, 60 * 24 * time.Hour, store.MaxPresignExpiry},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			archives := &presigningBlobStore{BlobStore: newTestArchives(t)}
+			eh := newExportHandlerTest(t, archives, test.linkTTL)
+			e := eh.createExport(t, "presignuser", test.archiveTTL)
+			recorder := eh.get(eh.exporter.DownloadPath(e))
+			if recorder.Code != http.StatusTemporaryRedirect {
+				t.Fatalf("status = %v, want a redirect to the presigned url", recorder.Code)
+			}
+			// links expire on whole seconds
+			if archives.expiry > test.want || archives.expiry < test.want-2*time.Second {
+				t.Errorf("presigned for %v, want %v", archives.expiry, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+	"todoapp/internal/importer"
+	"todoapp/internal/media"
+	"todoapp/internal/metrics"
+	"todoapp/internal/middleware"
+	"todoapp/internal/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ImportHandler struct {
+	importer *importer.Importer
+	maxBytes int64
+	// timeout bounds a whole import, including receiving the file, far
+	// beyond the server's usual read and write timeouts.
+	timeout time.Duration
+	// publicURL prefixes the links of imported images, they are root
+	// relative when empty.
+	publicURL string
+}
+
+func NewImportHandler(importer *importer.Importer, maxBytes int64, timeout time.Duration, publicURL string) *ImportHandler {
+	return &ImportHandler{
+		importer:  importer,
+		maxBytes:  maxBytes,
+		timeout:   timeout,
+		publicURL: publicURL,
+	}
+}
+
+// multipartOverhead is room for the form around the file.
+const multipartOverhead = 1 << 20
+
+// HandleImport creates posts from an uploaded zip of markdown files or a
+// WordPress export and answers with a report per item.
+func (ih *ImportHandler) HandleImport(c *gin.Context) {
+	deadline := time.Now().Add(ih.timeout)
+	controller := http.NewResponseController(c.Writer)
+	err := controller.SetReadDeadline(deadline)
+	if err == nil {
+		err = controller.SetWriteDeadline(deadline)
+	}
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		middleware.Fail(c, fmt.Errorf("handleImportDeadline: %w", err))
+		return
+	}
+
+	// FormFile spools the whole body to disk, stop reading once the file
+	// can no longer fit
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, ih.maxBytes+multipartOverhead)
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			middleware.Fail(c, media.ErrFileTooLarge)
+			return
+		}
+		validationErr := &store.ValidationError{}
+		validationErr.Add("file", "is required")
+		middleware.Fail(c, validationErr)
+		return
+	}
+	if fileHeader.Size > ih.maxBytes {
+		middleware.Fail(c, media.ErrFileTooLarge)
+		return
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		middleware.Fail(c, fmt.Errorf("handleImportOpen: %w", err))
+		return
+	}
+	defer file.Close()
+	metrics.UploadedBytes.WithLabelValues("import").Add(float64(fileHeader.Size))
+
+	ctx, cancel := context.WithDeadline(c.Request.Context(), deadline)
+	defer cancel()
+	user := middleware.GetUser(c)
+	report, err := ih.importer.Import(ctx, user.ID, file, fileHeader.Size, ih.publicURL)
+	if errors.Is(err, importer.ErrUnsupportedFormat) {
+		middleware.Fail(c, middleware.NewProblem(http.StatusBadRequest, "unsupported_format", err.Error()))
+		return
+	}
+	if err != nil {
+		middleware.Fail(c, fmt.Errorf("handleImport: %w", err))
+		return
+	}
+	c.IndentedJSON(http.StatusOK, report)
+}
@@ -1,9 +1,13 @@
 package api
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"strings"
+	"time"
+	"todoapp/internal/media"
+	"todoapp/internal/metrics"
 	"todoapp/internal/middleware"
 	"todoapp/internal/store"
 
@@ -13,24 +17,47 @@ import (
 
 type PostHandler struct {
 	postStore store.PostStore
-	logger    *log.Logger
+	blobStore store.BlobStore
+	ingester  *media.Ingester
+	// trashRetention is how long deleted posts can be restored.
+	trashRetention time.Duration
+	// publicURL prefixes image links, they are root relative when empty.
+	publicURL string
 }
 
-func NewPostHanlder(postStore store.PostStore, logger *log.Logger) *PostHandler {
+func NewPostHanlder(postStore store.PostStore, blobStore store.BlobStore, ingester *media.Ingester, trashRetention time.Duration, publicURL string) *PostHandler {
 	return &PostHandler{
-		postStore: postStore,
-		logger:    logger,
+		postStore:      postStore,
+		blobStore:      blobStore,
+		ingester:       ingester,
+		trashRetention: trashRetention,
+		publicURL:      publicURL,
 	}
 }
 
+type ImageVariant struct {
+	Width int    `json:"width"`
+	URL   string `json:"url"`
+}
+
+type UploadImageResponse struct {
+	URL         string         `json:"url"`
+	ContentType string         `json:"content_type"`
+	Thumbnail   string         `json:"thumbnail,omitempty"`
+	Variants    []ImageVariant `json:"variants"`
+	Srcset      string         `json:"srcset,omitempty"`
+}
+
+type CreatePostRequest struct {
+	Title   string `json:"title" form:"title" binding:"required"`
+	Content string `json:"content" form:"content" binding:"required"`
+}
+
 func (ph *PostHandler) HandleCreatePost(c *gin.Context) {
-	postRequest := struct {
-		Title   string `json:"title" form:"title" binding:"required"`
-		Content string `json:"content" form:"content" binding:"required"`
-	}{}
+	postRequest := CreatePostRequest{}
 	err := c.ShouldBind(&postRequest)
 	if err != nil {
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		middleware.Fail(c, middleware.BindError(err))
 		return
 	}
 	user := middleware.GetUser(c)
@@ -39,31 +66,225 @@ func (ph *PostHandler) HandleCreatePost(c *gin.Context) {
 		Title:   postRequest.Title,
 		Content: postRequest.Content,
 	}
-	err = ph.postStore.CreatePost(post)
+	err = ph.postStore.CreatePost(c.Request.Context(), post)
+	if err != nil {
+		middleware.Fail(c, fmt.Errorf("handleCreatePostCreatePost: %w", err))
+		return
+	}
+	setPostValidators(c, post)
+	c.IndentedJSON(http.StatusCreated, post)
+}
+
+type UpdatePostRequest struct {
+	Title   string `json:"title" form:"title" binding:"required"`
+	Content string `json:"content" form:"content" binding:"required"`
+}
+
+// HandleUpdatePost replaces the title and content of one of the user's
+// posts. Posts of other users are reported as missing. The request must
+// carry the post's ETag in If-Match, edits based on an older version fail
+// with 412.
+func (ph *PostHandler) HandleUpdatePost(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		middleware.Fail(c, middleware.NewProblem(http.StatusNotFound, "not_found", "resource not found"))
+		return
+	}
+	postRequest := UpdatePostRequest{}
+	err = c.ShouldBind(&postRequest)
+	if err != nil {
+		middleware.Fail(c, middleware.BindError(err))
+		return
+	}
+	user := middleware.GetUser(c)
+	// the version check needs the latest commit, not a cached or replicated
+	// copy of the post
+	post, err := ph.postStore.GetPostByID(store.PinPrimary(c.Request.Context()), id)
+	if err != nil {
+		middleware.Fail(c, fmt.Errorf("handleUpdatePostGetPost: %w", err))
+		return
+	}
+	if post.UserID != user.ID {
+		middleware.Fail(c, store.ErrNotFound)
+		return
+	}
+	if !requireIfMatch(c, post) {
+		return
+	}
+	version := post.UpdatedAt
+	post.Title = postRequest.Title
+	post.Content = postRequest.Content
+	err = ph.postStore.UpdatePost(c.Request.Context(), post, version)
+	if err != nil {
+		if errors.Is(err, store.ErrConflict) {
+			// another edit committed between the check and the update
+			middleware.Fail(c, postChanged())
+			return
+		}
+		middleware.Fail(c, fmt.Errorf("handleUpdatePost: %w", err))
+		return
+	}
+	setPostValidators(c, post)
+	c.IndentedJSON(http.StatusOK, post)
+}
+
+// HandleDeletePost moves one of the user's posts to the trash. Images it
+// embedded are kept until the post is purged.
+func (ph *PostHandler) HandleDeletePost(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		middleware.Fail(c, middleware.NewProblem(http.StatusNotFound, "not_found", "resource not found"))
+		return
+	}
+	user := middleware.GetUser(c)
+	err = ph.postStore.DeletePost(c.Request.Context(), id, user.ID)
+	if err != nil {
+		middleware.Fail(c, fmt.Errorf("handleDeletePost: %w", err))
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// TrashedPost is a deleted post as listed in the trash.
+type TrashedPost struct {
+	ID        uuid.UUID `json:"id"`
+	Title     string    `json:"title"`
+	DeletedAt time.Time `json:"deleted_at"`
+	// PurgeAt is when the post is deleted for good.
+	PurgeAt time.Time `json:"purge_at"`
+}
+
+// HandleGetTrash lists the user's deleted posts, most recently deleted
+// first.
+func (ph *PostHandler) HandleGetTrash(c *gin.Context) {
+	user := middleware.GetUser(c)
+	posts, err := ph.postStore.GetDeletedPostsForUser(c.Request.Context(), user.ID)
+	if err != nil {
+		middleware.Fail(c, fmt.Errorf("handleGetTrash: %w", err))
+		return
+	}
+	trash := make([]TrashedPost, 0, len(posts))
+	for _, post := range posts {
+		trash = append(trash, TrashedPost{
+			ID:        post.ID,
+			Title:     post.Title,
+			DeletedAt: post.DeletedAt.Time,
+			PurgeAt:   post.DeletedAt.Time.Add(ph.trashRetention),
+		})
+	}
+	c.IndentedJSON(http.StatusOK, trash)
+}
+
+// HandleRestorePost takes one of the user's posts out of the trash and
+// returns it with its new validators. Posts that are not in the user's
+// trash are reported as missing.
+func (ph *PostHandler) HandleRestorePost(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		middleware.Fail(c, middleware.NewProblem(http.StatusNotFound, "not_found", "resource not found"))
+		return
+	}
+	user := middleware.GetUser(c)
+	err = ph.postStore.RestorePost(c.Request.Context(), id, user.ID)
 	if err != nil {
-		ph.logger.Printf("ERROR: handleCreatePostCreatePost: %v\n", err)
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		middleware.Fail(c, fmt.Errorf("handleRestorePost: %w", err))
 		return
 	}
-	c.String(http.StatusCreated, "successfully created post")
+	post, err := ph.postStore.GetPostByID(c.Request.Context(), id)
+	if err != nil {
+		middleware.Fail(c, fmt.Errorf("handleRestorePostGetPost: %w", err))
+		return
+	}
+	setPostValidators(c, post)
+	c.IndentedJSON(http.StatusOK, post)
 }
 
 func (ph *PostHandler) HandleUploadImage(c *gin.Context) {
-	file, err := c.FormFile("file")
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		validationErr := &store.ValidationError{}
+		validationErr.Add("file", "is required")
+		middleware.Fail(c, validationErr)
+		return
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		middleware.Fail(c, fmt.Errorf("handleUploadImageOpen: %w", err))
+		return
+	}
+	defer file.Close()
+
+	user := middleware.GetUser(c)
+	result, err := ph.ingester.Ingest(c.Request.Context(), user.ID, file, fileHeader.Size)
 	if err != nil {
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "image upload error"})
+		middleware.Fail(c, fmt.Errorf("handleUploadImageIngest: %w", err))
 		return
 	}
-	filename := uuid.New().String()
-	c.SaveUploadedFile(file, "./files/static/images/"+filename)
-	c.JSON(http.StatusOK, gin.H{"url": fmt.Sprintf("http://%v/static/images/%v", c.Request.Host, filename)})
+	metrics.UploadedBytes.WithLabelValues("image").Add(float64(fileHeader.Size))
+	c.JSON(http.StatusOK, newUploadImageResponse(ph.publicURL, result))
+}
+
+func imageURL(publicURL string, key string) string {
+	return publicURL + "/static/images/" + key
+}
+
+// newUploadImageResponse lists the variants the processor will generate,
+// the original doubles as the largest srcset candidate.
+func newUploadImageResponse(publicURL string, result *media.IngestResult) UploadImageResponse {
+	response := UploadImageResponse{
+		URL:         imageURL(publicURL, result.Key),
+		ContentType: result.ContentType,
+		Variants:    []ImageVariant{},
+	}
+	if !result.IsImage() {
+		return response
+	}
+	response.Thumbnail = imageURL(publicURL, media.ThumbnailKey(result.Key))
+	srcset := []string{}
+	for _, w := range media.PlanVariants(result.Width) {
+		url := imageURL(publicURL, media.VariantKey(result.Key, w))
+		response.Variants = append(response.Variants, ImageVariant{Width: w, URL: url})
+		srcset = append(srcset, fmt.Sprintf("%v %vw", url, w))
+	}
+	srcset = append(srcset, fmt.Sprintf("%v %vw", response.URL, result.Width))
+	response.Srcset = strings.Join(srcset, ", ")
+	return response
+}
+
+// HandleServeImage streams an uploaded image, or redirects to a presigned
+// url when the blob backend can serve it directly. Keys other than images and
+// their variants are reported as missing.
+func (ph *PostHandler) HandleServeImage(c *gin.Context) {
+	key := c.Param("key")
+	if !media.IsImageKey(key) {
+		middleware.Fail(c, store.ErrNotFound)
+		return
+	}
+	url, err := ph.blobStore.PresignedURL(key, 15*time.Minute)
+	if err == nil {
+		c.Redirect(http.StatusTemporaryRedirect, url)
+		return
+	}
+	if !errors.Is(err, store.ErrPresignUnsupported) {
+		middleware.Fail(c, fmt.Errorf("handleServeImagePresign: %w", err))
+		return
+	}
+	blob, info, err := ph.blobStore.Get(key)
+	if err != nil {
+		middleware.Fail(c, fmt.Errorf("handleServeImageGet: %w", err))
+		return
+	}
+	defer blob.Close()
+	if info.ContentType != "" {
+		c.Header("Content-Type", info.ContentType)
+	}
+	http.ServeContent(c.Writer, c.Request, key, info.ModTime, blob)
 }
 
 func (ph *PostHandler) HandleGetAllPosts(c *gin.Context) {
-	posts, err := ph.postStore.GetAllPosts()
+	posts, err := ph.postStore.GetAllPosts(c.Request.Context())
 	if err != nil {
-		ph.logger.Printf("ERROR: handleGetAllPosts: %v\n", err)
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		middleware.Fail(c, fmt.Errorf("handleGetAllPosts: %w", err))
 		return
 	}
 	c.IndentedJSON(http.StatusOK, posts)
@@ -72,14 +293,18 @@ func (ph *PostHandler) HandleGetAllPosts(c *gin.Context) {
 func (ph *PostHandler) HandleGetPostByID(c *gin.Context) {
 	id, err := uuid.Parse(c.Param("id"))
 	if err != nil {
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		middleware.Fail(c, middleware.NewProblem(http.StatusNotFound, "not_found", "resource not found"))
 		return
 	}
-	post, err := ph.postStore.GetPostByID(id)
+	post, err := ph.postStore.GetPostByID(c.Request.Context(), id)
 	if err != nil {
-		ph.logger.Printf("ERROR: handleGetPostByID: %v\n", err)
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		middleware.Fail(c, fmt.Errorf("handleGetPostByID: %w", err))
+		return
+	}
+	setPostValidators(c, post)
+	if notModified(c, post) {
+		c.Status(http.StatusNotModified)
 		return
 	}
 	c.IndentedJSON(http.StatusOK, post)
-}
\ No newline at end of file
+}
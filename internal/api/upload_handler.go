@@ -0,0 +1,265 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"todoapp/internal/logging"
+	"todoapp/internal/media"
+	"todoapp/internal/metrics"
+	"todoapp/internal/middleware"
+	"todoapp/internal/store"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// UploadHandler implements resumable uploads modelled on the tus protocol:
+// POST creates an upload, PATCH appends chunks at the current offset, HEAD
+// reports progress and POST .../finalize stores the assembled file.
+type UploadHandler struct {
+	uploadStore store.UploadStore
+	// blobStore holds the chunks, it is private so they are never served
+	blobStore store.BlobStore
+	ingester  *media.Ingester
+	maxLength int64
+	maxChunk  int64
+	expiry    time.Duration
+	publicURL string
+}
+
+func NewUploadHandler(uploadStore store.UploadStore, blobStore store.BlobStore, ingester *media.Ingester, maxLength int64, maxChunk int64, expiry time.Duration, publicURL string) *UploadHandler {
+	return &UploadHandler{
+		uploadStore: uploadStore,
+		blobStore:   blobStore,
+		ingester:    ingester,
+		maxLength:   maxLength,
+		maxChunk:    maxChunk,
+		expiry:      expiry,
+		publicURL:   publicURL,
+	}
+}
+
+const (
+	tusVersion = "1.0.0"
+	// tus reports checksum mismatches with this non standard status code
+	statusChecksumMismatch = 460
+)
+
+func (uh *UploadHandler) setUploadHeaders(c *gin.Context, upload *store.Upload) {
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	c.Header("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	c.Header("Cache-Control", "no-store")
+}
+
+func (uh *UploadHandler) HandleCreateUpload(c *gin.Context) {
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		middleware.Fail(c, middleware.NewProblem(http.StatusBadRequest, "invalid_upload_length", "invalid Upload-Length"))
+		return
+	}
+	if length > uh.maxLength {
+		middleware.Fail(c, media.ErrFileTooLarge)
+		return
+	}
+	user := middleware.GetUser(c)
+	upload := &store.Upload{
+		UserID:    user.ID,
+		Length:    length,
+		Metadata:  c.GetHeader("Upload-Metadata"),
+		ExpiresAt: time.Now().Add(uh.expiry),
+	}
+	err = uh.uploadStore.CreateUpload(c.Request.Context(), upload, uh.ingester.Quota())
+	if err != nil {
+		middleware.Fail(c, fmt.Errorf("handleCreateUploadCreateUpload: %w", err))
+		return
+	}
+	uh.setUploadHeaders(c, upload)
+	c.Header("Location", fmt.Sprintf("/uploads/%v", upload.ID))
+	c.Status(http.StatusCreated)
+}
+
+// getUpload loads the upload named in the path for the logged in user,
+// failing the request itself when that does not work.
+func (uh *UploadHandler) getUpload(c *gin.Context) *store.Upload {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		middleware.Fail(c, store.ErrNotFound)
+		return nil
+	}
+	user := middleware.GetUser(c)
+	upload, err := uh.uploadStore.GetUploadForUser(c.Request.Context(), id, user.ID)
+	if err != nil {
+		middleware.Fail(c, fmt.Errorf("getUploadGetUploadForUser: %w", err))
+		return nil
+	}
+	if time.Now().After(upload.ExpiresAt) {
+		middleware.Fail(c, middleware.NewProblem(http.StatusGone, "upload_expired", "upload expired"))
+		return nil
+	}
+	return upload
+}
+
+func (uh *UploadHandler) HandleGetUploadOffset(c *gin.Context) {
+	upload := uh.getUpload(c)
+	if upload == nil {
+		return
+	}
+	uh.setUploadHeaders(c, upload)
+	c.Status(http.StatusOK)
+}
+
+func (uh *UploadHandler) HandlePatchUpload(c *gin.Context) {
+	if c.ContentType() != "application/offset+octet-stream" {
+		middleware.Fail(c, middleware.NewProblem(http.StatusUnsupportedMediaType, "unsupported_media_type", "expected application/offset+octet-stream"))
+		return
+	}
+	upload := uh.getUpload(c)
+	if upload == nil {
+		return
+	}
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset != upload.Offset {
+		uh.setUploadHeaders(c, upload)
+		middleware.Fail(c, offsetMismatch())
+		return
+	}
+	checksum, err := parseUploadChecksum(c.GetHeader("Upload-Checksum"))
+	if err != nil {
+		middleware.Fail(c, middleware.NewProblem(http.StatusBadRequest, "invalid_checksum", err.Error()))
+		return
+	}
+
+	// the upload's length is already counted, this fails once other uploads
+	// or a lowered quota took the user over it
+	err = uh.ingester.CheckQuota(c.Request.Context(), upload.UserID, 0)
+	if err != nil {
+		middleware.Fail(c, fmt.Errorf("handlePatchUploadCheckQuota: %w", err))
+		return
+	}
+
+	limit := min(uh.maxChunk, upload.Length-upload.Offset)
+	chunk, err := io.ReadAll(io.LimitReader(c.Request.Body, limit+1))
+	if err != nil {
+		middleware.Fail(c, middleware.NewProblem(http.StatusBadRequest, "invalid_request", "chunk upload error"))
+		return
+	}
+	if int64(len(chunk)) > limit {
+		middleware.Fail(c, middleware.NewProblem(http.StatusRequestEntityTooLarge, "chunk_too_large", "chunk exceeds upload length or maximum chunk size"))
+		return
+	}
+	metrics.UploadedBytes.WithLabelValues("resumable").Add(float64(len(chunk)))
+	if len(chunk) == 0 {
+		uh.setUploadHeaders(c, upload)
+		c.Status(http.StatusNoContent)
+		return
+	}
+	sum := sha256.Sum256(chunk)
+	if checksum != nil && !bytes.Equal(sum[:], checksum) {
+		middleware.Fail(c, middleware.NewProblem(statusChecksumMismatch, "checksum_mismatch", "checksum mismatch"))
+		return
+	}
+
+	key := upload.NewChunkKey()
+	err = uh.blobStore.Put(key, bytes.NewReader(chunk), int64(len(chunk)), "application/octet-stream")
+	if err != nil {
+		middleware.Fail(c, fmt.Errorf("handlePatchUploadPut: %w", err))
+		return
+	}
+	err = uh.uploadStore.AdvanceUpload(c.Request.Context(), upload, key, int64(len(chunk)), time.Now().Add(uh.expiry))
+	if err != nil {
+		uh.blobStore.Delete(key)
+		if errors.Is(err, store.ErrConflict) {
+			// a concurrent PATCH won the race for this offset
+			middleware.Fail(c, offsetMismatch())
+			return
+		}
+		middleware.Fail(c, fmt.Errorf("handlePatchUploadAdvanceUpload: %w", err))
+		return
+	}
+	uh.setUploadHeaders(c, upload)
+	c.Status(http.StatusNoContent)
+}
+
+func offsetMismatch() error {
+	return middleware.NewProblem(http.StatusConflict, "offset_mismatch", "Upload-Offset does not match")
+}
+
+// parseUploadChecksum reads a tus "Upload-Checksum: sha256 <base64>" header,
+// returning nil when the client did not send one.
+func parseUploadChecksum(header string) ([]byte, error) {
+	if header == "" {
+		return nil, nil
+	}
+	algorithm, encoded, ok := strings.Cut(header, " ")
+	if !ok || algorithm != "sha256" {
+		return nil, errors.New("unsupported checksum algorithm, use sha256")
+	}
+	checksum, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(checksum) != sha256.Size {
+		return nil, errors.New("invalid Upload-Checksum")
+	}
+	return checksum, nil
+}
+
+func (uh *UploadHandler) HandleFinalizeUpload(c *gin.Context) {
+	upload := uh.getUpload(c)
+	if upload == nil {
+		return
+	}
+	if !upload.IsComplete() {
+		uh.setUploadHeaders(c, upload)
+		middleware.Fail(c, middleware.NewProblem(http.StatusConflict, "upload_incomplete", "upload incomplete"))
+		return
+	}
+	file, err := media.AssembleUpload(uh.blobStore, upload)
+	if err != nil {
+		middleware.Fail(c, fmt.Errorf("handleFinalizeUploadAssemble: %w", err))
+		return
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	user := middleware.GetUser(c)
+	result, err := uh.ingester.IngestUpload(c.Request.Context(), user.ID, file, upload.Length)
+	if err != nil {
+		middleware.Fail(c, fmt.Errorf("handleFinalizeUploadIngest: %w", err))
+		return
+	}
+	uh.removeUpload(c, upload)
+	c.JSON(http.StatusOK, newUploadImageResponse(uh.publicURL, result))
+}
+
+func (uh *UploadHandler) HandleDeleteUpload(c *gin.Context) {
+	upload := uh.getUpload(c)
+	if upload == nil {
+		return
+	}
+	uh.removeUpload(c, upload)
+	c.Header("Tus-Resumable", tusVersion)
+	c.Status(http.StatusNoContent)
+}
+
+// removeUpload deletes the chunks and the upload record, failures are only
+// logged since the expirer will retry once the upload expires.
+func (uh *UploadHandler) removeUpload(c *gin.Context, upload *store.Upload) {
+	err := media.DeleteUploadChunks(uh.blobStore, upload)
+	if err != nil {
+		logging.FromContext(c).Error("removeUploadDeleteChunks", "error", err)
+		return
+	}
+	err = uh.uploadStore.DeleteUpload(c.Request.Context(), upload.ID)
+	if err != nil {
+		logging.FromContext(c).Error("removeUploadDeleteUpload", "error", err)
+	}
+}
@@ -2,33 +2,42 @@ package api
 
 import (
 	"errors"
-	"log"
+	"fmt"
 	"net/http"
-	"os"
 	"regexp"
+	"time"
+	"todoapp/internal/logging"
+	"todoapp/internal/media"
+	"todoapp/internal/metrics"
 	"todoapp/internal/middleware"
 	"todoapp/internal/store"
 	"todoapp/internal/utils"
 
 	"github.com/gin-gonic/gin"
-	"gorm.io/gorm"
+	"github.com/google/uuid"
 )
 
 type UserHandler struct {
 	userStore  store.UserStore
 	tokenStore store.TokenStore
-	logger     *log.Logger
+	transactor store.Transactor
+	// chunkStore holds the chunks of unfinished uploads
+	chunkStore store.BlobStore
+	cookies    middleware.CookieConfig
 }
 
-func NewUserHanlder(userStore store.UserStore, tokenStore store.TokenStore, logger *log.Logger) *UserHandler {
+func NewUserHanlder(userStore store.UserStore, tokenStore store.TokenStore, transactor store.Transactor, chunkStore store.BlobStore, cookies middleware.CookieConfig) *UserHandler {
 	return &UserHandler{
 		userStore:  userStore,
 		tokenStore: tokenStore,
-		logger:     logger,
+		transactor: transactor,
+		chunkStore: chunkStore,
+		cookies:    cookies,
 	}
 }
 
-var domain = os.Getenv("DOMAIN")
+// SessionMaxAge is how long sessions and their cookies live.
+const SessionMaxAge = time.Hour
 
 type RegisterUserRequest struct {
 	Username string `json:"username" form:"username" binding:"required"`
@@ -40,30 +49,28 @@ func (uh *UserHandler) HandleRegister(c *gin.Context) {
 	request := RegisterUserRequest{}
 	err := c.ShouldBind(&request)
 	if err != nil {
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		middleware.Fail(c, middleware.BindError(err))
 		return
 	}
 	err = validateRegisterRequest(request)
 	if err != nil {
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		middleware.Fail(c, err)
 		return
 	}
-	check, err := uh.userStore.DoesUsernameExist(request.Username)
+	check, err := uh.userStore.DoesUsernameExist(c.Request.Context(), request.Username)
 	if err != nil {
-		uh.logger.Printf("ERROR: doesUsernameExist: %v\n", err)
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		middleware.Fail(c, fmt.Errorf("doesUsernameExist: %w", err))
 		return
 	}
 	if check {
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "username already in use"})
+		middleware.Fail(c, usernameTaken())
 		return
 	}
 
 	hashedPassword, err := utils.HashPassword(request.Password)
 
 	if err != nil {
-		uh.logger.Printf("ERROR: registerUserHashPassword: %v\n", err)
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		middleware.Fail(c, fmt.Errorf("registerUserHashPassword: %w", err))
 		return
 	}
 
@@ -72,102 +79,231 @@ func (uh *UserHandler) HandleRegister(c *gin.Context) {
 		Email:        request.Email,
 		PasswordHash: hashedPassword,
 	}
-	err = uh.userStore.CreateUser(user)
+	// the user is signed in right away, a user without a session must not
+	// be left behind when creating it fails
+	var tokens *store.Token
+	err = uh.transactor.WithinTransaction(c.Request.Context(), func(stores store.Stores) error {
+		err := stores.Users.CreateUser(c.Request.Context(), user)
+		if err != nil {
+			return err
+		}
+		tokens, err = stores.Tokens.CreateToken(c.Request.Context(), user.ID)
+		return err
+	})
 	if err != nil {
-		uh.logger.Printf("ERROR: createUser: %v\n", err)
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "internal server errror"})
+		if errors.Is(err, store.ErrConflict) {
+			// lost the race against a concurrent registration
+			middleware.Fail(c, usernameTaken())
+			return
+		}
+		middleware.Fail(c, fmt.Errorf("registerUser: %w", err))
 		return
 	}
-	c.String(http.StatusCreated, "Successfully created user!")
+	uh.cookies.SetSession(c, tokens.SessionToken.PlainText, tokens.CSRFToken.PlainText, SessionMaxAge)
+	c.IndentedJSON(http.StatusCreated, newUserResponse(user))
+}
 
+func usernameTaken() error {
+	validationErr := &store.ValidationError{}
+	validationErr.Add("username", "is already in use")
+	return validationErr
 }
 
+var emailRegex = regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
+
 func validateRegisterRequest(request RegisterUserRequest) error {
-	if request.Username == "" {
-		return errors.New("username is required")
-	}
-	if len(request.Username) > 50 {
-		return errors.New("username cannot be greater than 50 characters")
-	}
-	if len(request.Username) < 5 {
-		return errors.New("username cannot be smaller than 5 characters")
+	validationErr := &store.ValidationError{}
+	switch {
+	case request.Username == "":
+		validationErr.Add("username", "is required")
+	case len(request.Username) > 50:
+		validationErr.Add("username", "cannot be greater than 50 characters")
+	case len(request.Username) < 5:
+		validationErr.Add("username", "cannot be smaller than 5 characters")
 	}
-	if request.Email == "" {
-		return errors.New("email is required")
-	}
-	emailRegex := regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
-	if !emailRegex.MatchString(request.Email) {
-		return errors.New("invalid email format")
+	switch {
+	case request.Email == "":
+		validationErr.Add("email", "is required")
+	case !emailRegex.MatchString(request.Email):
+		validationErr.Add("email", "is not a valid email address")
 	}
 	if request.Password == "" {
-		return errors.New("password is required")
+		validationErr.Add("password", "is required")
 	}
-	return nil
+	return validationErr.Err()
+}
+
+type LoginRequest struct {
+	Username string `json:"username" form:"username" binding:"required"`
+	Password string `json:"password" form:"password" binding:"required"`
+	// IssueToken returns the session token in the body for clients that
+	// send it as a bearer token, instead of setting cookies.
+	IssueToken bool `json:"issue_token" form:"issue_token"`
+}
+
+type LoginResponse struct {
+	UserResponse
+	Token string `json:"token,omitempty"`
+}
+
+// UserResponse is the public view of a user.
+type UserResponse struct {
+	ID       uuid.UUID `json:"id"`
+	Username string    `json:"username"`
+	Email    string    `json:"email"`
+}
+
+func newUserResponse(user *store.User) UserResponse {
+	return UserResponse{ID: user.ID, Username: user.Username, Email: user.Email}
 }
 
 func (uh *UserHandler) HandleLogin(c *gin.Context) {
-	requestUser := struct {
-		Username string `json:"username" form:"username" binding:"required"`
-		Password string `json:"password" form:"password" binding:"required"`
-	}{}
+	requestUser := LoginRequest{}
 	err := c.ShouldBind(&requestUser)
 	if err != nil {
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		middleware.Fail(c, middleware.BindError(err))
 		return
 	}
 
-	user, err := uh.userStore.GetUserByUsername(requestUser.Username)
+	user, err := uh.userStore.GetUserByUsername(c.Request.Context(), requestUser.Username)
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			c.IndentedJSON(http.StatusUnauthorized, gin.H{"error": "user not registerd"})
+		if errors.Is(err, store.ErrNotFound) {
+			metrics.LoginAttempts.WithLabelValues("unknown_user").Inc()
+			middleware.Fail(c, middleware.NewProblem(http.StatusUnauthorized, "unknown_user", "user not registered"))
 			return
 		}
-		uh.logger.Printf("ERROR: loginGetUserByUsername: %v\n", err)
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		metrics.LoginAttempts.WithLabelValues("error").Inc()
+		middleware.Fail(c, fmt.Errorf("loginGetUserByUsername: %w", err))
 		return
 	}
 	if !utils.CheckPasswordHash(requestUser.Password, user.PasswordHash) {
-		c.IndentedJSON(http.StatusUnauthorized, gin.H{"error": "invalid password"})
+		metrics.LoginAttempts.WithLabelValues("invalid_password").Inc()
+		middleware.Fail(c, middleware.NewProblem(http.StatusUnauthorized, "invalid_password", "invalid password"))
 		return
 	}
 
-	tokens, err := uh.tokenStore.CreateToken(user.ID)
+	err = uh.startSession(c, user, requestUser.IssueToken)
 	if err != nil {
-		uh.logger.Printf("ERROR: createToken: %v\n", err)
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		metrics.LoginAttempts.WithLabelValues("error").Inc()
+		middleware.Fail(c, fmt.Errorf("createToken: %w", err))
 		return
 	}
-	c.SetCookie("session_token", tokens.SessionToken.PlainText, 3600, "/", domain, false, true)
-	c.SetCookie("csrf_token", tokens.CSRFToken.PlainText, 3600, "/", domain, false, false)
-	c.JSON(http.StatusOK, gin.H{"id": user.ID, "username": user.Username, "email": user.Email})
+	metrics.LoginAttempts.WithLabelValues("success").Inc()
+}
+
+// startSession signs the user in, with cookies or by returning the token.
+func (uh *UserHandler) startSession(c *gin.Context, user *store.User, issueToken bool) error {
+	tokens, err := uh.tokenStore.CreateToken(c.Request.Context(), user.ID)
+	if err != nil {
+		return err
+	}
+	response := LoginResponse{UserResponse: newUserResponse(user)}
+	if issueToken {
+		response.Token = tokens.SessionToken.PlainText
+	} else {
+		uh.cookies.SetSession(c, tokens.SessionToken.PlainText, tokens.CSRFToken.PlainText, SessionMaxAge)
+	}
+	c.JSON(http.StatusOK, response)
+	return nil
 }
 
 func (uh *UserHandler) HandleLogout(c *gin.Context) {
 	user := middleware.GetUser(c)
 	if user.IsAnonymous() {
-		c.String(http.StatusOK, "Already not logged in!")
-	} else {
-		err := uh.tokenStore.DeleteAllTokenForUser(user.ID)
+		c.Status(http.StatusNoContent)
+		return
+	}
+	err := uh.tokenStore.DeleteAllTokenForUser(c.Request.Context(), user.ID)
+	if err != nil {
+		middleware.Fail(c, fmt.Errorf("handleLogoutDeleteToken: %w", err))
+		return
+	}
+	uh.cookies.ClearSession(c)
+	c.Status(http.StatusNoContent)
+}
+
+// HandleDeleteAccount moves the user and their posts to the trash and signs
+// them out everywhere. Unfinished uploads are dropped right away, images
+// stay until the account is purged. Within the retention period the account
+// can be restored with HandleRestoreAccount.
+func (uh *UserHandler) HandleDeleteAccount(c *gin.Context) {
+	user := middleware.GetUser(c)
+	var uploads []store.Upload
+	err := uh.transactor.WithinTransaction(c.Request.Context(), func(stores store.Stores) error {
+		err := stores.Tokens.DeleteAllTokenForUser(c.Request.Context(), user.ID)
+		if err != nil {
+			return err
+		}
+		err = stores.Posts.DeletePostsForUser(c.Request.Context(), user.ID)
 		if err != nil {
-			uh.logger.Printf("ERROR: handleLogoutDeleteToken: %v\n", err)
-			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+			return err
+		}
+		uploads, err = stores.Uploads.GetUploadsForUser(c.Request.Context(), user.ID)
+		if err != nil {
+			return err
+		}
+		for _, upload := range uploads {
+			err = stores.Uploads.DeleteUpload(c.Request.Context(), upload.ID)
+			if err != nil {
+				return err
+			}
+		}
+		return stores.Users.DeleteUser(c.Request.Context(), user.ID)
+	})
+	if err != nil {
+		middleware.Fail(c, fmt.Errorf("handleDeleteAccount: %w", err))
+		return
+	}
+	for _, upload := range uploads {
+		err = media.DeleteUploadChunks(uh.chunkStore, &upload)
+		if err != nil {
+			logging.FromContext(c).Error("handleDeleteAccountDeleteChunks", "upload_id", upload.ID, "error", err)
+		}
+	}
+	uh.cookies.ClearSession(c)
+	c.Status(http.StatusNoContent)
+}
+
+// HandleRestoreAccount brings a deleted account back and signs it in, it
+// takes the same credentials as HandleLogin. Posts deleted together with the
+// account stay in the trash to be restored one by one.
+func (uh *UserHandler) HandleRestoreAccount(c *gin.Context) {
+	request := LoginRequest{}
+	err := c.ShouldBind(&request)
+	if err != nil {
+		middleware.Fail(c, middleware.BindError(err))
+		return
+	}
+	user, err := uh.userStore.GetDeletedUserByUsername(c.Request.Context(), request.Username)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			middleware.Fail(c, middleware.NewProblem(http.StatusNotFound, "not_found", "no deleted account with this username"))
 			return
 		}
-		c.SetCookie("session_token", "", -1, "/", domain, false, true)
-		c.SetCookie("csrf_token", "", -1, "/", domain, false, false)
-		c.String(http.StatusOK, "Logout successful!")
+		middleware.Fail(c, fmt.Errorf("handleRestoreAccountGetUser: %w", err))
+		return
+	}
+	if !utils.CheckPasswordHash(request.Password, user.PasswordHash) {
+		middleware.Fail(c, middleware.NewProblem(http.StatusUnauthorized, "invalid_password", "invalid password"))
+		return
+	}
+	err = uh.userStore.RestoreUser(c.Request.Context(), user.ID)
+	if err != nil {
+		middleware.Fail(c, fmt.Errorf("handleRestoreAccount: %w", err))
+		return
+	}
+	err = uh.startSession(c, user, request.IssueToken)
+	if err != nil {
+		middleware.Fail(c, fmt.Errorf("handleRestoreAccountCreateToken: %w", err))
+		return
 	}
 }
 
 func (uh *UserHandler) HandleProtected(c *gin.Context) {
-	c.String(http.StatusOK, "Protected Message")
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Protected Message"})
 }
 
 func (uh *UserHandler) HandleGetuser(c *gin.Context) {
 	user := middleware.GetUser(c)
-	c.IndentedJSON(http.StatusOK, gin.H{
-		"id": user.ID,
-		"username": user.Username,
-		"email":    user.Email,
-	})
+	c.IndentedJSON(http.StatusOK, newUserResponse(user))
 }
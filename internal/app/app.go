@@ -1,51 +1,467 @@
 package app
 
 import (
-	"log"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
 	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 	"todoapp/internal/api"
+	"todoapp/internal/cache"
+	"todoapp/internal/export"
+	"todoapp/internal/health"
+	"todoapp/internal/importer"
+	"todoapp/internal/logging"
+	"todoapp/internal/media"
+	"todoapp/internal/metrics"
 	"todoapp/internal/middleware"
+	"todoapp/internal/ratelimit"
+	"todoapp/internal/retention"
 	"todoapp/internal/store"
 
 	"gorm.io/gorm"
 )
 
 type Application struct {
-	Logger         *log.Logger
+	Logger         *slog.Logger
 	UserHandler    *api.UserHandler
-	PostHandler *api.PostHandler
+	PostHandler    *api.PostHandler
+	UploadHandler  *api.UploadHandler
+	ExportHandler  *api.ExportHandler
+	ImportHandler  *api.ImportHandler
 	Middleware     middleware.UserMiddleware
 	DB             *gorm.DB
+	BlobStore      store.BlobStore
+	ImageProcessor *media.Processor
+	ImageGC        *media.GarbageCollector
+	UploadExpirer  *media.UploadExpirer
+	TrashPurger    *retention.TrashPurger
+	Exporter       *export.Exporter
+	Importer       *importer.Importer
+	Health         *health.Checker
+	RateLimiter    *ratelimit.Limiter
+	RateLimits     RateLimits
+	Security       SecurityPolicies
+	// Replicas routes user and post reads, nil without DB_REPLICA_DSNS.
+	Replicas *store.ReplicaRouter
+	// ReadPrimaryFor is how long a client's reads stay on the primary after
+	// it wrote, so it sees its own changes despite replication lag.
+	ReadPrimaryFor time.Duration
+	// PublicURL is where clients reach the api, empty when links are root
+	// relative.
+	PublicURL string
 }
 
-func NewApplication() (*Application, error) {
-	pgDB, err := store.Open()
+// SecurityPolicies are the security headers per route group.
+type SecurityPolicies struct {
+	// API applies to every response unless a group below overrides it.
+	API middleware.SecurityPolicy
+	// Static covers user uploaded files, which must never run as a page.
+	Static middleware.SecurityPolicy
+	// Docs covers the Swagger UI page.
+	Docs middleware.SecurityPolicy
+}
+
+// RateLimits configures the limiter per route group.
+type RateLimits struct {
+	// Auth covers /register and /login, keyed by ip.
+	Auth ratelimit.Limit
+	// Posts covers writing posts, keyed by user.
+	Posts ratelimit.Limit
+	// Uploads covers the upload endpoints, keyed by user.
+	Uploads ratelimit.Limit
+	// Exports covers requesting account exports, keyed by user.
+	Exports ratelimit.Limit
+	// Imports covers bulk post imports, keyed by user.
+	Imports ratelimit.Limit
+	// CSPReports covers the unauthenticated report collector, keyed by ip.
+	CSPReports ratelimit.Limit
+}
+
+// Options are the startup choices made on the command line.
+type Options struct {
+	// Store selects the store backend, "postgres", "sqlite" or "memory".
+	// DB_DSN points the sql backends at a database. The memory stores lose
+	// everything on restart and are meant for local development.
+	Store string
+}
+
+func NewApplication(opts Options) (*Application, error) {
+	logger := logging.NewFromEnv()
+	slog.SetDefault(logger)
+
+	var db *gorm.DB
+	var userStore store.UserStore
+	var tokenStore store.TokenStore
+	var postStore store.PostStore
+	var imageStore store.ImageStore
+	var uploadStore store.UploadStore
+	var exportStore store.ExportStore
+	var transactor store.Transactor
+	var replicas *store.ReplicaRouter
+	switch opts.Store {
+	case "", "postgres", "sqlite":
+		driver := opts.Store
+		if driver == "" {
+			driver = "postgres"
+		}
+		var err error
+		queryTimeout := durationFromEnv("DB_QUERY_TIMEOUT", 5*time.Second)
+		db, err = store.Open(logger, store.DatabaseConfig{
+			Driver:       driver,
+			DSN:          os.Getenv("DB_DSN"),
+			QueryTimeout: queryTimeout,
+		})
+		if err != nil {
+			return nil, err
+		}
+		replicas, err = openReplicas(logger, driver, queryTimeout)
+		if err != nil {
+			return nil, err
+		}
+		userStore = store.NewPostgresUserStore(db, replicas)
+		tokenStore = store.NewPostgresTokenStore(db)
+		postStore = store.NewPostgresPostStore(db, replicas)
+		imageStore = store.NewPostgresImageStore(db)
+		uploadStore = store.NewPostgresUploadStore(db)
+		exportStore = store.NewPostgresExportStore(db)
+		transactor = store.NewPostgresTransactor(db)
+	case "memory":
+		logger.Warn("using in-memory stores, data is lost on restart")
+		memoryStores := store.NewMemoryStores()
+		userStore = memoryStores.Users
+		tokenStore = memoryStores.Tokens
+		postStore = memoryStores.Posts
+		imageStore = memoryStores.Images
+		uploadStore = memoryStores.Uploads
+		exportStore = memoryStores.Exports
+		transactor = store.NewMemoryTransactor(memoryStores)
+	default:
+		return nil, fmt.Errorf("app: unknown store %q, use postgres, sqlite or memory", opts.Store)
+	}
+
+	// posts are public and identical for everyone, the listing and single
+	// posts are cached for POST_CACHE_TTL
+	postCache, err := cache.Open()
+	if err != nil {
+		return nil, err
+	}
+	if postCache != nil {
+		cachedPostStore := store.NewCachedPostStore(postStore, postCache, durationFromEnv("POST_CACHE_TTL", 30*time.Second))
+		postStore = cachedPostStore
+		transactor = cachedPostStore.Transactor(transactor)
+	}
+
+	blobStore, err := store.OpenBlobStore()
+	if err != nil {
+		return nil, err
+	}
+	// upload chunks and export archives must not be reachable through
+	// /static/images/:key
+	privateBlobStore, err := store.OpenPrivateBlobStore()
 	if err != nil {
 		return nil, err
 	}
 
-	logger := log.New(os.Stdout, "", log.Ldate|log.Ltime)
+	metrics.RegisterActiveSessions(func() (int64, error) {
+		return tokenStore.CountTokensCreatedSince(context.Background(), time.Now().Add(-api.SessionMaxAge))
+	})
 
+	imageProcessor := media.NewProcessor(blobStore, logger, 2, 100)
+
+	ingester := media.NewIngester(imageStore, blobStore, imageProcessor, int64FromEnv("UPLOAD_QUOTA_BYTES", 100<<20), logger)
+
+	cookies, err := middleware.CookieConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
 
-	userStore := store.NewPostgresUserStore(pgDB)
-	tokenStore := store.NewPostgresTokenStore(pgDB)
-	postStore := store.NewPostgresPostStore(pgDB)
+	// PUBLIC_URL is where clients reach the api, e.g. https://api.example.com,
+	// links to uploaded files and exports are root relative without it
+	publicURL := strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
 
-	userHandler := api.NewUserHanlder(userStore, tokenStore, logger)
-	postHandler := api.NewPostHanlder(postStore, logger)
+	userHandler := api.NewUserHanlder(userStore, tokenStore, transactor, privateBlobStore, cookies)
+	trashRetention := durationFromEnv("TRASH_RETENTION", 30*24*time.Hour)
+	postHandler := api.NewPostHanlder(postStore, blobStore, ingester, trashRetention, publicURL)
+	uploadHandler := api.NewUploadHandler(
+		uploadStore,
+		privateBlobStore,
+		ingester,
+		int64FromEnv("UPLOAD_MAX_BYTES", 1<<30),
+		int64FromEnv("UPLOAD_CHUNK_MAX_BYTES", 8<<20),
+		durationFromEnv("UPLOAD_EXPIRY", 24*time.Hour),
+		publicURL,
+	)
+
+	imageGC := media.NewGarbageCollector(
+		imageStore,
+		blobStore,
+		logger,
+		durationFromEnv("IMAGE_GC_GRACE", 24*time.Hour),
+		os.Getenv("IMAGE_GC_DRY_RUN") == "true",
+	)
+
+	uploadExpirer := media.NewUploadExpirer(uploadStore, privateBlobStore, logger)
+
+	exportSigningKey, err := exportSigningKeyFromEnv(logger)
+	if err != nil {
+		return nil, err
+	}
+	exporter := export.NewExporter(
+		export.Stores{
+			Users:   userStore,
+			Posts:   postStore,
+			Images:  imageStore,
+			Tokens:  tokenStore,
+			Exports: exportStore,
+		},
+		blobStore,
+		privateBlobStore,
+		export.NotifierFromEnv(logger),
+		logger,
+		exportSigningKey,
+		durationFromEnv("EXPORT_TTL", 24*time.Hour),
+		durationFromEnv("EXPORT_LINK_TTL", time.Hour),
+	)
+	exportHandler := api.NewExportHandler(exportStore, privateBlobStore, exporter, publicURL)
+
+	postImporter := importer.NewImporter(postStore, ingester, os.Getenv("IMPORT_FETCH_IMAGES") == "true", logger)
+	importHandler := api.NewImportHandler(
+		postImporter,
+		int64FromEnv("IMPORT_MAX_BYTES", 256<<20),
+		durationFromEnv("IMPORT_TIMEOUT", 10*time.Minute),
+		publicURL,
+	)
+
+	trashPurger := retention.NewTrashPurger(userStore, postStore, transactor, blobStore, privateBlobStore, exporter, logger, trashRetention)
+
+	healthChecker := health.NewChecker(
+		durationFromEnv("READINESS_TIMEOUT", 2*time.Second),
+		durationFromEnv("READINESS_CACHE", 5*time.Second),
+		logger,
+	)
+	if db != nil {
+		sqlDB, err := db.DB()
+		if err != nil {
+			return nil, err
+		}
+		metrics.RegisterDB(sqlDB, db.Dialector.Name())
+		healthChecker.Add("database", sqlDB.PingContext)
+		// the schema only changes with a deploy, once it is current there
+		// is no need to look again
+		var migrated atomic.Bool
+		healthChecker.Add("migrations", func(ctx context.Context) error {
+			if migrated.Load() {
+				return nil
+			}
+			err := store.CheckMigrations(db.WithContext(ctx))
+			if err != nil {
+				return err
+			}
+			migrated.Store(true)
+			return nil
+		})
+	}
+	healthChecker.Add("blob_storage", blobStore.Ping)
+
+	if redisCache, ok := postCache.(*cache.RedisCache); ok {
+		healthChecker.Add("cache", redisCache.Ping)
+	}
+
+	rateLimitStore, err := ratelimit.OpenStore()
+	if err != nil {
+		return nil, err
+	}
+	if redisStore, ok := rateLimitStore.(*ratelimit.RedisStore); ok {
+		healthChecker.Add("rate_limit_store", redisStore.Ping)
+	}
+	rateLimits := RateLimits{}
+	rateLimits.Auth, err = limitFromEnv("RATE_LIMIT_AUTH", "10/1m")
+	if err != nil {
+		return nil, err
+	}
+	rateLimits.Posts, err = limitFromEnv("RATE_LIMIT_POSTS", "30/1m,10")
+	if err != nil {
+		return nil, err
+	}
+	rateLimits.Uploads, err = limitFromEnv("RATE_LIMIT_UPLOADS", "600/1m,100")
+	if err != nil {
+		return nil, err
+	}
+	rateLimits.Exports, err = limitFromEnv("RATE_LIMIT_EXPORTS", "3/1h")
+	if err != nil {
+		return nil, err
+	}
+	rateLimits.Imports, err = limitFromEnv("RATE_LIMIT_IMPORTS", "5/1h")
+	if err != nil {
+		return nil, err
+	}
+	rateLimits.CSPReports, err = limitFromEnv("RATE_LIMIT_CSP_REPORTS", "60/1m")
+	if err != nil {
+		return nil, err
+	}
 
 	userMidleware := middleware.UserMiddleware{
-		UserStore:  userStore,
-		TokenStore: tokenStore,
-		Logger:     logger,
+		UserStore:     userStore,
+		TokenStore:    tokenStore,
+		Cookies:       cookies,
+		SessionMaxAge: api.SessionMaxAge,
 	}
 
 	app := &Application{
 		Logger:         logger,
 		UserHandler:    userHandler,
-		PostHandler: postHandler,
+		PostHandler:    postHandler,
+		UploadHandler:  uploadHandler,
+		ExportHandler:  exportHandler,
+		ImportHandler:  importHandler,
 		Middleware:     userMidleware,
-		DB:             pgDB,
+		DB:             db,
+		BlobStore:      blobStore,
+		ImageProcessor: imageProcessor,
+		ImageGC:        imageGC,
+		UploadExpirer:  uploadExpirer,
+		TrashPurger:    trashPurger,
+		Exporter:       exporter,
+		Importer:       postImporter,
+		Health:         healthChecker,
+		RateLimiter:    ratelimit.NewLimiter(rateLimitStore),
+		RateLimits:     rateLimits,
+		Security:       securityPoliciesFromEnv(),
+		Replicas:       replicas,
+		ReadPrimaryFor: durationFromEnv("DB_READ_PRIMARY_AFTER_WRITE", 5*time.Second),
+		PublicURL:      publicURL,
 	}
 	return app, nil
 }
+
+// StartWorkers runs the image processor and the periodic jobs: image GC,
+// upload expiry, account exports and the trash purge. Only the server starts
+// them, one off commands use the application without jobs running next to
+// them.
+func (app *Application) StartWorkers() {
+	app.ImageProcessor.Start()
+	app.ImageGC.Start(durationFromEnv("IMAGE_GC_INTERVAL", time.Hour))
+	app.UploadExpirer.Start(durationFromEnv("UPLOAD_EXPIRY_INTERVAL", 15*time.Minute))
+	app.Exporter.Start(durationFromEnv("EXPORT_EXPIRY_INTERVAL", 15*time.Minute))
+	app.TrashPurger.Start(durationFromEnv("TRASH_PURGE_INTERVAL", time.Hour))
+}
+
+// Close stops background workers once the server no longer accepts requests,
+// workers StartWorkers never started stop right away.
+func (app *Application) Close() {
+	app.TrashPurger.Stop()
+	app.Exporter.Stop()
+	app.UploadExpirer.Stop()
+	app.ImageGC.Stop()
+	app.ImageProcessor.Stop()
+	if app.Replicas != nil {
+		app.Replicas.Stop()
+	}
+}
+
+// openReplicas connects to the comma separated DB_REPLICA_DSNS and starts
+// checking them every DB_REPLICA_CHECK_INTERVAL. Reads only go to the
+// replicas of the user and post stores, sessions, images and uploads are
+// read where they are written.
+func openReplicas(logger *slog.Logger, driver string, queryTimeout time.Duration) (*store.ReplicaRouter, error) {
+	dsns := os.Getenv("DB_REPLICA_DSNS")
+	if dsns == "" {
+		return nil, nil
+	}
+	dbs := []*gorm.DB{}
+	for _, dsn := range strings.Split(dsns, ",") {
+		db, err := store.Open(logger, store.DatabaseConfig{
+			Driver:       driver,
+			DSN:          strings.TrimSpace(dsn),
+			QueryTimeout: queryTimeout,
+			Replica:      true,
+		})
+		if err != nil {
+			return nil, err
+		}
+		dbs = append(dbs, db)
+	}
+	router := store.NewReplicaRouter(dbs, logger)
+	router.Start(durationFromEnv("DB_REPLICA_CHECK_INTERVAL", 5*time.Second))
+	logger.Info("reading from replicas", "replicas", len(dbs))
+	return router, nil
+}
+
+// exportSigningKeyFromEnv reads the hex EXPORT_SIGNING_KEY download links
+// are signed with. Without it a random key is used and links stop working
+// on restart or on other instances.
+func exportSigningKeyFromEnv(logger *slog.Logger) ([]byte, error) {
+	value := os.Getenv("EXPORT_SIGNING_KEY")
+	if value == "" {
+		logger.Warn("EXPORT_SIGNING_KEY is not set, export download links only work on this instance until it restarts")
+		key := make([]byte, 32)
+		_, err := rand.Read(key)
+		return key, err
+	}
+	key, err := hex.DecodeString(value)
+	if err != nil || len(key) < 32 {
+		return nil, fmt.Errorf("app: EXPORT_SIGNING_KEY must be at least 32 hex encoded bytes")
+	}
+	return key, nil
+}
+
+func int64FromEnv(key string, fallback int64) int64 {
+	value, err := strconv.ParseInt(os.Getenv(key), 10, 64)
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func durationFromEnv(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func limitFromEnv(key string, fallback string) (ratelimit.Limit, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		value = fallback
+	}
+	return ratelimit.ParseLimit(value)
+}
+
+// securityPoliciesFromEnv builds the default policies. CSP_API, CSP_STATIC
+// and CSP_DOCS replace a group's Content-Security-Policy, CSP_REPORT_ONLY
+// only reports violations and HSTS_MAX_AGE turns on Strict-Transport-Security.
+func securityPoliciesFromEnv() SecurityPolicies {
+	reportOnly := os.Getenv("CSP_REPORT_ONLY") == "true"
+	hstsMaxAge := durationFromEnv("HSTS_MAX_AGE", 0)
+	policy := func(cspKey string, csp string, corp string) middleware.SecurityPolicy {
+		if value := os.Getenv(cspKey); value != "" {
+			csp = value
+		}
+		return middleware.SecurityPolicy{
+			CSP:                       csp,
+			ReportOnly:                reportOnly,
+			ReportURI:                 "/csp-report",
+			FrameOptions:              "DENY",
+			ReferrerPolicy:            "no-referrer",
+			CrossOriginResourcePolicy: corp,
+			PermissionsPolicy:         "camera=(), microphone=(), geolocation=()",
+			HSTSMaxAge:                hstsMaxAge,
+		}
+	}
+	return SecurityPolicies{
+		API: policy("CSP_API", "default-src 'none'; frame-ancestors 'none'", "same-site"),
+		// the frontend embeds uploads from another origin, sandbox keeps
+		// anything that slips past type sniffing from running scripts
+		Static: policy("CSP_STATIC", "default-src 'none'; img-src 'self'; media-src 'self'; style-src 'unsafe-inline'; sandbox", "cross-origin"),
+		Docs: policy("CSP_DOCS", "default-src 'none'; script-src {nonce} https://unpkg.com; style-src 'unsafe-inline' https://unpkg.com; "+
+			"img-src 'self' data: https:; connect-src 'self'; frame-ancestors 'none'; base-uri 'none'; form-action 'none'", "same-origin"),
+	}
+}
@@ -0,0 +1,162 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Cache keeps encoded values for a limited time. The memory cache is per
+// instance, the redis cache is shared between instances so an invalidation
+// on one reaches all of them.
+type Cache interface {
+	// Get reports false when key is missing or expired.
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, keys ...string) error
+}
+
+// Open picks the backend from CACHE_BACKEND ("memory", "redis" or "off",
+// the redis one connecting to REDIS_URL). The memory cache holds at most
+// CACHE_MAX_ENTRIES values. Open returns nil when caching is off.
+func Open() (Cache, error) {
+	switch backend := os.Getenv("CACHE_BACKEND"); backend {
+	case "", "memory":
+		size, err := strconv.Atoi(os.Getenv("CACHE_MAX_ENTRIES"))
+		if err != nil || size <= 0 {
+			size = 1000
+		}
+		return NewMemoryCache(size), nil
+	case "redis":
+		options, err := redis.ParseURL(os.Getenv("REDIS_URL"))
+		if err != nil {
+			return nil, fmt.Errorf("cache: redis url with %w", err)
+		}
+		return NewRedisCache(redis.NewClient(options)), nil
+	case "off":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("cache: unknown backend %q", backend)
+	}
+}
+
+type entry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// MemoryCache evicts the least recently used value once it is full.
+type MemoryCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func NewMemoryCache(size int) *MemoryCache {
+	return &MemoryCache{
+		size:    size,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+func (mc *MemoryCache) Get(_ context.Context, key string) ([]byte, bool, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	element, ok := mc.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	e := element.Value.(*entry)
+	if time.Now().After(e.expires) {
+		mc.order.Remove(element)
+		delete(mc.entries, key)
+		return nil, false, nil
+	}
+	mc.order.MoveToFront(element)
+	return e.value, true, nil
+}
+
+func (mc *MemoryCache) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	e := &entry{key: key, value: value, expires: time.Now().Add(ttl)}
+	if element, ok := mc.entries[key]; ok {
+		element.Value = e
+		mc.order.MoveToFront(element)
+		return nil
+	}
+	mc.entries[key] = mc.order.PushFront(e)
+	for mc.order.Len() > mc.size {
+		oldest := mc.order.Back()
+		mc.order.Remove(oldest)
+		delete(mc.entries, oldest.Value.(*entry).key)
+	}
+	return nil
+}
+
+func (mc *MemoryCache) Delete(_ context.Context, keys ...string) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for _, key := range keys {
+		if element, ok := mc.entries[key]; ok {
+			mc.order.Remove(element)
+			delete(mc.entries, key)
+		}
+	}
+	return nil
+}
+
+type RedisCache struct {
+	client redis.UniversalClient
+}
+
+func NewRedisCache(client redis.UniversalClient) *RedisCache {
+	return &RedisCache{
+		client: client,
+	}
+}
+
+func (rc *RedisCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	value, err := rc.client.Get(ctx, "cache:"+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("cache: redis with %w", err)
+	}
+	return value, true, nil
+}
+
+func (rc *RedisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	err := rc.client.Set(ctx, "cache:"+key, value, ttl).Err()
+	if err != nil {
+		return fmt.Errorf("cache: redis with %w", err)
+	}
+	return nil
+}
+
+func (rc *RedisCache) Delete(ctx context.Context, keys ...string) error {
+	prefixed := make([]string, 0, len(keys))
+	for _, key := range keys {
+		prefixed = append(prefixed, "cache:"+key)
+	}
+	err := rc.client.Del(ctx, prefixed...).Err()
+	if err != nil {
+		return fmt.Errorf("cache: redis with %w", err)
+	}
+	return nil
+}
+
+func (rc *RedisCache) Ping(ctx context.Context) error {
+	return rc.client.Ping(ctx).Err()
+}
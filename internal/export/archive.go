@@ -0,0 +1,232 @@
+package export
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"time"
+	"todoapp/internal/store"
+
+	"github.com/google/uuid"
+)
+
+// manifest is the archive's table of contents. Posts cannot be commented
+// on, the app has no comments, so they are listed as omitted instead of
+// silently missing.
+type manifest struct {
+	CreatedAt time.Time `json:"created_at"`
+	// Contents describes each file, or group of files, in the archive.
+	Contents map[string]string `json:"contents"`
+	// Omitted explains the data an archive never holds.
+	Omitted map[string]string `json:"omitted"`
+}
+
+var archiveContents = map[string]string{
+	"profile.json":  "the account's profile",
+	"posts.json":    "every post, including those in the trash",
+	"posts/<id>.md": "each post as Markdown with YAML front matter, the format the importer reads",
+	"images.json":   "metadata of the uploaded images",
+	"images/<key>":  "the uploaded images named by key and extension, images missing from storage have an empty file in images.json",
+	"sessions.json": "the open sessions",
+	"manifest.json": "this file",
+}
+
+type profile struct {
+	ID        uuid.UUID `json:"id"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type post struct {
+	ID        uuid.UUID  `json:"id"`
+	Title     string     `json:"title"`
+	Content   string     `json:"content"`
+	Slug      string     `json:"slug,omitempty"`
+	Tags      []string   `json:"tags,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+type image struct {
+	Key         string    `json:"key"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	CreatedAt   time.Time `json:"created_at"`
+	// File is the path inside the archive, empty when the file was missing
+	// from storage.
+	File string `json:"file"`
+}
+
+// session is a login, tokens are deleted on logout so only open sessions
+// are left.
+type session struct {
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// writeArchive zips a manifest, the user's profile, posts as JSON and as
+// Markdown with front matter, images with their metadata and open sessions.
+func writeArchive(ctx context.Context, w io.Writer, stores Stores, blobStore store.BlobStore, user *store.User) error {
+	archive := zip.NewWriter(w)
+	err := writeJSON(archive, "manifest.json", manifest{
+		CreatedAt: time.Now(),
+		Contents:  archiveContents,
+		Omitted: map[string]string{
+			"comments": "posts cannot be commented on, there are no comments to export",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	err = writeJSON(archive, "profile.json", profile{
+		ID:        user.ID,
+		Username:  user.Username,
+		Email:     user.Email,
+		CreatedAt: user.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	live, err := stores.Posts.GetPostsForUser(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	trashed, err := stores.Posts.GetDeletedPostsForUser(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	posts := []post{}
+	for _, p := range append(live, trashed...) {
+		exported := post{ID: p.ID, Title: p.Title, Content: p.Content, Slug: p.Slug, Tags: p.Tags, CreatedAt: p.CreatedAt, UpdatedAt: p.UpdatedAt}
+		if p.DeletedAt.Valid {
+			exported.DeletedAt = &p.DeletedAt.Time
+		}
+		posts = append(posts, exported)
+		err = writeMarkdown(archive, exported)
+		if err != nil {
+			return err
+		}
+	}
+	err = writeJSON(archive, "posts.json", posts)
+	if err != nil {
+		return err
+	}
+
+	userImages, err := stores.Images.GetImagesForUser(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	images := []image{}
+	for _, i := range userImages {
+		exported := image{Key: i.Key, ContentType: i.ContentType, Size: i.Size, CreatedAt: i.CreatedAt}
+		exported.File, err = copyBlob(archive, blobStore, i.Key, i.ContentType)
+		if err != nil {
+			return err
+		}
+		images = append(images, exported)
+	}
+	err = writeJSON(archive, "images.json", images)
+	if err != nil {
+		return err
+	}
+
+	tokens, err := stores.Tokens.GetTokensForUser(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	sessions := []session{}
+	for _, token := range tokens {
+		sessions = append(sessions, session{CreatedAt: token.CreatedAt})
+	}
+	err = writeJSON(archive, "sessions.json", sessions)
+	if err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+func writeJSON(archive *zip.Writer, name string, value any) error {
+	file, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// writeMarkdown writes the post with YAML front matter, the format the
+// importer reads. JSON strings are valid YAML scalars.
+func writeMarkdown(archive *zip.Writer, p post) error {
+	file, err := archive.Create(fmt.Sprintf("posts/%v.md", p.ID))
+	if err != nil {
+		return err
+	}
+	title, err := json.Marshal(p.Title)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(file, "---\ntitle: %s\ndate: %s\nupdated: %s\n", title, p.CreatedAt.Format(time.RFC3339), p.UpdatedAt.Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	if p.Slug != "" {
+		slug, err := json.Marshal(p.Slug)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(file, "slug: %s\n", slug)
+		if err != nil {
+			return err
+		}
+	}
+	if len(p.Tags) > 0 {
+		tags, err := json.Marshal(p.Tags)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(file, "tags: %s\n", tags)
+		if err != nil {
+			return err
+		}
+	}
+	if p.DeletedAt != nil {
+		_, err = fmt.Fprintf(file, "deleted: %s\n", p.DeletedAt.Format(time.RFC3339))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(file, "---\n\n%s\n", p.Content)
+	return err
+}
+
+func copyBlob(archive *zip.Writer, blobStore store.BlobStore, key string, contentType string) (string, error) {
+	blob, _, err := blobStore.Get(key)
+	if errors.Is(err, store.ErrBlobNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer blob.Close()
+	name := "images/" + key
+	extensions, _ := mime.ExtensionsByType(contentType)
+	if len(extensions) > 0 {
+		name += extensions[0]
+	}
+	file, err := archive.Create(name)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(file, blob)
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
@@ -0,0 +1,297 @@
+package export
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+	"todoapp/internal/store"
+	"todoapp/internal/worker"
+
+	"github.com/google/uuid"
+)
+
+// ErrBusy is returned when too many exports are already queued.
+var ErrBusy = errors.New("export queue is full")
+
+// Stores are what an archive is built from.
+type Stores struct {
+	Users   store.UserStore
+	Posts   store.PostStore
+	Images  store.ImageStore
+	Tokens  store.TokenStore
+	Exports store.ExportStore
+}
+
+// Exporter builds account archives in the background, one at a time. A
+// finished archive is announced through the notifier, downloaded through a
+// signed link and deleted once it expires.
+type Exporter struct {
+	stores    Stores
+	blobStore store.BlobStore
+	// archiveStore keeps the archives, private so they are only reachable
+	// through a signed link.
+	archiveStore store.BlobStore
+	notifier     Notifier
+	logger       *slog.Logger
+	signingKey   []byte
+	// ttl is how long a finished archive is kept, linkTTL how long a
+	// download link stays valid.
+	ttl     time.Duration
+	linkTTL time.Duration
+	jobs    chan uuid.UUID
+	mu      sync.Mutex
+	stopped bool
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func NewExporter(stores Stores, blobStore store.BlobStore, archiveStore store.BlobStore, notifier Notifier, logger *slog.Logger, signingKey []byte, ttl time.Duration, linkTTL time.Duration) *Exporter {
+	return &Exporter{
+		stores:       stores,
+		blobStore:    blobStore,
+		archiveStore: archiveStore,
+		notifier:     notifier,
+		logger:       logger,
+		signingKey:   signingKey,
+		ttl:          ttl,
+		linkTTL:      linkTTL,
+		jobs:         make(chan uuid.UUID, 100),
+		stop:         make(chan struct{}),
+	}
+}
+
+// Request records a pending export for the user and queues it.
+func (e *Exporter) Request(ctx context.Context, userId uuid.UUID) (*store.Export, error) {
+	export := &store.Export{
+		UserID:    userId,
+		Status:    store.ExportPending,
+		ExpiresAt: time.Now().Add(e.ttl),
+	}
+	err := e.stores.Exports.CreateExport(ctx, export)
+	if err != nil {
+		return nil, err
+	}
+	if !e.enqueue(export.ID) {
+		err = e.stores.Exports.DeleteExport(context.WithoutCancel(ctx), export.ID)
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrBusy
+	}
+	return export, nil
+}
+
+func (e *Exporter) enqueue(id uuid.UUID) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.stopped {
+		return false
+	}
+	select {
+	case e.jobs <- id:
+		return true
+	default:
+		return false
+	}
+}
+
+// Start runs the worker and removes expired archives every interval.
+// Exports left pending by a previous process are queued again.
+func (e *Exporter) Start(interval time.Duration) {
+	ctx, cancel := worker.Context(e.stop)
+	pending, err := e.stores.Exports.GetPendingExports(ctx)
+	if err != nil {
+		e.logger.Error("exporterPending", "error", err)
+	}
+	for _, export := range pending {
+		e.enqueue(export.ID)
+	}
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		defer cancel()
+		for id := range e.jobs {
+			e.process(ctx, id)
+		}
+	}()
+	worker.Every(interval, e.stop, &e.wg, func(ctx context.Context) {
+		removed, err := e.Expire(ctx)
+		if err != nil {
+			e.logger.Error("exporterExpire", "error", err)
+		}
+		if removed > 0 {
+			e.logger.Info("expired account exports", "removed", removed)
+		}
+	})
+}
+
+// Stop abandons queued exports, they are picked up again on the next Start.
+func (e *Exporter) Stop() {
+	e.mu.Lock()
+	if e.stopped {
+		e.mu.Unlock()
+		return
+	}
+	e.stopped = true
+	close(e.stop)
+	close(e.jobs)
+	e.mu.Unlock()
+	e.wg.Wait()
+}
+
+func (e *Exporter) process(ctx context.Context, id uuid.UUID) {
+	select {
+	case <-e.stop:
+		return
+	default:
+	}
+	export, err := e.stores.Exports.GetExportByID(ctx, id)
+	if err != nil || export.Status != store.ExportPending {
+		return
+	}
+	user, err := e.stores.Users.GetUserByID(ctx, export.UserID)
+	if err == nil {
+		export.Size, err = e.build(ctx, user, export)
+	}
+	if ctx.Err() != nil {
+		// shutting down, stays pending for the next start
+		return
+	}
+	if err != nil {
+		e.logger.Error("exporterBuild", "export_id", export.ID, "error", err)
+		export.Status = store.ExportFailed
+	} else {
+		export.Status = store.ExportReady
+		export.ExpiresAt = time.Now().Add(e.ttl)
+	}
+	err = e.stores.Exports.UpdateExport(ctx, export)
+	if err != nil {
+		e.logger.Error("exporterUpdate", "export_id", export.ID, "error", err)
+		return
+	}
+	if user == nil {
+		return
+	}
+	downloadPath := ""
+	if export.Status == store.ExportReady {
+		downloadPath = e.DownloadPath(export)
+	}
+	err = e.notifier.ExportFinished(ctx, user, export, downloadPath)
+	if err != nil {
+		e.logger.Error("exporterNotify", "export_id", export.ID, "error", err)
+	}
+}
+
+// build writes the archive to a temporary file first, the blob store needs
+// the size up front.
+func (e *Exporter) build(ctx context.Context, user *store.User, export *store.Export) (int64, error) {
+	file, err := os.CreateTemp("", "export-*.zip")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	err = writeArchive(ctx, file, e.stores, e.blobStore, user)
+	if err != nil {
+		return 0, err
+	}
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	err = e.archiveStore.Put(export.BlobKey(), file, size, "application/zip")
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// Expire deletes archives past their expiry and returns how many.
+func (e *Exporter) Expire(ctx context.Context) (int, error) {
+	exports, err := e.stores.Exports.GetExpiredExports(ctx, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, export := range exports {
+		err = e.remove(ctx, &export)
+		if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// DeleteForUser removes every export of the user with its archive.
+func (e *Exporter) DeleteForUser(ctx context.Context, userId uuid.UUID) error {
+	exports, err := e.stores.Exports.GetExportsForUser(ctx, userId)
+	if err != nil {
+		return err
+	}
+	for _, export := range exports {
+		err = e.remove(ctx, &export)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Exporter) remove(ctx context.Context, export *store.Export) error {
+	err := e.archiveStore.Delete(export.BlobKey())
+	if err != nil && !errors.Is(err, store.ErrBlobNotFound) {
+		return err
+	}
+	return e.stores.Exports.DeleteExport(ctx, export.ID)
+}
+
+// DownloadPath is a signed link to the archive, valid for the link ttl but
+// never beyond the archive's expiry.
+func (e *Exporter) DownloadPath(export *store.Export) string {
+	expires := time.Now().Add(e.linkTTL).Unix()
+	expires = min(expires, export.ExpiresAt.Unix())
+	return fmt.Sprintf("/exports/%v/download?expires=%d&signature=%v", export.ID, expires, e.sign(export.ID, expires))
+}
+
+// VerifyDownload checks the expires and signature parameters of a download
+// link and returns when the link expires.
+func (e *Exporter) VerifyDownload(id uuid.UUID, expires string, signature string) (time.Time, bool) {
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return time.Time{}, false
+	}
+	given, err := hex.DecodeString(signature)
+	if err != nil {
+		return time.Time{}, false
+	}
+	expected, _ := hex.DecodeString(e.sign(id, unix))
+	if !hmac.Equal(given, expected) {
+		return time.Time{}, false
+	}
+	return time.Unix(unix, 0), true
+}
+
+// LinkTTL is how long a download link stays valid.
+func (e *Exporter) LinkTTL() time.Duration {
+	return e.linkTTL
+}
+
+func (e *Exporter) sign(id uuid.UUID, expires int64) string {
+	mac := hmac.New(sha256.New, e.signingKey)
+	fmt.Fprintf(mac, "%v|%d", id, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,226 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"todoapp/internal/store"
+
+	"github.com/google/uuid"
+)
+
+type recordingNotifier struct {
+	downloadPaths []string
+}
+
+func (rn *recordingNotifier) ExportFinished(_ context.Context, _ *store.User, _ *store.Export, downloadPath string) error {
+	rn.downloadPaths = append(rn.downloadPaths, downloadPath)
+	return nil
+}
+
+type exportTest struct {
+	ctx      context.Context
+	stores   *store.MemoryStores
+	archives *store.LocalBlobStore
+	notifier *recordingNotifier
+	exporter *Exporter
+}
+
+func newExportTest(t *testing.T) *exportTest {
+	t.Helper()
+	blobs, err := store.NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	archives, err := store.NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := store.NewMemoryStores()
+	notifier := &recordingNotifier{}
+	exporter := NewExporter(Stores{
+		Users:   stores.Users,
+		Posts:   stores.Posts,
+		Images:  stores.Images,
+		Tokens:  stores.Tokens,
+		Exports: stores.Exports,
+	}, blobs, archives, notifier, slog.New(slog.NewTextHandler(io.Discard, nil)), []byte("signing key"), 24*time.Hour, time.Hour)
+	return &exportTest{
+		ctx:      context.Background(),
+		stores:   stores,
+		archives: archives,
+		notifier: notifier,
+		exporter: exporter,
+	}
+}
+
+func (et *exportTest) createUser(t *testing.T, username string) *store.User {
+	t.Helper()
+	user := &store.User{Username: username, Email: username + "@example.com", PasswordHash: "hash"}
+	err := et.stores.Users.CreateUser(et.ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// build requests an export and builds it right away instead of through the
+// worker.
+func (et *exportTest) build(t *testing.T, user *store.User) *store.Export {
+	t.Helper()
+	export, err := et.exporter.Request(et.ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	et.exporter.process(et.ctx, export.ID)
+	export, err = et.stores.Exports.GetExportByID(et.ctx, export.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if export.Status != store.ExportReady {
+		t.Fatalf("export status = %v, want ready", export.Status)
+	}
+	return export
+}
+
+func TestExportArchive(t *testing.T) {
+	et := newExportTest(t)
+	user := et.createUser(t, "exportuser")
+	post := &store.Post{UserID: user.ID, Title: "Hello", Content: "World", Tags: []string{"go"}}
+	err := et.stores.Posts.CreatePost(et.ctx, post)
+	if err != nil {
+		t.Fatal(err)
+	}
+	export := et.build(t, user)
+	if len(et.notifier.downloadPaths) != 1 || et.notifier.downloadPaths[0] == "" {
+		t.Errorf("notified with %v, want one download path", et.notifier.downloadPaths)
+	}
+
+	blob, _, err := et.archives.Get(export.BlobKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	data, err := io.ReadAll(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{}
+	for _, file := range archive.File {
+		reader, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[file.Name], _ = io.ReadAll(reader)
+		reader.Close()
+	}
+	for _, name := range []string{"manifest.json", "profile.json", "posts.json", "images.json", "sessions.json", "posts/" + post.ID.String() + ".md"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("archive is missing %v", name)
+		}
+	}
+	manifest := manifest{}
+	err = json.Unmarshal(files["manifest.json"], &manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Omitted["comments"] == "" {
+		t.Errorf("manifest = %+v, want comments listed as omitted", manifest)
+	}
+	markdown := string(files["posts/"+post.ID.String()+".md"])
+	if !strings.Contains(markdown, `title: "Hello"`) || !strings.Contains(markdown, `tags: ["go"]`) || !strings.HasSuffix(markdown, "World\n") {
+		t.Errorf("markdown = %q, want the front matter and content", markdown)
+	}
+}
+
+func TestVerifyDownload(t *testing.T) {
+	et := newExportTest(t)
+	export := et.build(t, et.createUser(t, "linkuser"))
+	other := et.build(t, et.createUser(t, "otheruser"))
+
+	link, err := url.Parse(et.exporter.DownloadPath(export))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires, signature := link.Query().Get("expires"), link.Query().Get("signature")
+	unix, _ := strconv.ParseInt(expires, 10, 64)
+	past := time.Now().Add(-time.Minute).Unix()
+	tampered := []byte(signature)
+	tampered[0] ^= 1
+	tests := []struct {
+		name      string
+		id        uuid.UUID
+		expires   string
+		signature string
+		valid     bool
+	}{
+		{"valid", export.ID, expires, signature, true},
+		{"tampered signature", export.ID, expires, string(tampered), false},
+		{"not hex", export.ID, expires, "not-a-signature", false},
+		{"extended expiry", export.ID, strconv.FormatInt(unix+3600, 10), signature, false},
+		{"expired", export.ID, strconv.FormatInt(past, 10), et.exporter.sign(export.ID, past), false},
+		{"another export", other.ID, expires, signature, false},
+		{"missing", export.ID, "", "", false},
+	}
+	for _, test := range tests {
+		linkExpires, ok := et.exporter.VerifyDownload(test.id, test.expires, test.signature)
+		if ok != test.valid {
+			t.Errorf("%v: VerifyDownload = %v, want %v", test.name, ok, test.valid)
+		}
+		if ok && linkExpires.Unix() != unix {
+			t.Errorf("%v: link expires %v, want %v", test.name, linkExpires.Unix(), unix)
+		}
+	}
+	if want := time.Now().Add(et.exporter.LinkTTL()).Unix(); unix < want-1 || unix > want {
+		t.Errorf("link expires at %v, want the link ttl from now, %v", unix, want)
+	}
+
+	// links never outlive the archive
+	export.ExpiresAt = time.Now().Add(10 * time.Minute)
+	link, _ = url.Parse(et.exporter.DownloadPath(export))
+	if got := link.Query().Get("expires"); got != fmt.Sprint(export.ExpiresAt.Unix()) {
+		t.Errorf("link of an archive expiring sooner expires at %v, want %v", got, export.ExpiresAt.Unix())
+	}
+}
+
+func TestExpire(t *testing.T) {
+	et := newExportTest(t)
+	expired := et.build(t, et.createUser(t, "expireduser"))
+	kept := et.build(t, et.createUser(t, "keptuser"))
+	expired.ExpiresAt = time.Now().Add(-time.Minute)
+	err := et.stores.Exports.UpdateExport(et.ctx, expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := et.exporter.Expire(et.ctx)
+	if err != nil || removed != 1 {
+		t.Fatalf("Expire = %v, %v, want 1 removed", removed, err)
+	}
+	_, err = et.stores.Exports.GetExportByID(et.ctx, expired.ID)
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("expired export lookup = %v, want it deleted", err)
+	}
+	_, _, err = et.archives.Get(expired.BlobKey())
+	if !errors.Is(err, store.ErrBlobNotFound) {
+		t.Errorf("expired archive lookup = %v, want it deleted", err)
+	}
+	_, _, err = et.archives.Get(kept.BlobKey())
+	if err != nil {
+		t.Errorf("archive that has not expired = %v, want it kept", err)
+	}
+}
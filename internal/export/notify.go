@@ -0,0 +1,93 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+	"todoapp/internal/store"
+	"todoapp/internal/tracing"
+
+	"github.com/google/uuid"
+)
+
+// Notifier tells a user that their export finished, downloadPath is empty
+// when it failed.
+type Notifier interface {
+	ExportFinished(ctx context.Context, user *store.User, export *store.Export, downloadPath string) error
+}
+
+// NotifierFromEnv posts to EXPORT_WEBHOOK_URL when it is set, a mail or
+// push service behind it reaches the user. Without it notifications are
+// only logged and clients poll the export.
+func NotifierFromEnv(logger *slog.Logger) Notifier {
+	url := os.Getenv("EXPORT_WEBHOOK_URL")
+	if url == "" {
+		return &LogNotifier{logger: logger}
+	}
+	return &WebhookNotifier{
+		url:    url,
+		client: tracing.HTTPClient(nil, 10*time.Second),
+	}
+}
+
+type LogNotifier struct {
+	logger *slog.Logger
+}
+
+func (ln *LogNotifier) ExportFinished(_ context.Context, user *store.User, export *store.Export, _ string) error {
+	ln.logger.Info("account export finished", "user_id", user.ID, "export_id", export.ID, "status", export.Status)
+	return nil
+}
+
+// WebhookNotifier posts a JSON event per finished export.
+type WebhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+type webhookEvent struct {
+	Event     string    `json:"event"`
+	UserID    uuid.UUID `json:"user_id"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
+	ExportID  uuid.UUID `json:"export_id"`
+	Status    string    `json:"status"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// DownloadPath is relative to the api's base url.
+	DownloadPath string `json:"download_path,omitempty"`
+}
+
+func (wn *WebhookNotifier) ExportFinished(ctx context.Context, user *store.User, export *store.Export, downloadPath string) error {
+	body, err := json.Marshal(webhookEvent{
+		Event:        "export." + export.Status,
+		UserID:       user.ID,
+		Username:     user.Username,
+		Email:        user.Email,
+		ExportID:     export.ID,
+		Status:       export.Status,
+		ExpiresAt:    export.ExpiresAt,
+		DownloadPath: downloadPath,
+	})
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, wn.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := wn.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("export: webhook answered %v", response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type CheckFunc func(ctx context.Context) error
+
+type check struct {
+	name string
+	fn   CheckFunc
+}
+
+type CheckResult struct {
+	Status     string  `json:"status"`
+	Error      string  `json:"error,omitempty"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+type Report struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// Checker serves liveness and readiness probes. Readiness runs every
+// registered dependency check and turns false while the server drains.
+// Results are reused for cacheFor, so frequent probes from several load
+// balancers don't each hit every dependency.
+type Checker struct {
+	checks   []check
+	timeout  time.Duration
+	cacheFor time.Duration
+	logger   *slog.Logger
+	draining atomic.Bool
+
+	// mu is held during a run, probes arriving meanwhile wait for its result
+	mu      sync.Mutex
+	last    Report
+	checked time.Time
+}
+
+func NewChecker(timeout time.Duration, cacheFor time.Duration, logger *slog.Logger) *Checker {
+	return &Checker{
+		timeout:  timeout,
+		cacheFor: cacheFor,
+		logger:   logger,
+	}
+}
+
+func (hc *Checker) Add(name string, fn CheckFunc) {
+	hc.checks = append(hc.checks, check{name: name, fn: fn})
+}
+
+// SetDraining marks the server as shutting down so load balancers stop
+// sending it new traffic.
+func (hc *Checker) SetDraining() {
+	hc.draining.Store(true)
+}
+
+// Run returns the last report if it is recent enough and otherwise runs
+// the checks.
+func (hc *Checker) Run(ctx context.Context) Report {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if hc.checked.IsZero() || time.Since(hc.checked) >= hc.cacheFor {
+		hc.last = hc.run(ctx)
+		hc.checked = time.Now()
+	}
+	report := Report{
+		Status: hc.last.Status,
+		Checks: hc.last.Checks,
+	}
+	if hc.draining.Load() {
+		report.Status = "draining"
+	}
+	return report
+}
+
+// run checks every dependency. The probe is unauthenticated, so the report
+// only says whether a check failed or timed out and the error is logged.
+func (hc *Checker) run(ctx context.Context) Report {
+	ctx, cancel := context.WithTimeout(ctx, hc.timeout)
+	defer cancel()
+
+	report := Report{
+		Status: "ready",
+		Checks: map[string]CheckResult{},
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, ch := range hc.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			err := ch.fn(ctx)
+			result := CheckResult{
+				Status:     "ok",
+				DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				hc.logger.Error("readiness check failed", "check", ch.name, "error", err)
+				result.Status = "error"
+				result.Error = "check failed"
+				if errors.Is(err, context.DeadlineExceeded) {
+					result.Error = "timed out"
+				}
+			}
+			mu.Lock()
+			report.Checks[ch.name] = result
+			if err != nil {
+				report.Status = "not ready"
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return report
+}
+
+func (hc *Checker) HandleLiveness(c *gin.Context) {
+	c.IndentedJSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func (hc *Checker) HandleReadiness(c *gin.Context) {
+	report := hc.Run(c.Request.Context())
+	status := http.StatusOK
+	if report.Status != "ready" {
+		status = http.StatusServiceUnavailable
+	}
+	c.Header("Cache-Control", "no-store")
+	c.IndentedJSON(status, report)
+}
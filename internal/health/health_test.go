@@ -0,0 +1,92 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestChecker(timeout time.Duration, cacheFor time.Duration) *Checker {
+	return NewChecker(timeout, cacheFor, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func TestCheckerRunResults(t *testing.T) {
+	tests := []struct {
+		name   string
+		fn     CheckFunc
+		status string
+		err    string
+	}{
+		{"ok", func(ctx context.Context) error { return nil }, "ok", ""},
+		{"failed", func(ctx context.Context) error { return errors.New("connection refused") }, "error", "check failed"},
+		{"timed out", func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}, "error", "timed out"},
+		{"wrapped timeout", func(ctx context.Context) error {
+			<-ctx.Done()
+			return errors.Join(errors.New("ping"), ctx.Err())
+		}, "error", "timed out"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hc := newTestChecker(20*time.Millisecond, 0)
+			hc.Add("dependency", test.fn)
+			report := hc.Run(context.Background())
+			result := report.Checks["dependency"]
+			if result.Status != test.status || result.Error != test.err {
+				t.Errorf("result = %+v, want status %q and error %q", result, test.status, test.err)
+			}
+			wantStatus := "ready"
+			if test.status != "ok" {
+				wantStatus = "not ready"
+			}
+			if report.Status != wantStatus {
+				t.Errorf("report status = %q, want %q", report.Status, wantStatus)
+			}
+		})
+	}
+}
+
+func TestCheckerRunCaches(t *testing.T) {
+	var calls atomic.Int32
+	hc := newTestChecker(time.Second, 50*time.Millisecond)
+	hc.Add("dependency", func(ctx context.Context) error {
+		calls.Add(1)
+		return nil
+	})
+	hc.Run(context.Background())
+	hc.Run(context.Background())
+	if got := calls.Load(); got != 1 {
+		t.Errorf("checks ran %v times within cacheFor, want 1", got)
+	}
+	time.Sleep(60 * time.Millisecond)
+	hc.Run(context.Background())
+	if got := calls.Load(); got != 2 {
+		t.Errorf("checks ran %v times after cacheFor, want 2", got)
+	}
+}
+
+func TestCheckerRunDraining(t *testing.T) {
+	hc := newTestChecker(time.Second, time.Minute)
+	hc.Add("dependency", func(ctx context.Context) error { return nil })
+	if report := hc.Run(context.Background()); report.Status != "ready" {
+		t.Fatalf("status = %q, want ready", report.Status)
+	}
+	hc.SetDraining()
+	report := hc.Run(context.Background())
+	if report.Status != "draining" {
+		t.Errorf("status = %q, want draining", report.Status)
+	}
+	if report.Checks["dependency"].Status != "ok" {
+		t.Errorf("draining changed the check result to %+v", report.Checks["dependency"])
+	}
+	// draining must not leak into the cached report
+	if hc.last.Status != "ready" {
+		t.Errorf("cached status = %q, want ready", hc.last.Status)
+	}
+}
@@ -0,0 +1,233 @@
+package importer
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+	"todoapp/internal/media"
+	"todoapp/internal/tracing"
+)
+
+var (
+	// markdownImage captures the url of ![alt](url "title").
+	markdownImage = regexp.MustCompile(`!\[[^\]]*\]\(\s*<?([^)\s>]+)>?(?:\s+["'(][^)]*)?\)`)
+	htmlImage     = regexp.MustCompile(`(?i)<img\b[^>]*>`)
+	srcAttribute  = regexp.MustCompile(`(?i)\bsrc\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+	// srcsetAttribute points at the old site's resized copies, it is dropped
+	// once src is rewritten.
+	srcsetAttribute = regexp.MustCompile(`(?i)\s+(?:srcset|sizes)\s*=\s*(?:"[^"]*"|'[^']*')`)
+)
+
+var errImageNotFound = errors.New("not found in the archive")
+
+// rewriteImages uploads the images a post embeds and points the references
+// at the copies. Images that can't be uploaded are left alone and reported
+// as warnings.
+func (ru *run) rewriteImages(ctx context.Context, dir string, content string) (string, int, []string) {
+	rewritten := 0
+	var warnings []string
+	replace := func(ref string) (string, bool) {
+		newURL, err := ru.image(ctx, dir, ref)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("image %v: %v", ref, err))
+			return "", false
+		}
+		if newURL == "" {
+			return "", false
+		}
+		rewritten++
+		return newURL, true
+	}
+
+	content = markdownImage.ReplaceAllStringFunc(content, func(match string) string {
+		ref := markdownImage.FindStringSubmatch(match)[1]
+		newURL, ok := replace(ref)
+		if !ok {
+			return match
+		}
+		return strings.Replace(match, ref, newURL, 1)
+	})
+	content = htmlImage.ReplaceAllStringFunc(content, func(tag string) string {
+		src := srcAttribute.FindStringSubmatch(tag)
+		if src == nil {
+			return tag
+		}
+		ref := src[1] + src[2]
+		newURL, ok := replace(ref)
+		if !ok {
+			return tag
+		}
+		tag = strings.Replace(tag, src[0], `src="`+newURL+`"`, 1)
+		return srcsetAttribute.ReplaceAllString(tag, "")
+	})
+	return content, rewritten, warnings
+}
+
+// image uploads the image behind ref once per import and returns its new
+// url, or "" for references that stay as they are.
+func (ru *run) image(ctx context.Context, dir string, ref string) (string, error) {
+	if strings.HasPrefix(ref, "data:") || strings.HasPrefix(ref, "#") {
+		return "", nil
+	}
+	file := ru.assets.find(dir, ref)
+	cacheKey := ref
+	if file != nil {
+		cacheKey = file.Name
+	}
+	if newURL, ok := ru.uploaded[cacheKey]; ok {
+		return newURL, nil
+	}
+	var data []byte
+	var err error
+	switch {
+	case file != nil:
+		data, err = readFile(file, media.MaxImageBytes)
+	case ru.importer.fetcher != nil && isRemote(ref):
+		data, err = ru.importer.fetcher.fetch(ctx, ref)
+	case isRemote(ref):
+		err = fmt.Errorf("%w and fetching remote images is off", errImageNotFound)
+	default:
+		err = errImageNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	result, err := ru.importer.ingester.Ingest(ctx, ru.userId, bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+	newURL := ru.imageBaseURL + "/static/images/" + result.Key
+	ru.uploaded[cacheKey] = newURL
+	return newURL, nil
+}
+
+func isRemote(ref string) bool {
+	return strings.HasPrefix(ref, "http://") || strings.HasPrefix(ref, "https://")
+}
+
+// assets finds the files of an archive that image references point at.
+// Absolute urls, like those of a WordPress export next to its uploads
+// folder, are matched by the longest common path suffix.
+type assets struct {
+	files map[string]*zip.File
+	// byName indexes files by lower case base name, with and without the
+	// extension, since our own exports link images without one.
+	byName map[string][]*zip.File
+}
+
+func newAssets(files []*zip.File) *assets {
+	a := &assets{files: map[string]*zip.File{}, byName: map[string][]*zip.File{}}
+	for _, file := range files {
+		if file.FileInfo().IsDir() || isHidden(file.Name) {
+			continue
+		}
+		a.files[file.Name] = file
+		base := strings.ToLower(path.Base(file.Name))
+		a.byName[base] = append(a.byName[base], file)
+		if stem := strings.TrimSuffix(base, path.Ext(base)); stem != base {
+			a.byName[stem] = append(a.byName[stem], file)
+		}
+	}
+	return a
+}
+
+func (a *assets) find(dir string, ref string) *zip.File {
+	u, err := url.Parse(ref)
+	if err != nil || u.Path == "" {
+		return nil
+	}
+	if u.Scheme == "" && u.Host == "" {
+		candidates := []string{strings.TrimPrefix(path.Clean("/"+u.Path), "/")}
+		if !strings.HasPrefix(u.Path, "/") {
+			candidates = append([]string{path.Join(dir, u.Path)}, candidates...)
+		}
+		for _, name := range candidates {
+			if file, ok := a.files[name]; ok {
+				return file
+			}
+		}
+	}
+	var best *zip.File
+	bestScore := -1
+	for _, file := range a.byName[strings.ToLower(path.Base(u.Path))] {
+		score := commonSuffix(file.Name, u.Path)
+		if score > bestScore {
+			best, bestScore = file, score
+		}
+	}
+	return best
+}
+
+// commonSuffix counts the trailing path elements a and b share.
+func commonSuffix(a string, b string) int {
+	aParts := strings.Split(a, "/")
+	bParts := strings.Split(b, "/")
+	n := 0
+	for n < len(aParts) && n < len(bParts) && aParts[len(aParts)-1-n] == bParts[len(bParts)-1-n] {
+		n++
+	}
+	return n
+}
+
+var errPrivateAddress = errors.New("refusing to fetch from a private address")
+
+// fetcher downloads remote images. It only connects to public addresses so
+// an import can't be used to reach internal services.
+type fetcher struct {
+	client *http.Client
+}
+
+func newFetcher() *fetcher {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: publicOnly}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	// a proxy would connect on our behalf and skip the address check
+	transport.Proxy = nil
+	return &fetcher{client: tracing.HTTPClient(transport, 30*time.Second)}
+}
+
+func publicOnly(_ string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return errPrivateAddress
+	}
+	return nil
+}
+
+func (f *fetcher) fetch(ctx context.Context, ref string) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, ref, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := f.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download answered %v", response.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(response.Body, media.MaxImageBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > media.MaxImageBytes {
+		return nil, media.ErrFileTooLarge
+	}
+	return data, nil
+}
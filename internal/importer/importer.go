@@ -0,0 +1,374 @@
+package importer
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"todoapp/internal/media"
+	"todoapp/internal/store"
+	"unicode"
+
+	"github.com/google/uuid"
+)
+
+// ErrUnsupportedFormat is returned for files that are neither a zip nor a
+// WordPress export.
+var ErrUnsupportedFormat = errors.New("import: expected a zip of markdown files or a WordPress WXR export")
+
+const (
+	StatusImported = "imported"
+	StatusSkipped  = "skipped"
+	StatusFailed   = "failed"
+)
+
+// maxDocumentBytes bounds a single markdown or WXR file read from an
+// archive, the declared sizes in a zip can't be trusted.
+const maxDocumentBytes = 32 << 20
+
+// Report lists what happened to every item of an import.
+type Report struct {
+	Imported int          `json:"imported"`
+	Skipped  int          `json:"skipped"`
+	Failed   int          `json:"failed"`
+	Items    []ItemReport `json:"items"`
+	// Stopped says why the import ended before the last item, e.g. a
+	// timeout. Running it again picks up where it stopped.
+	Stopped string `json:"stopped,omitempty"`
+}
+
+type ItemReport struct {
+	// Source is the file in the archive or the WXR item the post came from.
+	Source string     `json:"source"`
+	Title  string     `json:"title"`
+	Slug   string     `json:"slug,omitempty"`
+	Status string     `json:"status"`
+	PostID *uuid.UUID `json:"post_id,omitempty"`
+	// Images is how many image references now point at uploaded copies.
+	Images int `json:"images"`
+	// Error says why the item was skipped or failed.
+	Error string `json:"error,omitempty"`
+	// Warnings list images that were left pointing at their old location.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+func (r *Report) add(item ItemReport) {
+	switch item.Status {
+	case StatusImported:
+		r.Imported++
+	case StatusSkipped:
+		r.Skipped++
+	case StatusFailed:
+		r.Failed++
+	}
+	r.Items = append(r.Items, item)
+}
+
+// item is a post read from one of the supported formats.
+type item struct {
+	source  string
+	title   string
+	slug    string
+	tags    []string
+	created time.Time
+	updated time.Time
+	content string
+	// dir is where relative image references in an archive start from.
+	dir string
+	// skip is why the item is not imported, e.g. a draft.
+	skip string
+	// err is why the item could not be read.
+	err error
+}
+
+// Importer creates posts from Markdown archives and WordPress exports. Items
+// are imported one by one, a failing item is reported and the rest still
+// go through. Posts whose slug the user already has are skipped, so an
+// import can be repeated after fixing what failed.
+type Importer struct {
+	postStore store.PostStore
+	ingester  *media.Ingester
+	fetcher   *fetcher
+	logger    *slog.Logger
+}
+
+// NewImporter downloads images that are not part of the archive when
+// fetchImages is set, otherwise they keep pointing at their old location.
+func NewImporter(postStore store.PostStore, ingester *media.Ingester, fetchImages bool, logger *slog.Logger) *Importer {
+	importer := &Importer{
+		postStore: postStore,
+		ingester:  ingester,
+		logger:    logger,
+	}
+	if fetchImages {
+		importer.fetcher = newFetcher()
+	}
+	return importer
+}
+
+// Import reads a zip of markdown files, optionally with WXR files and the
+// images they reference, or a bare WXR file. Re-uploaded images are linked
+// as imageBaseURL + "/static/images/<key>". A canceled ctx ends the import
+// with the report of what was done so far.
+func (im *Importer) Import(ctx context.Context, userId uuid.UUID, r io.ReaderAt, size int64, imageBaseURL string) (*Report, error) {
+	report, err := im.run(ctx, userId, r, size, imageBaseURL)
+	if report != nil && ctx.Err() != nil {
+		report.Stopped = ctx.Err().Error()
+		return report, nil
+	}
+	return report, err
+}
+
+func (im *Importer) run(ctx context.Context, userId uuid.UUID, r io.ReaderAt, size int64, imageBaseURL string) (*Report, error) {
+	magic := make([]byte, 4)
+	n, _ := r.ReadAt(magic, 0)
+	run := &run{
+		importer:     im,
+		userId:       userId,
+		imageBaseURL: imageBaseURL,
+		report:       &Report{Items: []ItemReport{}},
+		uploaded:     map[string]string{},
+	}
+	if bytes.Equal(magic[:n], []byte("PK\x03\x04")) {
+		archive, err := zip.NewReader(r, size)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnsupportedFormat, err)
+		}
+		err = run.archive(ctx, archive)
+		if err != nil {
+			return run.report, err
+		}
+		return run.report, nil
+	}
+	items, err := parseWXR(io.NewSectionReader(r, 0, size), "")
+	if err != nil {
+		return nil, err
+	}
+	run.assets = newAssets(nil)
+	err = run.items(ctx, items)
+	if err != nil {
+		return run.report, err
+	}
+	return run.report, nil
+}
+
+// run is the state of one import.
+type run struct {
+	importer     *Importer
+	userId       uuid.UUID
+	imageBaseURL string
+	assets       *assets
+	report       *Report
+	// uploaded maps image references to their new url, so an image used
+	// by several posts is uploaded once.
+	uploaded map[string]string
+}
+
+func (ru *run) archive(ctx context.Context, archive *zip.Reader) error {
+	ru.assets = newAssets(archive.File)
+	files := append([]*zip.File{}, archive.File...)
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	found := false
+	for _, file := range files {
+		if file.FileInfo().IsDir() || isHidden(file.Name) {
+			continue
+		}
+		switch strings.ToLower(path.Ext(file.Name)) {
+		case ".md", ".markdown":
+			found = true
+			data, err := readFile(file, maxDocumentBytes)
+			if err != nil {
+				ru.report.add(ItemReport{Source: file.Name, Status: StatusFailed, Error: err.Error()})
+				continue
+			}
+			post, err := parseMarkdown(file.Name, data)
+			if err != nil {
+				post.err = err
+			}
+			err = ru.items(ctx, []item{post})
+			if err != nil {
+				return err
+			}
+		case ".xml":
+			reader, err := file.Open()
+			if err != nil {
+				return err
+			}
+			items, err := parseWXR(io.LimitReader(reader, maxDocumentBytes), file.Name)
+			reader.Close()
+			if errors.Is(err, ErrUnsupportedFormat) {
+				// some other xml file that came along
+				continue
+			}
+			found = true
+			if err != nil {
+				ru.report.add(ItemReport{Source: file.Name, Status: StatusFailed, Error: err.Error()})
+				continue
+			}
+			err = ru.items(ctx, items)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if !found {
+		return fmt.Errorf("%w: the archive holds no .md or WXR files", ErrUnsupportedFormat)
+	}
+	return nil
+}
+
+// items imports each item, only a canceled context stops the run.
+func (ru *run) items(ctx context.Context, items []item) error {
+	for _, it := range items {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+		ru.report.add(ru.item(ctx, it))
+	}
+	return nil
+}
+
+func (ru *run) item(ctx context.Context, it item) ItemReport {
+	report := ItemReport{Source: it.source, Title: it.title, Slug: slugify(it.slug)}
+	if it.err != nil {
+		report.Status = StatusFailed
+		report.Error = it.err.Error()
+		return report
+	}
+	if it.skip != "" {
+		report.Status = StatusSkipped
+		report.Error = it.skip
+		return report
+	}
+	if strings.TrimSpace(it.title) == "" {
+		report.Status = StatusFailed
+		report.Error = "title is required"
+		return report
+	}
+	if strings.TrimSpace(it.content) == "" {
+		report.Status = StatusFailed
+		report.Error = "content is required"
+		return report
+	}
+	if report.Slug == "" {
+		report.Slug = slugify(it.title)
+	}
+	if report.Slug == "" {
+		// posts created through the api have no slug, never match them
+		report.Slug = slugify(it.source)
+	}
+	_, err := ru.importer.postStore.GetPostBySlug(ctx, ru.userId, report.Slug)
+	if err == nil {
+		report.Status = StatusSkipped
+		report.Error = "a post with this slug already exists"
+		return report
+	}
+	if !errors.Is(err, store.ErrNotFound) {
+		report.Status = StatusFailed
+		report.Error = err.Error()
+		return report
+	}
+
+	content, images, warnings := ru.rewriteImages(ctx, it.dir, it.content)
+	report.Images = images
+	report.Warnings = warnings
+	post := &store.Post{
+		UserID:    ru.userId,
+		Title:     it.title,
+		Content:   content,
+		Slug:      report.Slug,
+		Tags:      it.tags,
+		CreatedAt: it.created,
+		UpdatedAt: it.updated,
+	}
+	if post.UpdatedAt.Before(post.CreatedAt) {
+		post.UpdatedAt = post.CreatedAt
+	}
+	err = ru.importer.postStore.CreatePost(ctx, post)
+	if err != nil {
+		report.Status = StatusFailed
+		report.Error = err.Error()
+		return report
+	}
+	report.Status = StatusImported
+	report.PostID = &post.ID
+	return report
+}
+
+func readFile(file *zip.File, limit int64) ([]byte, error) {
+	reader, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, media.ErrFileTooLarge
+	}
+	return data, nil
+}
+
+// isHidden skips the metadata macOS and editors put into archives.
+func isHidden(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") || part == "__MACOSX" {
+			return true
+		}
+	}
+	return false
+}
+
+// slugify lowercases s and joins its words with dashes.
+func slugify(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			dash = false
+			b.WriteRune(r)
+			continue
+		}
+		dash = true
+	}
+	return b.String()
+}
+
+// LogReport writes a line per item and a summary, for the import command.
+func (im *Importer) LogReport(report *Report) {
+	for _, item := range report.Items {
+		level := slog.LevelInfo
+		attrs := []any{"source", item.Source, "title", item.Title, "status", item.Status}
+		switch item.Status {
+		case StatusImported:
+			attrs = append(attrs, "post_id", item.PostID, "slug", item.Slug, "images", item.Images)
+		case StatusSkipped:
+			attrs = append(attrs, "reason", item.Error)
+		default:
+			level = slog.LevelError
+			attrs = append(attrs, "error", item.Error)
+		}
+		if len(item.Warnings) > 0 {
+			level = max(level, slog.LevelWarn)
+			attrs = append(attrs, "warnings", item.Warnings)
+		}
+		im.logger.Log(context.Background(), level, "import item", attrs...)
+	}
+	if report.Stopped != "" {
+		im.logger.Error("import stopped early", "reason", report.Stopped)
+	}
+	im.logger.Info("import", "imported", report.Imported, "skipped", report.Skipped, "failed", report.Failed)
+}
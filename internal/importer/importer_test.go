@@ -0,0 +1,380 @@
+package importer
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"todoapp/internal/media"
+	"todoapp/internal/store"
+
+	"github.com/google/uuid"
+)
+
+func TestParseMarkdown(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		data    string
+		title   string
+		slug    string
+		tags    []string
+		created time.Time
+		content string
+		skip    string
+	}{
+		{
+			name:    "front matter",
+			file:    "posts/hello.md",
+			data:    "---\ntitle: Hello\nslug: hello-world\ndate: 2021-03-04T10:00:00+02:00\ntags: [go, Go, web]\n---\nBody text\n",
+			title:   "Hello",
+			slug:    "hello-world",
+			tags:    []string{"go", "web"},
+			created: time.Date(2021, 3, 4, 8, 0, 0, 0, time.UTC),
+			content: "Body text",
+		},
+		{
+			name:    "crlf and tags separated by commas",
+			file:    "hello.md",
+			data:    "---\r\ntitle: Hello\r\ntags: go, web\r\n---\r\nBody\r\n",
+			title:   "Hello",
+			tags:    []string{"go", "web"},
+			content: "Body",
+		},
+		{
+			name:    "jekyll file name",
+			file:    "_posts/2021-03-04-my-first-post.md",
+			data:    "---\ntags: go web\n---\nBody",
+			title:   "my first post",
+			slug:    "my-first-post",
+			tags:    []string{"go", "web"},
+			created: time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC),
+			content: "Body",
+		},
+		{
+			name:    "heading",
+			file:    "notes.md",
+			data:    "# A heading #\n\nBody",
+			title:   "A heading",
+			content: "Body",
+		},
+		{
+			name:    "file name",
+			file:    "some-notes.markdown",
+			data:    "Body",
+			title:   "some notes",
+			content: "Body",
+		},
+		{
+			name:    "draft",
+			file:    "draft.md",
+			data:    "---\ntitle: Draft\ndraft: true\n---\nBody",
+			title:   "Draft",
+			content: "Body",
+			skip:    "drafts are not imported",
+		},
+		{
+			name:    "jekyll unpublished",
+			file:    "unpublished.md",
+			data:    "---\ntitle: Unpublished\npublished: false\n---\nBody",
+			title:   "Unpublished",
+			content: "Body",
+			skip:    "drafts are not imported",
+		},
+		{
+			name:    "deleted",
+			file:    "deleted.md",
+			data:    "---\ntitle: Deleted\ndeleted: 2022-01-01\n---\nBody",
+			title:   "Deleted",
+			content: "Body",
+			skip:    "the post was deleted",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			it, err := parseMarkdown(test.file, []byte(test.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if it.title != test.title || it.slug != test.slug || it.content != test.content || it.skip != test.skip {
+				t.Errorf("item = %q %q %q %q, want %q %q %q %q", it.title, it.slug, it.content, it.skip, test.title, test.slug, test.content, test.skip)
+			}
+			if !reflect.DeepEqual(it.tags, test.tags) {
+				t.Errorf("tags = %v, want %v", it.tags, test.tags)
+			}
+			if !it.created.Equal(test.created) {
+				t.Errorf("created = %v, want %v", it.created, test.created)
+			}
+		})
+	}
+}
+
+func TestParseMarkdownErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"unclosed front matter", "---\ntitle: Hello\nBody", "front matter is not closed"},
+		{"invalid yaml", "---\ntitle: [\n---\nBody", "front matter:"},
+		{"unknown date", "---\ntitle: Hello\ndate: yesterday\n---\nBody", "date:"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseMarkdown("post.md", []byte(test.data))
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("error = %v, want it to contain %q", err, test.err)
+			}
+		})
+	}
+}
+
+const testWXR = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:content="http://purl.org/rss/1.0/modules/content/" xmlns:wp="http://wordpress.org/export/1.2/">
+<channel>
+	<item>
+		<title>Hello &amp; welcome</title>
+		<pubDate>Thu, 04 Mar 2021 10:00:00 +0000</pubDate>
+		<content:encoded><![CDATA[<!-- wp:paragraph -->
+<p>Body</p>
+<!-- /wp:paragraph -->]]></content:encoded>
+		<wp:post_id>1</wp:post_id>
+		<wp:post_date_gmt>2021-03-04 10:00:00</wp:post_date_gmt>
+		<wp:post_modified_gmt>2021-03-05 10:00:00</wp:post_modified_gmt>
+		<wp:post_name>gr%c3%bc%c3%9fe</wp:post_name>
+		<wp:status>publish</wp:status>
+		<wp:post_type>post</wp:post_type>
+		<category domain="category" nicename="news"><![CDATA[News]]></category>
+		<category domain="post_tag" nicename="go"><![CDATA[go]]></category>
+	</item>
+	<item>
+		<title>Draft</title>
+		<pubDate>Thu, 04 Mar 2021 10:00:00 +0000</pubDate>
+		<wp:post_id>2</wp:post_id>
+		<wp:post_date_gmt>0000-00-00 00:00:00</wp:post_date_gmt>
+		<wp:status>draft</wp:status>
+		<wp:post_type>post</wp:post_type>
+	</item>
+	<item>
+		<title>Private</title>
+		<wp:post_id>3</wp:post_id>
+		<wp:status>private</wp:status>
+		<wp:post_type>post</wp:post_type>
+	</item>
+	<item>
+		<title>About</title>
+		<wp:post_id>4</wp:post_id>
+		<wp:status>publish</wp:status>
+		<wp:post_type>page</wp:post_type>
+	</item>
+	<item>
+		<title>photo.jpg</title>
+		<wp:post_id>5</wp:post_id>
+		<wp:post_type>attachment</wp:post_type>
+	</item>
+</channel>
+</rss>`
+
+func TestParseWXR(t *testing.T) {
+	items, err := parseWXR(strings.NewReader(testWXR), "export.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 4 {
+		t.Fatalf("parsed %v items, want 4 without the attachment", len(items))
+	}
+
+	post := items[0]
+	if post.source != "export.xml item 1" || post.title != "Hello & welcome" || post.slug != "grüße" {
+		t.Errorf("post = %q %q %q, want the source, unescaped title and decoded slug", post.source, post.title, post.slug)
+	}
+	if post.content != "<p>Body</p>" {
+		t.Errorf("content = %q, want the block comments removed", post.content)
+	}
+	if !reflect.DeepEqual(post.tags, []string{"go"}) {
+		t.Errorf("tags = %v, want only the post tags", post.tags)
+	}
+	if !post.created.Equal(time.Date(2021, 3, 4, 10, 0, 0, 0, time.UTC)) || !post.updated.Equal(time.Date(2021, 3, 5, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("dates = %v %v, want the gmt dates", post.created, post.updated)
+	}
+
+	skips := []string{
+		"draft posts are not imported",
+		"private posts are not imported, posts here are public",
+		"page items are not imported",
+	}
+	for i, skip := range skips {
+		if items[i+1].skip != skip {
+			t.Errorf("item %v skip = %q, want %q", items[i+1].source, items[i+1].skip, skip)
+		}
+	}
+
+	_, err = parseWXR(strings.NewReader(`<feed></feed>`), "feed.xml")
+	if !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("error for another xml file = %v, want ErrUnsupportedFormat", err)
+	}
+}
+
+// newTestImporter imports into memory stores with images kept on disk.
+func newTestImporter(t *testing.T) (*Importer, *store.MemoryStores) {
+	t.Helper()
+	stores := store.NewMemoryStores()
+	blobStore, err := store.NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ingester := media.NewIngester(stores.Images, blobStore, media.NewProcessor(blobStore, logger, 1, 10), 0, logger)
+	return NewImporter(stores.Posts, ingester, false, logger), stores
+}
+
+// zipOf builds an archive of the given files.
+func zipOf(t *testing.T, files map[string]string) *bytes.Reader {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	writer := zip.NewWriter(buf)
+	for name, content := range files {
+		file, err := writer.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write([]byte(content))
+	}
+	err := writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestImportSkipsExistingSlugs(t *testing.T) {
+	ctx := context.Background()
+	importer, stores := newTestImporter(t)
+	userId := uuid.New()
+	existing := &store.Post{UserID: userId, Title: "Existing", Content: "Already here", Slug: "existing"}
+	err := stores.Posts.CreatePost(ctx, existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := zipOf(t, map[string]string{
+		"existing.md": "---\ntitle: Imported again\nslug: existing\n---\nNew content",
+		"new.md":      "---\ntitle: New post\n---\nBody",
+		"draft.md":    "---\ntitle: Draft\ndraft: true\n---\nBody",
+		"empty.md":    "---\ntitle: Empty\n---\n",
+	})
+
+	report, err := importer.Import(ctx, userId, archive, archive.Size(), "https://api.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"draft.md":    StatusSkipped,
+		"empty.md":    StatusFailed,
+		"existing.md": StatusSkipped,
+		"new.md":      StatusImported,
+	}
+	for _, item := range report.Items {
+		if item.Status != want[item.Source] {
+			t.Errorf("%v status = %v (%v), want %v", item.Source, item.Status, item.Error, want[item.Source])
+		}
+	}
+	if report.Imported != 1 || report.Skipped != 2 || report.Failed != 1 {
+		t.Errorf("report = %v imported, %v skipped, %v failed, want 1, 2 and 1", report.Imported, report.Skipped, report.Failed)
+	}
+	post, err := stores.Posts.GetPostBySlug(ctx, userId, "existing")
+	if err != nil || post.ID != existing.ID || post.Content != "Already here" {
+		t.Errorf("existing post = %+v, %v, want it left alone", post, err)
+	}
+	_, err = stores.Posts.GetPostBySlug(ctx, userId, "new-post")
+	if err != nil {
+		t.Errorf("imported post by its title slug: %v", err)
+	}
+
+	// importing again skips what the first run created
+	report, err = importer.Import(ctx, userId, archive, archive.Size(), "https://api.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported != 0 || report.Skipped != 3 {
+		t.Errorf("repeated import = %v imported, %v skipped, want 0 and 3", report.Imported, report.Skipped)
+	}
+
+	// slugs are per user
+	report, err = importer.Import(ctx, uuid.New(), archive, archive.Size(), "https://api.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported != 2 {
+		t.Errorf("another user's import = %v imported, want 2", report.Imported)
+	}
+}
+
+func TestImportUnsupportedFormat(t *testing.T) {
+	importer, _ := newTestImporter(t)
+	tests := map[string]*bytes.Reader{
+		"plain text":        bytes.NewReader([]byte("just some text")),
+		"zip without posts": zipOf(t, map[string]string{"image.png": "png"}),
+	}
+	for name, r := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := importer.Import(context.Background(), uuid.New(), r, r.Size(), "")
+			if !errors.Is(err, ErrUnsupportedFormat) {
+				t.Errorf("error = %v, want ErrUnsupportedFormat", err)
+			}
+		})
+	}
+}
+
+func TestPublicOnly(t *testing.T) {
+	tests := []struct {
+		address string
+		allowed bool
+	}{
+		{"93.184.216.34:443", true},
+		{"[2606:2800:220:1:248:1893:25c8:1946]:443", true},
+		{"127.0.0.1:80", false},
+		{"[::1]:80", false},
+		{"10.0.0.5:80", false},
+		{"172.16.0.1:80", false},
+		{"192.168.1.1:80", false},
+		{"[fd00::1]:80", false},
+		{"169.254.169.254:80", false},
+		{"0.0.0.0:80", false},
+		{"224.0.0.1:80", false},
+	}
+	for _, test := range tests {
+		t.Run(test.address, func(t *testing.T) {
+			err := publicOnly("tcp", test.address, nil)
+			if test.allowed && err != nil {
+				t.Errorf("publicOnly(%v) = %v, want nil", test.address, err)
+			}
+			if !test.allowed && !errors.Is(err, errPrivateAddress) {
+				t.Errorf("publicOnly(%v) = %v, want errPrivateAddress", test.address, err)
+			}
+		})
+	}
+}
+
+func TestFetcherRefusesPrivateAddresses(t *testing.T) {
+	requested := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = true
+	}))
+	defer server.Close()
+
+	_, err := newFetcher().fetch(context.Background(), server.URL+"/image.png")
+	if !errors.Is(err, errPrivateAddress) {
+		t.Errorf("fetch from %v = %v, want errPrivateAddress", server.URL, err)
+	}
+	if requested {
+		t.Error("the fetcher connected to a loopback address")
+	}
+}
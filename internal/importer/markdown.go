@@ -0,0 +1,170 @@
+package importer
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// frontMatter covers the keys Hugo, Jekyll and our own export write.
+type frontMatter struct {
+	Title   string `yaml:"title"`
+	Slug    string `yaml:"slug"`
+	Date    string `yaml:"date"`
+	Updated string `yaml:"updated"`
+	Lastmod string `yaml:"lastmod"`
+	Tags    any    `yaml:"tags"`
+	Draft   bool   `yaml:"draft"`
+	// Published is Jekyll's way to mark drafts.
+	Published *bool  `yaml:"published"`
+	Deleted   string `yaml:"deleted"`
+}
+
+// jekyllName matches file names like 2021-03-04-my-post.md.
+var jekyllName = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})-(.+)$`)
+
+var headingLine = regexp.MustCompile(`^#\s+(.+?)\s*#*\s*$`)
+
+// parseMarkdown reads a post with optional YAML front matter. Without a
+// title the first heading or the file name is used.
+func parseMarkdown(name string, data []byte) (item, error) {
+	it := item{source: name, dir: path.Dir(name)}
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+
+	meta := frontMatter{}
+	if rest, ok := strings.CutPrefix(text, "---\n"); ok {
+		end := strings.Index(rest, "\n---\n")
+		if end == -1 && strings.HasSuffix(rest, "\n---") {
+			end = len(rest) - len("\n---")
+		}
+		if end == -1 {
+			return it, fmt.Errorf("front matter is not closed with ---")
+		}
+		err := yaml.Unmarshal([]byte(rest[:end]), &meta)
+		if err != nil {
+			return it, fmt.Errorf("front matter: %w", err)
+		}
+		text = strings.TrimPrefix(rest[end+len("\n---"):], "\n")
+	}
+	text = strings.TrimSpace(text)
+
+	it.title = strings.TrimSpace(meta.Title)
+	if it.title == "" {
+		first, rest, _ := strings.Cut(text, "\n")
+		if match := headingLine.FindStringSubmatch(first); match != nil {
+			it.title = match[1]
+			text = strings.TrimSpace(rest)
+		}
+	}
+	base := strings.TrimSuffix(path.Base(name), path.Ext(name))
+	fileDate := ""
+	if match := jekyllName.FindStringSubmatch(base); match != nil {
+		fileDate, base = match[1], match[2]
+		if meta.Slug == "" {
+			meta.Slug = base
+		}
+	}
+	if it.title == "" {
+		it.title = strings.ReplaceAll(base, "-", " ")
+	}
+	it.slug = meta.Slug
+	it.content = text
+	it.tags = parseTags(meta.Tags)
+
+	var err error
+	it.created, err = parseDate(firstNonEmpty(meta.Date, fileDate))
+	if err != nil {
+		return it, fmt.Errorf("date: %w", err)
+	}
+	it.updated, err = parseDate(firstNonEmpty(meta.Updated, meta.Lastmod))
+	if err != nil {
+		return it, fmt.Errorf("updated: %w", err)
+	}
+	switch {
+	case meta.Deleted != "":
+		it.skip = "the post was deleted"
+	case meta.Draft || meta.Published != nil && !*meta.Published:
+		it.skip = "drafts are not imported"
+	}
+	return it, nil
+}
+
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05 -07:00",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	time.RFC1123Z,
+	time.RFC1123,
+}
+
+// parseDate reads the date formats static site generators use, times
+// without a zone are taken as UTC. An empty value is the zero time, the
+// store then uses the import time.
+func parseDate(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range dateLayouts {
+		t, err := time.Parse(layout, value)
+		if err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unknown date format %q", value)
+}
+
+// parseTags accepts a list or a string separated by commas or, like
+// Jekyll, by spaces.
+func parseTags(value any) []string {
+	var raw []string
+	switch v := value.(type) {
+	case string:
+		if strings.Contains(v, ",") {
+			raw = strings.Split(v, ",")
+		} else {
+			raw = strings.Fields(v)
+		}
+	case []any:
+		for _, tag := range v {
+			raw = append(raw, fmt.Sprint(tag))
+		}
+	}
+	return cleanTags(raw)
+}
+
+func cleanTags(raw []string) []string {
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, tag := range raw {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[strings.ToLower(tag)] {
+			continue
+		}
+		seen[strings.ToLower(tag)] = true
+		tags = append(tags, tag)
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	return tags
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,135 @@
+package importer
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// wxrItem is an <item> of a WordPress export. Fields without a namespace
+// match the wp: elements of every WXR version.
+type wxrItem struct {
+	Title           string        `xml:"title"`
+	PubDate         string        `xml:"pubDate"`
+	Content         string        `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	PostID          string        `xml:"post_id"`
+	PostDateGMT     string        `xml:"post_date_gmt"`
+	PostModifiedGMT string        `xml:"post_modified_gmt"`
+	PostName        string        `xml:"post_name"`
+	Status          string        `xml:"status"`
+	PostType        string        `xml:"post_type"`
+	Categories      []wxrCategory `xml:"category"`
+}
+
+type wxrCategory struct {
+	Domain string `xml:"domain,attr"`
+	Name   string `xml:",chardata"`
+}
+
+// blockComments are the markers the WordPress block editor wraps content
+// in, they mean nothing outside of it.
+var blockComments = regexp.MustCompile(`<!-- /?wp:[^>]*?-->\n?`)
+
+// parseWXR reads the posts of a WordPress export. Attachments are not
+// items of their own, they are uploaded when a post embeds them.
+func parseWXR(r io.Reader, file string) ([]item, error) {
+	decoder := xml.NewDecoder(r)
+	decoder.Strict = false
+	decoder.Entity = xml.HTMLEntity
+	root, err := firstElement(decoder)
+	if err != nil || root.Name.Local != "rss" {
+		return nil, ErrUnsupportedFormat
+	}
+	items := []item{}
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			return items, nil
+		}
+		if err != nil {
+			return items, fmt.Errorf("wxr: %w", err)
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "item" {
+			continue
+		}
+		var entry wxrItem
+		err = decoder.DecodeElement(&entry, &start)
+		if err != nil {
+			return items, fmt.Errorf("wxr: %w", err)
+		}
+		if entry.PostType == "attachment" || entry.PostType == "revision" || entry.PostType == "nav_menu_item" {
+			continue
+		}
+		items = append(items, wxrToItem(entry, file))
+	}
+}
+
+func firstElement(decoder *xml.Decoder) (xml.StartElement, error) {
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return start, nil
+		}
+	}
+}
+
+func wxrToItem(entry wxrItem, file string) item {
+	it := item{
+		source:  strings.TrimSpace(file + " item " + entry.PostID),
+		title:   strings.TrimSpace(entry.Title),
+		content: strings.TrimSpace(blockComments.ReplaceAllString(entry.Content, "")),
+	}
+	// WordPress stores non ascii slugs percent encoded
+	slug, err := url.PathUnescape(entry.PostName)
+	if err != nil {
+		slug = entry.PostName
+	}
+	it.slug = slug
+	tags := []string{}
+	for _, category := range entry.Categories {
+		if category.Domain == "post_tag" {
+			tags = append(tags, category.Name)
+		}
+	}
+	it.tags = cleanTags(tags)
+
+	switch {
+	case entry.PostType != "" && entry.PostType != "post":
+		it.skip = fmt.Sprintf("%v items are not imported", entry.PostType)
+		return it
+	case entry.Status == "private":
+		it.skip = "private posts are not imported, posts here are public"
+		return it
+	case entry.Status != "" && entry.Status != "publish":
+		it.skip = fmt.Sprintf("%v posts are not imported", entry.Status)
+		return it
+	}
+
+	// drafts carry a zero gmt date, fall back to the rss date
+	it.created, err = parseDate(wxrDate(entry.PostDateGMT))
+	if err == nil && it.created.IsZero() {
+		it.created, err = parseDate(entry.PubDate)
+	}
+	if err == nil {
+		it.updated, err = parseDate(wxrDate(entry.PostModifiedGMT))
+	}
+	if err != nil {
+		it.err = err
+	}
+	return it
+}
+
+func wxrDate(value string) string {
+	if strings.HasPrefix(value, "0000-00-00") {
+		return ""
+	}
+	return value
+}
@@ -0,0 +1,161 @@
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	RequestIDHeader = "X-Request-ID"
+	loggerKey       = "logger"
+)
+
+type contextKey struct{}
+
+// New builds the application logger. format is "json" or "text" and level
+// one of debug, info, warn or error.
+func New(w io.Writer, format string, level string) *slog.Logger {
+	options := &slog.HandlerOptions{Level: parseLevel(level)}
+	if strings.ToLower(format) == "text" {
+		return slog.New(slog.NewTextHandler(w, options))
+	}
+	return slog.New(slog.NewJSONHandler(w, options))
+}
+
+// NewFromEnv reads LOG_FORMAT and LOG_LEVEL, defaulting to json at info.
+func NewFromEnv() *slog.Logger {
+	return New(os.Stdout, os.Getenv("LOG_FORMAT"), os.Getenv("LOG_LEVEL"))
+}
+
+func parseLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// RequestLogger assigns every request an id, reusing a sane X-Request-ID
+// sent by the client or proxy, and stores a logger carrying the id, route
+// and running latency for handlers to pick up with FromContext. It writes
+// one access log line per request once the handlers are done.
+func RequestLogger(base *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		requestID := c.GetHeader(RequestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = uuid.New().String()
+		}
+		c.Header(RequestIDHeader, requestID)
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		logger := slog.New(&latencyHandler{Handler: base.Handler(), start: start}).With(
+			"request_id", requestID,
+			"method", c.Request.Method,
+			"route", route,
+		)
+		if span := trace.SpanContextFromContext(c.Request.Context()); span.IsValid() {
+			logger = logger.With("trace_id", span.TraceID().String())
+		}
+		setLogger(c, logger)
+
+		c.Next()
+
+		logger = FromContext(c)
+		level := slog.LevelInfo
+		if c.Writer.Status() >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		logger.Log(c.Request.Context(), level, "request",
+			"status", c.Writer.Status(),
+			"bytes", c.Writer.Size(),
+			"client_ip", c.ClientIP(),
+		)
+	}
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, r := range id {
+		if r < 0x21 || r > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func setLogger(c *gin.Context, logger *slog.Logger) {
+	c.Set(loggerKey, logger)
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), contextKey{}, logger))
+}
+
+// With adds attributes, such as the user id once authenticated, to the
+// request logger for the rest of the request.
+func With(c *gin.Context, args ...any) {
+	setLogger(c, FromContext(c).With(args...))
+}
+
+// FromContext returns the request scoped logger, or the default logger
+// outside of a request.
+func FromContext(c *gin.Context) *slog.Logger {
+	logger, ok := c.Keys[loggerKey].(*slog.Logger)
+	if !ok {
+		return slog.Default()
+	}
+	return logger
+}
+
+// FromRequestContext is FromContext for code that only has the request's
+// context.Context.
+func FromRequestContext(ctx context.Context) *slog.Logger {
+	return FromRequestContextOr(ctx, slog.Default())
+}
+
+// FromRequestContextOr returns fallback when ctx does not belong to a
+// request.
+func FromRequestContextOr(ctx context.Context, fallback *slog.Logger) *slog.Logger {
+	logger, ok := ctx.Value(contextKey{}).(*slog.Logger)
+	if !ok {
+		return fallback
+	}
+	return logger
+}
+
+// latencyHandler stamps every record with the time spent in the request so
+// far.
+type latencyHandler struct {
+	slog.Handler
+	start time.Time
+}
+
+func (h *latencyHandler) Handle(ctx context.Context, record slog.Record) error {
+	record.AddAttrs(slog.Float64("latency_ms", float64(time.Since(h.start).Microseconds())/1000))
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *latencyHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &latencyHandler{Handler: h.Handler.WithAttrs(attrs), start: h.start}
+}
+
+func (h *latencyHandler) WithGroup(name string) slog.Handler {
+	return &latencyHandler{Handler: h.Handler.WithGroup(name), start: h.start}
+}
@@ -0,0 +1,98 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// logLines decodes every json line written to buf.
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	lines := []map[string]any{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		record := map[string]any{}
+		err := json.Unmarshal([]byte(line), &record)
+		if err != nil {
+			t.Fatalf("log line %q: %v", line, err)
+		}
+		lines = append(lines, record)
+	}
+	return lines
+}
+
+func TestRequestLoggerRequestID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name string
+		sent string
+		// kept is whether the id sent by the client is used
+		kept bool
+	}{
+		{"sent", "proxy-id-123", true},
+		{"missing", "", false},
+		{"control characters", "bad\tid", false},
+		{"too long", strings.Repeat("a", 129), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			engine := gin.New()
+			engine.Use(RequestLogger(New(buf, "json", "info")))
+			engine.GET("/posts", func(c *gin.Context) {
+				With(c, "user_id", "user-1")
+				FromRequestContext(c.Request.Context()).Info("handler")
+				c.Status(http.StatusOK)
+			})
+			request := httptest.NewRequest(http.MethodGet, "/posts", nil)
+			if test.sent != "" {
+				request.Header.Set(RequestIDHeader, test.sent)
+			}
+			recorder := httptest.NewRecorder()
+			engine.ServeHTTP(recorder, request)
+
+			id := recorder.Header().Get(RequestIDHeader)
+			if test.kept && id != test.sent {
+				t.Errorf("request id = %q, want the one sent, %q", id, test.sent)
+			}
+			if !test.kept && (id == "" || id == test.sent) {
+				t.Errorf("request id = %q, want a generated one", id)
+			}
+			lines := logLines(t, buf)
+			if len(lines) != 2 {
+				t.Fatalf("logged %v lines, want the handler's and the access log", len(lines))
+			}
+			for _, line := range lines {
+				if line["request_id"] != id || line["route"] != "/posts" || line["user_id"] != "user-1" {
+					t.Errorf("%v line = %v, want the request id, route and user id", line["msg"], line)
+				}
+			}
+		})
+	}
+}
+
+func TestFromContextDefault(t *testing.T) {
+	buf := &bytes.Buffer{}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(buf, nil)))
+	defer slog.SetDefault(previous)
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	FromContext(c).Info("outside a request")
+	FromRequestContext(context.Background()).Info("no request context")
+	if lines := logLines(t, buf); len(lines) != 2 {
+		t.Errorf("the default logger wrote %v lines, want 2", len(lines))
+	}
+	fallback := slog.New(slog.NewJSONHandler(&bytes.Buffer{}, nil))
+	if FromRequestContextOr(context.Background(), fallback) != fallback {
+		t.Error("FromRequestContextOr did not return the fallback")
+	}
+}
@@ -0,0 +1,141 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+	"todoapp/internal/store"
+	"todoapp/internal/worker"
+)
+
+// GCReport summarises one garbage collection pass. In dry-run mode Orphaned
+// lists what would have been deleted and nothing is removed.
+type GCReport struct {
+	DryRun     bool
+	Scanned    int
+	Orphaned   []string
+	Deleted    int
+	BytesFreed int64
+}
+
+// GarbageCollector deletes uploaded images that no post references once they
+// are older than the grace period, giving users time to finish their post.
+// The underlying blob is only removed once its last image is gone.
+type GarbageCollector struct {
+	imageStore store.ImageStore
+	blobStore  store.BlobStore
+	logger     *slog.Logger
+	grace      time.Duration
+	dryRun     bool
+	stop       chan struct{}
+	wg         sync.WaitGroup
+}
+
+func NewGarbageCollector(imageStore store.ImageStore, blobStore store.BlobStore, logger *slog.Logger, grace time.Duration, dryRun bool) *GarbageCollector {
+	return &GarbageCollector{
+		imageStore: imageStore,
+		blobStore:  blobStore,
+		logger:     logger,
+		grace:      grace,
+		dryRun:     dryRun,
+		stop:       make(chan struct{}),
+	}
+}
+
+// Run does one collection pass, honouring the configured dry-run mode.
+func (gc *GarbageCollector) Run(ctx context.Context) (*GCReport, error) {
+	return gc.run(ctx, gc.dryRun)
+}
+
+// Report does a dry-run pass regardless of the configured mode.
+func (gc *GarbageCollector) Report(ctx context.Context) (*GCReport, error) {
+	return gc.run(ctx, true)
+}
+
+func (gc *GarbageCollector) run(ctx context.Context, dryRun bool) (*GCReport, error) {
+	report := &GCReport{
+		DryRun:   dryRun,
+		Orphaned: []string{},
+	}
+	images, err := gc.imageStore.GetImagesCreatedBefore(ctx, time.Now().Add(-gc.grace))
+	if err != nil {
+		return nil, err
+	}
+	for _, image := range images {
+		report.Scanned++
+		referenced, err := gc.imageStore.IsImageReferenced(ctx, image.Key)
+		if err != nil {
+			return report, err
+		}
+		if referenced {
+			continue
+		}
+		if dryRun {
+			report.Orphaned = append(report.Orphaned, image.Key)
+			continue
+		}
+		// the check above only skips the obvious cases, a post may link
+		// the image by now and the store checks again as it deletes
+		lastReference, err := gc.imageStore.DeleteImageIfUnreferenced(ctx, image.ID)
+		if errors.Is(err, store.ErrConflict) || errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return report, err
+		}
+		report.Orphaned = append(report.Orphaned, image.Key)
+		report.Deleted++
+		if lastReference {
+			err = DeleteBlobWithVariants(gc.blobStore, image.Key)
+			if err != nil {
+				return report, err
+			}
+			report.BytesFreed += image.Size
+		}
+	}
+	return report, nil
+}
+
+// Start runs the collector every interval until Stop is called.
+func (gc *GarbageCollector) Start(interval time.Duration) {
+	worker.Every(interval, gc.stop, &gc.wg, func(ctx context.Context) {
+		report, err := gc.Run(ctx)
+		if err != nil {
+			gc.logger.Error("imageGarbageCollector", "error", err)
+		}
+		if report != nil {
+			gc.LogReport(report)
+		}
+	})
+}
+
+func (gc *GarbageCollector) Stop() {
+	close(gc.stop)
+	gc.wg.Wait()
+}
+
+func (gc *GarbageCollector) LogReport(report *GCReport) {
+	if report.DryRun {
+		gc.logger.Info("image gc dry run", "scanned", report.Scanned, "would_delete", len(report.Orphaned), "keys", report.Orphaned)
+		return
+	}
+	gc.logger.Info("image gc", "scanned", report.Scanned, "deleted", report.Deleted, "bytes_freed", report.BytesFreed)
+}
+
+// DeleteBlobWithVariants removes an upload together with its generated
+// variants and thumbnail.
+func DeleteBlobWithVariants(blobStore store.BlobStore, key string) error {
+	keys := []string{ThumbnailKey(key)}
+	for _, width := range VariantWidths {
+		keys = append(keys, VariantKey(key, width))
+	}
+	for _, k := range keys {
+		err := blobStore.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	return blobStore.Delete(key)
+}
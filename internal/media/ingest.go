@@ -0,0 +1,229 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"todoapp/internal/store"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrUnsupportedType = errors.New("unsupported media type")
+	ErrInvalidImage    = errors.New("invalid image")
+	ErrFileTooLarge    = errors.New("file too large")
+	ErrTooManyPixels   = errors.New("image dimensions too large")
+)
+
+var imageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// videoTypes are stored as is, without variants.
+var videoTypes = map[string]bool{
+	"video/mp4":  true,
+	"video/webm": true,
+}
+
+// MaxImageBytes bounds how much of an image is held in memory for metadata
+// stripping and decoding, larger media has to be video.
+const MaxImageBytes = 64 << 20
+
+// MaxImagePixels bounds width times height. A small file can declare huge
+// dimensions and decoding allocates for every pixel, so images are checked
+// against it before they are decoded.
+const MaxImagePixels = 50_000_000
+
+type IngestResult struct {
+	Key         string
+	ContentType string
+	Size        int64
+	// Width is the displayed width of images and 0 for other media.
+	Width int
+}
+
+func (r *IngestResult) IsImage() bool {
+	return imageTypes[r.ContentType]
+}
+
+// Ingester is the single path uploads take into storage: type checks,
+// metadata stripping, quota, content addressed dedup and variant generation.
+type Ingester struct {
+	imageStore store.ImageStore
+	blobStore  store.BlobStore
+	processor  *Processor
+	quota      int64
+	logger     *slog.Logger
+}
+
+// NewIngester takes the per-user quota in bytes, 0 disables it.
+func NewIngester(imageStore store.ImageStore, blobStore store.BlobStore, processor *Processor, quota int64, logger *slog.Logger) *Ingester {
+	return &Ingester{
+		imageStore: imageStore,
+		blobStore:  blobStore,
+		processor:  processor,
+		quota:      quota,
+		logger:     logger,
+	}
+}
+
+// Ingest stores size bytes read from r for the user. Uploading content the
+// user already has returns the existing key without using more quota.
+func (in *Ingester) Ingest(ctx context.Context, userId uuid.UUID, r io.ReadSeeker, size int64) (*IngestResult, error) {
+	return in.ingest(ctx, userId, r, size, in.quota)
+}
+
+// IngestUpload stores a finished resumable upload. Its length was reserved
+// against the quota while it was uploaded, so the quota is not checked again.
+func (in *Ingester) IngestUpload(ctx context.Context, userId uuid.UUID, r io.ReadSeeker, size int64) (*IngestResult, error) {
+	return in.ingest(ctx, userId, r, size, 0)
+}
+
+func (in *Ingester) ingest(ctx context.Context, userId uuid.UUID, r io.ReadSeeker, size int64, quota int64) (*IngestResult, error) {
+	sniff := make([]byte, 512)
+	n, err := io.ReadFull(r, sniff)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	contentType := http.DetectContentType(sniff[:n])
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &IngestResult{ContentType: contentType}
+	var body io.ReadSeeker
+	switch {
+	case imageTypes[contentType]:
+		if size > MaxImageBytes {
+			return nil, ErrFileTooLarge
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		config, err := DecodeConfig(data, contentType)
+		if err != nil {
+			return nil, ErrInvalidImage
+		}
+		err = checkPixels(config)
+		if err != nil {
+			return nil, err
+		}
+		data, err = StripMetadata(data, contentType)
+		if err != nil {
+			return nil, ErrInvalidImage
+		}
+		sum := sha256.Sum256(data)
+		result.Key = hex.EncodeToString(sum[:])
+		result.Size = int64(len(data))
+		result.Width = config.Width
+		body = bytes.NewReader(data)
+	case videoTypes[contentType]:
+		hash := sha256.New()
+		result.Size, err = io.Copy(hash, r)
+		if err != nil {
+			return nil, err
+		}
+		_, err = r.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+		result.Key = hex.EncodeToString(hash.Sum(nil))
+		body = r
+	default:
+		return nil, ErrUnsupportedType
+	}
+
+	existing, err := in.imageStore.GetImageForUser(ctx, userId, result.Key)
+	if err == nil {
+		result.Key = existing.Key
+		blob, err := in.imageStore.GetBlob(ctx, existing.Key)
+		if err != nil {
+			return nil, err
+		}
+		if blob.Pending {
+			// an earlier upload of the user is still writing it
+			err = in.writeBlob(ctx, result, body)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	}
+	if !errors.Is(err, store.ErrNotFound) {
+		return nil, err
+	}
+	image := &store.Image{
+		UserID:      userId,
+		Key:         result.Key,
+		Size:        result.Size,
+		ContentType: contentType,
+	}
+	pending, err := in.imageStore.CreateImage(ctx, image, quota)
+	if err != nil {
+		return nil, err
+	}
+	if !pending {
+		return result, nil
+	}
+	// the first upload of this content, or a concurrent one that has not
+	// finished and may still fail, the file is only linked once written
+	err = in.writeBlob(ctx, result, body)
+	if err != nil {
+		// undo the reference even when the request is gone
+		_, deleteErr := in.imageStore.DeleteImage(context.WithoutCancel(ctx), image.ID)
+		if deleteErr != nil {
+			in.logger.Error("ingestDeleteImage", "error", deleteErr)
+		}
+		return nil, err
+	}
+	return result, nil
+}
+
+// writeBlob puts the file and marks its blob written. Concurrent uploads of
+// the same content may write it twice, the content is the same either way.
+func (in *Ingester) writeBlob(ctx context.Context, result *IngestResult, body io.ReadSeeker) error {
+	err := in.blobStore.Put(result.Key, body, result.Size, result.ContentType)
+	if err != nil {
+		return err
+	}
+	err = in.imageStore.MarkBlobWritten(context.WithoutCancel(ctx), result.Key)
+	if err != nil {
+		return err
+	}
+	if result.IsImage() && !in.processor.Enqueue(Job{Key: result.Key, ContentType: result.ContentType}) {
+		in.logger.Error("ingestEnqueue: image queue full, skipping variants", "key", result.Key)
+	}
+	return nil
+}
+
+// Quota is the per-user quota in bytes, 0 when disabled.
+func (in *Ingester) Quota() int64 {
+	return in.quota
+}
+
+// CheckQuota returns a *store.QuotaExceededError when storing size more
+// bytes would take the user over their quota.
+func (in *Ingester) CheckQuota(ctx context.Context, userId uuid.UUID, size int64) error {
+	if in.quota <= 0 {
+		return nil
+	}
+	used, err := in.imageStore.GetUsageForUser(ctx, userId)
+	if err != nil {
+		return err
+	}
+	if used+size > in.quota {
+		return &store.QuotaExceededError{Quota: in.quota, Used: used}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"testing"
+	"todoapp/internal/store"
+
+	"github.com/google/uuid"
+)
+
+func TestIngestWritesPendingBlob(t *testing.T) {
+	ctx := context.Background()
+	imageStore := store.NewMemoryStores().Images
+	blobStore, err := store.NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ingester := NewIngester(imageStore, blobStore, NewProcessor(blobStore, logger, 1, 10), 0, logger)
+	data := encodeJPEG(t, 32, 32)
+	stripped, err := StripMetadata(data, "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(stripped)
+	key := hex.EncodeToString(sum[:])
+
+	// another user's upload of the same content took the first reference
+	// and has not written the file yet
+	pending, err := imageStore.CreateImage(ctx, &store.Image{UserID: uuid.New(), Key: key, Size: int64(len(stripped)), ContentType: "image/jpeg"}, 0)
+	if err != nil || !pending {
+		t.Fatalf("first reference pending = %v, %v, want true", pending, err)
+	}
+
+	result, err := ingester.Ingest(ctx, uuid.New(), bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Key != key {
+		t.Fatalf("key = %v, want %v", result.Key, key)
+	}
+	blob, _, err := blobStore.Get(key)
+	if err != nil {
+		t.Fatalf("the second upload linked an unwritten file: %v", err)
+	}
+	blob.Close()
+	info, err := imageStore.GetBlob(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Pending {
+		t.Error("blob still pending after it was written")
+	}
+}
@@ -0,0 +1,276 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var ErrMalformedImage = errors.New("malformed image")
+
+// StripMetadata removes EXIF, XMP and textual metadata (camera details, GPS
+// position, comments) from an encoded image without re-encoding the pixels.
+// Formats that carry no such metadata are returned unchanged.
+func StripMetadata(data []byte, contentType string) ([]byte, error) {
+	switch contentType {
+	case "image/jpeg":
+		return stripJPEG(data)
+	case "image/png":
+		return stripPNG(data)
+	case "image/webp":
+		return stripWebP(data)
+	default:
+		return data, nil
+	}
+}
+
+const (
+	jpegSOI  = 0xD8
+	jpegEOI  = 0xD9
+	jpegSOS  = 0xDA
+	jpegAPP0 = 0xE0
+	jpegAPP1 = 0xE1
+	jpegAPP2 = 0xE2
+	jpegCOM  = 0xFE
+)
+
+// stripJPEG keeps the JFIF header and the ICC color profile of the APPn
+// segments, every other one (EXIF, XMP, Photoshop, vendor data) and
+// comments are dropped. Anything after the end of image marker, where some
+// tools append thumbnails or whole files, is cut off.
+func stripJPEG(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != jpegSOI {
+		return nil, ErrMalformedImage
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+	orientation := 1
+	wroteOrientation := false
+	i := 2
+	for i < len(data) {
+		if data[i] != 0xFF {
+			return nil, ErrMalformedImage
+		}
+		// skip fill bytes
+		for i < len(data) && data[i] == 0xFF {
+			i++
+		}
+		if i >= len(data) {
+			return nil, ErrMalformedImage
+		}
+		marker := data[i]
+		i++
+		if marker == jpegEOI {
+			out.Write([]byte{0xFF, jpegEOI})
+			return out.Bytes(), nil
+		}
+		// standalone markers carry no length
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			out.Write([]byte{0xFF, marker})
+			continue
+		}
+		if i+2 > len(data) {
+			return nil, ErrMalformedImage
+		}
+		length := int(binary.BigEndian.Uint16(data[i:]))
+		if length < 2 || i+length > len(data) {
+			return nil, ErrMalformedImage
+		}
+		segment := data[i+2 : i+length]
+		isApp := marker >= 0xE0 && marker <= 0xEF
+		keep := true
+		switch {
+		case marker == jpegAPP0:
+		case marker == jpegAPP2 && bytes.HasPrefix(segment, []byte("ICC_PROFILE\x00")):
+		case marker == jpegAPP1:
+			if o := exifOrientation(segment); o != 0 {
+				orientation = o
+			}
+			keep = false
+		case isApp, marker == jpegCOM:
+			keep = false
+		}
+		if keep {
+			// keep the orientation so stripped photos still display upright,
+			// it goes after the APPn headers and before the image data
+			if !wroteOrientation && !isApp {
+				writeOrientationSegment(out, orientation)
+				wroteOrientation = true
+			}
+			out.Write([]byte{0xFF, marker})
+			out.Write(data[i : i+length])
+		}
+		i += length
+		if marker == jpegSOS {
+			// copy the entropy coded data up to the next marker, 0xFF is
+			// followed by a stuffed zero or a restart marker inside it
+			start := i
+			for i < len(data) {
+				if data[i] == 0xFF && i+1 < len(data) && data[i+1] != 0 && (data[i+1] < 0xD0 || data[i+1] > 0xD7) {
+					break
+				}
+				i++
+			}
+			out.Write(data[start:i])
+		}
+	}
+	return nil, ErrMalformedImage
+}
+
+func writeOrientationSegment(out *bytes.Buffer, orientation int) {
+	if orientation <= 1 {
+		return
+	}
+	// big endian TIFF header followed by a single IFD holding only the
+	// orientation tag
+	segment := []byte{
+		'E', 'x', 'i', 'f', 0, 0,
+		'M', 'M', 0, 42, 0, 0, 0, 8,
+		0, 1,
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(orientation), 0, 0,
+		0, 0, 0, 0,
+	}
+	out.Write([]byte{0xFF, jpegAPP1})
+	binary.Write(out, binary.BigEndian, uint16(len(segment)+2))
+	out.Write(segment)
+}
+
+// exifOrientation reads the orientation tag from an APP1 payload, returning
+// 0 when the payload is not EXIF or has no orientation.
+func exifOrientation(segment []byte) int {
+	if len(segment) < 14 || string(segment[:6]) != "Exif\x00\x00" {
+		return 0
+	}
+	tiff := segment[6:]
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for n := 0; n < count; n++ {
+		entry := offset + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			o := int(order.Uint16(tiff[entry+8:]))
+			if o >= 1 && o <= 8 {
+				return o
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// JPEGOrientation returns the EXIF orientation (1-8) of a jpeg, defaulting
+// to 1 when none is present.
+func JPEGOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != jpegSOI {
+		return 1
+	}
+	i := 2
+	for i+4 <= len(data) && data[i] == 0xFF {
+		marker := data[i+1]
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == jpegSOS || length < 2 || i+2+length > len(data) {
+			break
+		}
+		if marker == jpegAPP1 {
+			if o := exifOrientation(data[i+4 : i+2+length]); o != 0 {
+				return o
+			}
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+var pngDroppedChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+func stripPNG(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, ErrMalformedImage
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(pngSignature)
+	i := len(pngSignature)
+	for i < len(data) {
+		if i+8 > len(data) {
+			return nil, ErrMalformedImage
+		}
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		kind := string(data[i+4 : i+8])
+		end := i + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, ErrMalformedImage
+		}
+		if !pngDroppedChunks[kind] {
+			out.Write(data[i:end])
+		}
+		i = end
+		if kind == "IEND" {
+			return out.Bytes(), nil
+		}
+	}
+	return nil, ErrMalformedImage
+}
+
+const (
+	webpFlagXMP  = 0x04
+	webpFlagEXIF = 0x08
+)
+
+func stripWebP(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, ErrMalformedImage
+	}
+	body := bytes.NewBuffer(make([]byte, 0, len(data)))
+	body.WriteString("WEBP")
+	i := 12
+	for i < len(data) {
+		if i+8 > len(data) {
+			return nil, ErrMalformedImage
+		}
+		kind := string(data[i : i+4])
+		length := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + length + length%2
+		if end > len(data) {
+			return nil, ErrMalformedImage
+		}
+		switch kind {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk := append([]byte(nil), data[i:end]...)
+			if len(chunk) > 8 {
+				chunk[8] &^= webpFlagEXIF | webpFlagXMP
+			}
+			body.Write(chunk)
+		default:
+			body.Write(data[i:end])
+		}
+		i = end
+	}
+	out := bytes.NewBuffer(make([]byte, 0, body.Len()+8))
+	out.WriteString("RIFF")
+	binary.Write(out, binary.LittleEndian, uint32(body.Len()))
+	out.Write(body.Bytes())
+	return out.Bytes(), nil
+}
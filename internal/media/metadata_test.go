@@ -0,0 +1,127 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func encodeJPEG(t *testing.T, width int, height int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	buf := &bytes.Buffer{}
+	err := jpeg.Encode(buf, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func jpegSegment(marker byte, payload string) []byte {
+	segment := []byte{0xFF, marker}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// exifWithOrientation is a little endian EXIF payload holding the
+// orientation and a GPS IFD pointer.
+func exifWithOrientation(orientation byte) string {
+	return "Exif\x00\x00" + "II*\x00\x08\x00\x00\x00" + "\x02\x00" +
+		"\x12\x01\x03\x00\x01\x00\x00\x00" + string([]byte{orientation, 0, 0, 0}) +
+		"\x25\x88\x04\x00\x01\x00\x00\x00\x26\x00\x00\x00" + "\x00\x00\x00\x00"
+}
+
+func TestStripJPEG(t *testing.T) {
+	encoded := encodeJPEG(t, 40, 20)
+	// Go writes no APPn segments, put ours right after SOI
+	data := append([]byte{}, encoded[:2]...)
+	data = append(data, jpegSegment(jpegAPP0, "JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00")...)
+	data = append(data, jpegSegment(jpegAPP1, exifWithOrientation(6))...)
+	data = append(data, jpegSegment(jpegAPP1, "http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>secret</x:xmpmeta>")...)
+	data = append(data, jpegSegment(jpegAPP2, "ICC_PROFILE\x00\x01\x01profile")...)
+	data = append(data, jpegSegment(jpegAPP2, "MPF\x00secret")...)
+	data = append(data, jpegSegment(0xED, "Photoshop 3.0\x00secret")...)
+	data = append(data, jpegSegment(0xEE, "Adobe\x00secret")...)
+	data = append(data, jpegSegment(jpegCOM, "secret comment")...)
+	data = append(data, encoded[2:]...)
+	// some tools append data after the end of the image
+	data = append(data, "secret trailer"...)
+
+	stripped, err := StripMetadata(data, "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kept := range []string{"JFIF", "ICC_PROFILE"} {
+		if !bytes.Contains(stripped, []byte(kept)) {
+			t.Errorf("%v was dropped", kept)
+		}
+	}
+	for _, dropped := range []string{"secret", "xmpmeta", "MPF"} {
+		if bytes.Contains(stripped, []byte(dropped)) {
+			t.Errorf("%q survived stripping", dropped)
+		}
+	}
+	if !bytes.HasSuffix(stripped, []byte{0xFF, jpegEOI}) {
+		t.Error("stripped jpeg does not end at EOI")
+	}
+	if JPEGOrientation(stripped) != 6 {
+		t.Errorf("orientation = %v, want 6", JPEGOrientation(stripped))
+	}
+	if !bytes.HasPrefix(stripped[2:], jpegSegment(jpegAPP0, "JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00")) {
+		t.Error("APP0 is no longer the first segment")
+	}
+	config, err := DecodeConfig(stripped, "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width != 20 || config.Height != 40 {
+		t.Errorf("displayed size = %vx%v, want the rotated 20x40", config.Width, config.Height)
+	}
+	_, err = jpeg.Decode(bytes.NewReader(stripped))
+	if err != nil {
+		t.Fatalf("stripped jpeg does not decode: %v", err)
+	}
+}
+
+func TestStripJPEGTruncated(t *testing.T) {
+	data := encodeJPEG(t, 16, 16)
+	_, err := StripMetadata(data[:len(data)-2], "image/jpeg")
+	if !errors.Is(err, ErrMalformedImage) {
+		t.Errorf("strip without EOI = %v, want ErrMalformedImage", err)
+	}
+}
+
+func TestCheckPixels(t *testing.T) {
+	// a png header declaring 20000x20000 pixels, a few bytes on disk
+	img := image.NewGray(image.Rect(0, 0, 1, 1))
+	buf := &bytes.Buffer{}
+	err := png.Encode(buf, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	binary.BigEndian.PutUint32(data[16:], 20000)
+	binary.BigEndian.PutUint32(data[20:], 20000)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	config, err := DecodeConfig(data, "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(checkPixels(config), ErrTooManyPixels) {
+		t.Errorf("checkPixels(%vx%v) = %v, want ErrTooManyPixels", config.Width, config.Height, checkPixels(config))
+	}
+	if checkPixels(image.Config{Width: 4000, Height: 3000}) != nil {
+		t.Error("a 12 megapixel photo was refused")
+	}
+}
@@ -0,0 +1,274 @@
+package media
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"todoapp/internal/store"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// VariantWidths are the responsive widths generated for every uploaded image.
+// Widths larger than the original are skipped, images are never upscaled.
+var VariantWidths = []int{320, 768, 1280}
+
+const ThumbnailSize = 256
+
+func VariantKey(key string, width int) string {
+	return fmt.Sprintf("%s_%dw", key, width)
+}
+
+func ThumbnailKey(key string) string {
+	return key + "_thumb"
+}
+
+var digestPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// IsImageKey reports whether key names an uploaded file, a hex sha256, or
+// one of the variants generated from it. Only those are served publicly.
+func IsImageKey(key string) bool {
+	digest, _, _ := strings.Cut(key, "_")
+	if !digestPattern.MatchString(digest) {
+		return false
+	}
+	if key == digest || key == ThumbnailKey(digest) {
+		return true
+	}
+	for _, w := range VariantWidths {
+		if key == VariantKey(digest, w) {
+			return true
+		}
+	}
+	return false
+}
+
+// PlanVariants returns the variant widths that will be generated for an image
+// of the given width.
+func PlanVariants(width int) []int {
+	widths := []int{}
+	for _, w := range VariantWidths {
+		if w < width {
+			widths = append(widths, w)
+		}
+	}
+	return widths
+}
+
+type Job struct {
+	Key         string
+	ContentType string
+}
+
+// Processor generates resized variants of uploaded images in the background
+// so the upload request does not wait on decoding and resampling.
+type Processor struct {
+	blobStore store.BlobStore
+	logger    *slog.Logger
+	workers   int
+	jobs      chan Job
+	wg        sync.WaitGroup
+	mu        sync.Mutex
+	stopped   bool
+}
+
+func NewProcessor(blobStore store.BlobStore, logger *slog.Logger, workers int, queueSize int) *Processor {
+	return &Processor{
+		blobStore: blobStore,
+		logger:    logger,
+		workers:   workers,
+		jobs:      make(chan Job, queueSize),
+	}
+}
+
+func (p *Processor) Start() {
+	for i := 0; i < p.workers; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for job := range p.jobs {
+				err := p.process(job)
+				if err != nil {
+					p.logger.Error("imageProcessor", "key", job.Key, "error", err)
+				}
+			}
+		}()
+	}
+}
+
+// Enqueue schedules a job without blocking, it reports false when the queue
+// is full or the processor has been stopped.
+func (p *Processor) Enqueue(job Job) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return false
+	}
+	select {
+	case p.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop waits for queued jobs to finish.
+func (p *Processor) Stop() {
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		return
+	}
+	p.stopped = true
+	close(p.jobs)
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+func (p *Processor) process(job Job) error {
+	blob, _, err := p.blobStore.Get(job.Key)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(blob)
+	blob.Close()
+	if err != nil {
+		return err
+	}
+	config, err := DecodeConfig(data, job.ContentType)
+	if err != nil {
+		return err
+	}
+	err = checkPixels(config)
+	if err != nil {
+		return err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if job.ContentType == "image/jpeg" {
+		img = applyOrientation(img, JPEGOrientation(data))
+	}
+	bounds := img.Bounds()
+
+	for _, width := range PlanVariants(bounds.Dx()) {
+		height := bounds.Dy() * width / bounds.Dx()
+		if height < 1 {
+			height = 1
+		}
+		dst := image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+		err = p.put(VariantKey(job.Key, width), dst, job.ContentType)
+		if err != nil {
+			return err
+		}
+	}
+
+	side := min(bounds.Dx(), bounds.Dy())
+	crop := image.Rect(0, 0, side, side).Add(image.Pt(
+		bounds.Min.X+(bounds.Dx()-side)/2,
+		bounds.Min.Y+(bounds.Dy()-side)/2,
+	))
+	thumbSide := min(side, ThumbnailSize)
+	thumb := image.NewRGBA(image.Rect(0, 0, thumbSide, thumbSide))
+	draw.CatmullRom.Scale(thumb, thumb.Bounds(), img, crop, draw.Src, nil)
+	return p.put(ThumbnailKey(job.Key), thumb, job.ContentType)
+}
+
+// put encodes a variant, re-encoding drops any metadata of the original.
+func (p *Processor) put(key string, img image.Image, sourceType string) error {
+	buf := &bytes.Buffer{}
+	contentType := VariantContentType(sourceType)
+	var err error
+	if contentType == "image/png" {
+		err = png.Encode(buf, img)
+	} else {
+		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: 85})
+	}
+	if err != nil {
+		return err
+	}
+	return p.blobStore.Put(key, buf, int64(buf.Len()), contentType)
+}
+
+// VariantContentType is the format variants of a given upload are stored as,
+// formats with transparency stay png and everything else becomes jpeg.
+func VariantContentType(sourceType string) string {
+	switch sourceType {
+	case "image/png", "image/gif":
+		return "image/png"
+	default:
+		return "image/jpeg"
+	}
+}
+
+// DecodeConfig returns the dimensions of an encoded image as displayed,
+// taking the EXIF orientation of jpegs into account.
+func DecodeConfig(data []byte, contentType string) (image.Config, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return config, err
+	}
+	if contentType == "image/jpeg" && JPEGOrientation(data) >= 5 {
+		config.Width, config.Height = config.Height, config.Width
+	}
+	return config, nil
+}
+
+func checkPixels(config image.Config) error {
+	if config.Width <= 0 || config.Height <= 0 {
+		return ErrInvalidImage
+	}
+	if int64(config.Width)*int64(config.Height) > MaxImagePixels {
+		return ErrTooManyPixels
+	}
+	return nil
+}
+
+// applyOrientation rotates and flips an image according to its EXIF
+// orientation so the pixels are stored upright.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,30 @@
+package media
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsImageKey(t *testing.T) {
+	digest := strings.Repeat("ab", 32)
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{digest, true},
+		{ThumbnailKey(digest), true},
+		{VariantKey(digest, 768), true},
+		{VariantKey(digest, 500), false},
+		{digest + "_large", false},
+		{strings.ToUpper(digest), false},
+		{digest[:62], false},
+		{"export_" + digest, false},
+		{"chunk_0", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := IsImageKey(test.key); got != test.want {
+			t.Errorf("IsImageKey(%q) = %v, want %v", test.key, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package media
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+	"todoapp/internal/store"
+	"todoapp/internal/worker"
+)
+
+// AssembleUpload concatenates the chunks of a resumable upload into a
+// temporary file positioned at the start. The caller removes the file.
+func AssembleUpload(blobStore store.BlobStore, upload *store.Upload) (*os.File, error) {
+	file, err := os.CreateTemp("", "upload-*")
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range upload.Chunks() {
+		err = appendBlob(file, blobStore, key)
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return nil, err
+		}
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return file, nil
+}
+
+func appendBlob(w io.Writer, blobStore store.BlobStore, key string) error {
+	blob, _, err := blobStore.Get(key)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	_, err = io.Copy(w, blob)
+	return err
+}
+
+func DeleteUploadChunks(blobStore store.BlobStore, upload *store.Upload) error {
+	for _, key := range upload.Chunks() {
+		err := blobStore.Delete(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UploadExpirer removes resumable uploads that were abandoned before being
+// finalized, together with the chunks received so far.
+type UploadExpirer struct {
+	uploadStore store.UploadStore
+	blobStore   store.BlobStore
+	logger      *slog.Logger
+	stop        chan struct{}
+	wg          sync.WaitGroup
+}
+
+func NewUploadExpirer(uploadStore store.UploadStore, blobStore store.BlobStore, logger *slog.Logger) *UploadExpirer {
+	return &UploadExpirer{
+		uploadStore: uploadStore,
+		blobStore:   blobStore,
+		logger:      logger,
+		stop:        make(chan struct{}),
+	}
+}
+
+// Run removes expired uploads and returns how many were removed.
+func (ue *UploadExpirer) Run(ctx context.Context) (int, error) {
+	uploads, err := ue.uploadStore.GetExpiredUploads(ctx, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, upload := range uploads {
+		err = DeleteUploadChunks(ue.blobStore, &upload)
+		if err != nil {
+			return removed, err
+		}
+		err = ue.uploadStore.DeleteUpload(ctx, upload.ID)
+		if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+func (ue *UploadExpirer) Start(interval time.Duration) {
+	worker.Every(interval, ue.stop, &ue.wg, func(ctx context.Context) {
+		removed, err := ue.Run(ctx)
+		if err != nil {
+			ue.logger.Error("uploadExpirer", "error", err)
+		}
+		if removed > 0 {
+			ue.logger.Info("upload expirer removed abandoned uploads", "removed", removed)
+		}
+	})
+}
+
+func (ue *UploadExpirer) Stop() {
+	close(ue.stop)
+	ue.wg.Wait()
+}
@@ -0,0 +1,131 @@
+package metrics
+
+import (
+	"database/sql"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry holds every metric exposed on /metrics. It is separate from the
+// prometheus default registry so only metrics registered here are served.
+var Registry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by method, route template and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by method, route template and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	LoginAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_login_attempts_total",
+		Help: "Login attempts by result (success, unknown_user, invalid_password, error).",
+	}, []string{"result"})
+
+	UploadedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "uploads_received_bytes_total",
+		Help: "Bytes received through the upload endpoints, by endpoint.",
+	}, []string{"endpoint"})
+
+	CSPViolations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "csp_violations_total",
+		Help: "Content security policy violation reports by directive.",
+	}, []string{"directive"})
+
+	ReplicaHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "db_replica_healthy",
+		Help: "Whether a read replica passed its last health check (1) or not (0).",
+	}, []string{"replica"})
+
+	PostCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "post_cache_requests_total",
+		Help: "Post cache lookups by result (hit, miss).",
+	}, []string{"result"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests,
+		httpDuration,
+		LoginAttempts,
+		UploadedBytes,
+		CSPViolations,
+		ReplicaHealthy,
+		PostCacheRequests,
+	)
+}
+
+// Middleware records count and latency of every request. Routes are labelled
+// by their template so /post/:id does not create a series per post.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		httpRequests.WithLabelValues(c.Request.Method, route, status).Inc()
+		httpDuration.WithLabelValues(c.Request.Method, route, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// RegisterDB exposes connection pool statistics (open, in use, idle, wait
+// count and duration) of the database.
+func RegisterDB(db *sql.DB, name string) {
+	replace("db:"+name, collectors.NewDBStatsCollector(db, name))
+}
+
+// RegisterActiveSessions exposes the number of sessions in the token store,
+// count is called on every scrape.
+func RegisterActiveSessions(count func() (int64, error)) {
+	replace("active_sessions", prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "auth_active_sessions",
+		Help: "Sessions currently stored in the token store.",
+	}, func() float64 {
+		n, err := count()
+		if err != nil {
+			slog.Error("metricsActiveSessions", "error", err)
+			return math.NaN()
+		}
+		return float64(n)
+	}))
+}
+
+var (
+	collectorsMu sync.Mutex
+	// appCollectors are the collectors registered for the application by
+	// key, setting up another application, as the tests do, replaces them.
+	appCollectors = map[string]prometheus.Collector{}
+)
+
+func replace(key string, collector prometheus.Collector) {
+	collectorsMu.Lock()
+	defer collectorsMu.Unlock()
+	if previous, ok := appCollectors[key]; ok {
+		Registry.Unregister(previous)
+	}
+	Registry.MustRegister(collector)
+	appCollectors[key] = collector
+}
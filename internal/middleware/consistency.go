@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+	"todoapp/internal/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ReadYourWrites keeps a client's reads on the primary database for
+// duration after it made a write, so replication lag never hides its own
+// changes. Successful writes of signed in users set a short lived cookie,
+// writes and requests carrying the cookie have their context pinned to the
+// primary. Clients that drop cookies only get eventual consistency.
+func ReadYourWrites(cookies CookieConfig, duration time.Duration) gin.HandlerFunc {
+	name := cookies.Prefix + "read_primary"
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			_, err := c.Cookie(name)
+			if err == nil {
+				c.Request = c.Request.WithContext(store.PinPrimary(c.Request.Context()))
+			}
+			c.Next()
+			return
+		}
+		// the checks a write makes before writing must see the primary as
+		// well
+		c.Request = c.Request.WithContext(store.PinPrimary(c.Request.Context()))
+		writer := &pinCookieWriter{ResponseWriter: c.Writer}
+		writer.setCookie = func() {
+			// failed requests are answered by ErrorHandler after this
+			// middleware returns, or have already picked an error status
+			if len(c.Errors) > 0 || writer.Status() >= http.StatusBadRequest {
+				return
+			}
+			user, ok := LookupUser(c)
+			if !ok || user.IsAnonymous() {
+				return
+			}
+			cookies.set(c, name, "1", int(duration.Seconds()), true)
+		}
+		c.Writer = writer
+		c.Next()
+		writer.beforeWrite()
+		c.Writer = writer.ResponseWriter
+	}
+}
+
+// pinCookieWriter runs setCookie right before the response headers are
+// sent, once the handler has picked the status and Authenticate has
+// resolved the user.
+type pinCookieWriter struct {
+	gin.ResponseWriter
+	setCookie func()
+	done      bool
+}
+
+func (w *pinCookieWriter) beforeWrite() {
+	if w.done || w.ResponseWriter.Written() {
+		return
+	}
+	w.done = true
+	w.setCookie()
+}
+
+func (w *pinCookieWriter) WriteHeaderNow() {
+	w.beforeWrite()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *pinCookieWriter) Write(data []byte) (int, error) {
+	w.beforeWrite()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *pinCookieWriter) WriteString(s string) (int, error) {
+	w.beforeWrite()
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *pinCookieWriter) Flush() {
+	w.beforeWrite()
+	w.ResponseWriter.Flush()
+}
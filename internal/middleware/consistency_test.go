@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"todoapp/internal/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestReadYourWritesCookie(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(ErrorHandler(), ReadYourWrites(CookieConfig{Prefix: "__Host-", Secure: true}, 5*time.Second))
+	engine.Use(func(c *gin.Context) {
+		SetUser(store.AnonymousUser, c)
+		if c.GetHeader("Authorization") != "" {
+			SetUser(&store.User{Username: "signedin"}, c)
+		}
+	})
+	engine.POST("/json", func(c *gin.Context) {
+		c.JSON(http.StatusCreated, gin.H{"ok": true})
+	})
+	engine.POST("/empty", func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+	engine.POST("/failed", func(c *gin.Context) {
+		Fail(c, store.ErrConflict)
+	})
+	engine.POST("/rejected", func(c *gin.Context) {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false})
+	})
+	engine.GET("/read", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+	tests := []struct {
+		method string
+		path   string
+		signed bool
+		cookie bool
+	}{
+		{http.MethodPost, "/json", true, true},
+		{http.MethodPost, "/empty", true, true},
+		{http.MethodPost, "/json", false, false},
+		{http.MethodPost, "/failed", true, false},
+		{http.MethodPost, "/rejected", true, false},
+		{http.MethodGet, "/read", true, false},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(test.method, test.path, nil)
+		if test.signed {
+			request.Header.Set("Authorization", "Bearer token")
+		}
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, request)
+		cookies := recorder.Result().Cookies()
+		got := len(cookies) == 1 && cookies[0].Name == "__Host-read_primary" && cookies[0].MaxAge == 5
+		if got != test.cookie || len(cookies) > 1 {
+			t.Errorf("%v %v signed in %v set cookies %v, want the pin cookie %v", test.method, test.path, test.signed, cookies, test.cookie)
+		}
+	}
+}
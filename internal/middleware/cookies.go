@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CookieConfig holds the flags of the session and csrf cookies.
+type CookieConfig struct {
+	Secure   bool
+	SameSite http.SameSite
+	Domain   string
+	// Prefix is prepended to the cookie names, "__Host-" or "__Secure-" make
+	// browsers enforce the matching restrictions.
+	Prefix string
+}
+
+// CookieConfigFromEnv reads COOKIE_SECURE (default true, browsers accept
+// secure cookies from http://localhost), COOKIE_SAMESITE (lax, strict or
+// none), COOKIE_DOMAIN (falling back to DOMAIN, except for __Host- cookies
+// which must not have one) and COOKIE_PREFIX.
+func CookieConfigFromEnv() (CookieConfig, error) {
+	config := CookieConfig{
+		Secure: os.Getenv("COOKIE_SECURE") != "false",
+		Domain: os.Getenv("COOKIE_DOMAIN"),
+		Prefix: os.Getenv("COOKIE_PREFIX"),
+	}
+	if config.Domain == "" && config.Prefix != "__Host-" {
+		config.Domain = os.Getenv("DOMAIN")
+	}
+	switch sameSite := strings.ToLower(os.Getenv("COOKIE_SAMESITE")); sameSite {
+	case "", "lax":
+		config.SameSite = http.SameSiteLaxMode
+	case "strict":
+		config.SameSite = http.SameSiteStrictMode
+	case "none":
+		config.SameSite = http.SameSiteNoneMode
+	default:
+		return CookieConfig{}, fmt.Errorf("cookies: unknown COOKIE_SAMESITE %q", sameSite)
+	}
+	return config, config.Validate()
+}
+
+// Validate rejects combinations browsers would silently drop the cookies for.
+func (cc CookieConfig) Validate() error {
+	switch cc.Prefix {
+	case "":
+	case "__Host-":
+		if !cc.Secure || cc.Domain != "" {
+			return errors.New("cookies: the __Host- prefix needs COOKIE_SECURE and no domain")
+		}
+	case "__Secure-":
+		if !cc.Secure {
+			return errors.New("cookies: the __Secure- prefix needs COOKIE_SECURE")
+		}
+	default:
+		return fmt.Errorf("cookies: unknown prefix %q", cc.Prefix)
+	}
+	if cc.SameSite == http.SameSiteNoneMode && !cc.Secure {
+		return errors.New("cookies: SameSite=None needs COOKIE_SECURE")
+	}
+	return nil
+}
+
+func (cc CookieConfig) SessionName() string {
+	return cc.Prefix + "session_token"
+}
+
+func (cc CookieConfig) CSRFName() string {
+	return cc.Prefix + "csrf_token"
+}
+
+// SetSession sets the HttpOnly session cookie and the csrf cookie, which
+// scripts read to echo it in the X-CSRF-Token header.
+func (cc CookieConfig) SetSession(c *gin.Context, session string, csrf string, maxAge time.Duration) {
+	cc.set(c, cc.SessionName(), session, int(maxAge.Seconds()), true)
+	cc.set(c, cc.CSRFName(), csrf, int(maxAge.Seconds()), false)
+}
+
+func (cc CookieConfig) ClearSession(c *gin.Context) {
+	cc.set(c, cc.SessionName(), "", -1, true)
+	cc.set(c, cc.CSRFName(), "", -1, false)
+}
+
+func (cc CookieConfig) set(c *gin.Context, name string, value string, maxAge int, httpOnly bool) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Domain:   cc.Domain,
+		MaxAge:   maxAge,
+		Secure:   cc.Secure,
+		HttpOnly: httpOnly,
+		SameSite: cc.SameSite,
+	})
+}
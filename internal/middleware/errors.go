@@ -0,0 +1,149 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"todoapp/internal/logging"
+	"todoapp/internal/media"
+	"todoapp/internal/store"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+// Problem is an RFC 7807 problem details body. Code is a stable machine
+// readable identifier clients can switch on, Title and Detail are for humans.
+type Problem struct {
+	Type     string             `json:"type"`
+	Title    string             `json:"title"`
+	Status   int                `json:"status"`
+	Code     string             `json:"code"`
+	Detail   string             `json:"detail,omitempty"`
+	Instance string             `json:"instance,omitempty"`
+	Errors   []store.FieldError `json:"errors,omitempty"`
+	// Extensions are additional members written next to the standard ones.
+	Extensions map[string]any `json:"-"`
+}
+
+func NewProblem(status int, code string, detail string) *Problem {
+	return &Problem{
+		Type:   "urn:todoapp:problem:" + code,
+		Title:  http.StatusText(status),
+		Status: status,
+		Code:   code,
+		Detail: detail,
+	}
+}
+
+func (p *Problem) Error() string {
+	return p.Code + ": " + p.Detail
+}
+
+// With adds an extension member to the problem.
+func (p *Problem) With(key string, value any) *Problem {
+	if p.Extensions == nil {
+		p.Extensions = map[string]any{}
+	}
+	p.Extensions[key] = value
+	return p
+}
+
+func (p *Problem) MarshalJSON() ([]byte, error) {
+	type problem Problem
+	data, err := json.Marshal((*problem)(p))
+	if err != nil || len(p.Extensions) == 0 {
+		return data, err
+	}
+	members := map[string]any{}
+	for key, value := range p.Extensions {
+		members[key] = value
+	}
+	err = json.Unmarshal(data, &members)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(members)
+}
+
+// ProblemFromError maps domain errors from the stores and the media pipeline
+// to problems. Anything unknown becomes an opaque internal error.
+func ProblemFromError(err error) *Problem {
+	var problem *Problem
+	var validationErr *store.ValidationError
+	var quotaErr *store.QuotaExceededError
+	switch {
+	case errors.As(err, &problem):
+		return problem
+	case errors.As(err, &validationErr):
+		problem = NewProblem(http.StatusBadRequest, "validation_failed", "one or more fields are invalid")
+		problem.Errors = validationErr.Fields
+		return problem
+	case errors.Is(err, store.ErrNotFound), errors.Is(err, store.ErrBlobNotFound):
+		return NewProblem(http.StatusNotFound, "not_found", "resource not found")
+	case errors.Is(err, store.ErrConflict):
+		return NewProblem(http.StatusConflict, "conflict", "resource already exists or was changed concurrently")
+	case errors.Is(err, store.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return NewProblem(http.StatusServiceUnavailable, "timeout", "the database did not answer in time, try again")
+	case errors.As(err, &quotaErr):
+		return NewProblem(http.StatusRequestEntityTooLarge, "quota_exceeded", "storage quota exceeded").
+			With("quota", quotaErr.Quota).
+			With("used", quotaErr.Used)
+	case errors.Is(err, media.ErrFileTooLarge):
+		return NewProblem(http.StatusRequestEntityTooLarge, "file_too_large", "file too large")
+	case errors.Is(err, media.ErrTooManyPixels):
+		return NewProblem(http.StatusRequestEntityTooLarge, "image_too_large", "image dimensions too large")
+	case errors.Is(err, media.ErrUnsupportedType):
+		return NewProblem(http.StatusBadRequest, "unsupported_media_type", "unsupported media type")
+	case errors.Is(err, media.ErrInvalidImage):
+		return NewProblem(http.StatusBadRequest, "invalid_image", "invalid image")
+	default:
+		return NewProblem(http.StatusInternalServerError, "internal_error", "internal server error")
+	}
+}
+
+// BindError turns a failed ShouldBind into a validation problem listing the
+// offending fields.
+func BindError(err error) error {
+	var fieldErrs validator.ValidationErrors
+	if !errors.As(err, &fieldErrs) {
+		return NewProblem(http.StatusBadRequest, "invalid_request", "malformed request body")
+	}
+	validationErr := &store.ValidationError{}
+	for _, fieldErr := range fieldErrs {
+		message := "is invalid"
+		if fieldErr.Tag() == "required" {
+			message = "is required"
+		}
+		validationErr.Add(strings.ToLower(fieldErr.Field()), message)
+	}
+	return validationErr
+}
+
+// Fail aborts the request with err, the response is written by ErrorHandler.
+func Fail(c *gin.Context, err error) {
+	c.Abort()
+	c.Error(err)
+}
+
+// ErrorHandler writes the last error attached to the context as
+// application/problem+json. Server errors are logged, their cause is never
+// sent to the client.
+func ErrorHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		if len(c.Errors) == 0 || c.Writer.Written() {
+			return
+		}
+		err := c.Errors.Last().Err
+		problem := ProblemFromError(err)
+		if problem.Status >= http.StatusInternalServerError {
+			logging.FromContext(c).Error("request failed", "error", err)
+		}
+		problem.Instance = c.Request.URL.Path
+		c.Header("Content-Type", "application/problem+json")
+		c.IndentedJSON(problem.Status, problem)
+	}
+}
@@ -0,0 +1,105 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"todoapp/internal/media"
+	"todoapp/internal/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestErrorHandlerStatus(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	validationErr := &store.ValidationError{}
+	validationErr.Add("title", "is required")
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"problem", NewProblem(http.StatusTooManyRequests, "rate_limited", "slow down"), http.StatusTooManyRequests, "rate_limited"},
+		{"validation", validationErr, http.StatusBadRequest, "validation_failed"},
+		{"not found", fmt.Errorf("handleGetPost: %w", store.ErrNotFound), http.StatusNotFound, "not_found"},
+		{"blob not found", store.ErrBlobNotFound, http.StatusNotFound, "not_found"},
+		{"conflict", fmt.Errorf("handleCreatePost: %w", store.ErrConflict), http.StatusConflict, "conflict"},
+		{"store timeout", store.ErrTimeout, http.StatusServiceUnavailable, "timeout"},
+		{"deadline", context.DeadlineExceeded, http.StatusServiceUnavailable, "timeout"},
+		{"quota", &store.QuotaExceededError{Quota: 10, Used: 8}, http.StatusRequestEntityTooLarge, "quota_exceeded"},
+		{"file too large", media.ErrFileTooLarge, http.StatusRequestEntityTooLarge, "file_too_large"},
+		{"too many pixels", media.ErrTooManyPixels, http.StatusRequestEntityTooLarge, "image_too_large"},
+		{"unsupported type", media.ErrUnsupportedType, http.StatusBadRequest, "unsupported_media_type"},
+		{"invalid image", media.ErrInvalidImage, http.StatusBadRequest, "invalid_image"},
+		{"unknown", errors.New("connection reset"), http.StatusInternalServerError, "internal_error"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			engine := gin.New()
+			engine.Use(ErrorHandler())
+			engine.GET("/posts/:id", func(c *gin.Context) {
+				Fail(c, test.err)
+			})
+			recorder := httptest.NewRecorder()
+			engine.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/posts/1", nil))
+
+			if recorder.Code != test.status {
+				t.Errorf("status = %v, want %v", recorder.Code, test.status)
+			}
+			if got := recorder.Header().Get("Content-Type"); got != "application/problem+json" {
+				t.Errorf("content type = %q, want application/problem+json", got)
+			}
+			body := map[string]any{}
+			err := json.Unmarshal(recorder.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatalf("body %q: %v", recorder.Body.String(), err)
+			}
+			if body["code"] != test.code || body["status"] != float64(test.status) || body["instance"] != "/posts/1" {
+				t.Errorf("body = %v, want code %q, status %v and the request path", body, test.code, test.status)
+			}
+		})
+	}
+}
+
+func TestErrorHandlerProblemDetails(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(ErrorHandler())
+	engine.GET("/quota", func(c *gin.Context) {
+		Fail(c, fmt.Errorf("handleUpload: %w", &store.QuotaExceededError{Quota: 10, Used: 8}))
+	})
+	engine.GET("/internal", func(c *gin.Context) {
+		Fail(c, errors.New("dial tcp 10.0.0.5:5432: connection refused"))
+	})
+	engine.GET("/written", func(c *gin.Context) {
+		c.String(http.StatusAccepted, "done")
+		c.Error(store.ErrNotFound)
+	})
+
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/quota", nil))
+	body := map[string]any{}
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+	if body["quota"] != float64(10) || body["used"] != float64(8) {
+		t.Errorf("quota body = %v, want the quota and used extensions", body)
+	}
+
+	recorder = httptest.NewRecorder()
+	engine.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/internal", nil))
+	body = map[string]any{}
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+	if body["detail"] != "internal server error" {
+		t.Errorf("internal error detail = %v, want the cause hidden", body["detail"])
+	}
+
+	recorder = httptest.NewRecorder()
+	engine.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/written", nil))
+	if recorder.Code != http.StatusAccepted || recorder.Body.String() != "done" {
+		t.Errorf("written response = %v %q, want it left alone", recorder.Code, recorder.Body.String())
+	}
+}
@@ -1,20 +1,26 @@
 package middleware
 
 import (
+	"crypto/subtle"
 	"errors"
-	"log"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
+	"todoapp/internal/logging"
 	"todoapp/internal/store"
 	"todoapp/internal/utils"
 
 	"github.com/gin-gonic/gin"
-	"gorm.io/gorm"
 )
 
 type UserMiddleware struct {
 	UserStore  store.UserStore
 	TokenStore store.TokenStore
-	Logger     *log.Logger
+	Cookies    CookieConfig
+	// SessionMaxAge expires sessions server side, bearer clients do not
+	// drop their token when the cookie would have expired.
+	SessionMaxAge time.Duration
 }
 
 // TODO: make middleware to give the handlerfunctions in the group access to the logged in user, admin? user, and tokens
@@ -23,63 +29,115 @@ func SetUser(user *store.User, c *gin.Context) {
 	c.Set("user", user)
 }
 
+// LookupUser returns the user Authenticate set, without failing the request
+// on routes that do not authenticate.
+func LookupUser(c *gin.Context) (*store.User, bool) {
+	user, ok := c.Keys["user"].(*store.User)
+	return user, ok
+}
+
 func GetUser(c *gin.Context) *store.User {
 	user := &store.User{}
 	user, ok := c.Keys["user"].(*store.User)
 	if !ok {
-		c.Abort()
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "missing user in header"})
+		Fail(c, errors.New("getUser: missing user in context"))
 		return nil
 	}
 	return user
 }
 
+const (
+	tokenKey      = "token"
+	authMethodKey = "authMethod"
+
+	AuthMethodCookie = "cookie"
+	AuthMethodBearer = "bearer"
+)
+
+// Authenticate resolves the session from the session cookie or from an
+// "Authorization: Bearer <session token>" header. Requests without a valid
+// session continue as the anonymous user, RequireCSRF and RequreLogin decide
+// what they may do.
 func (um *UserMiddleware) Authenticate() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		csrf_token := c.GetHeader("X-CSRF-Token")
-
-		if csrf_token == "" {
-			SetUser(store.AnonymousUser, c)
-			return
+		SetUser(store.AnonymousUser, c)
+		session_token, method := "", ""
+		if bearer, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+			session_token, method = bearer, AuthMethodBearer
+		} else if cookie, err := c.Cookie(um.Cookies.SessionName()); err == nil {
+			session_token, method = cookie, AuthMethodCookie
 		}
-		session_token, err := c.Cookie("session_token")
-		if err != nil || session_token == "" || csrf_token == "" {
-			SetUser(store.AnonymousUser, c)
+		if session_token == "" {
 			return
 		}
-		token, err := um.TokenStore.GetToken(utils.HashToken(session_token), utils.HashToken(csrf_token))
+		token, err := um.TokenStore.GetTokenBySession(c.Request.Context(), utils.HashToken(session_token))
 		if err != nil {
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				SetUser(store.AnonymousUser, c)
+			if errors.Is(err, store.ErrNotFound) {
 				return
 			}
-			c.Abort()
-			um.Logger.Printf("ERROR: userMiddlewareGetToken: %v\n", err)
-			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+			Fail(c, fmt.Errorf("userMiddlewareGetToken: %w", err))
+			return
+		}
+		if um.SessionMaxAge > 0 && time.Since(token.CreatedAt) > um.SessionMaxAge {
 			return
 		}
-		user, err := um.UserStore.GetUserByID(token.UserID)
+		user, err := um.UserStore.GetUserByID(c.Request.Context(), token.UserID)
 		if err != nil {
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				SetUser(store.AnonymousUser, c)
+			if errors.Is(err, store.ErrNotFound) {
 				return
 			}
-			c.Abort()
-			um.Logger.Printf("ERROR: userMiddlewareGetUserByID: %v\n", err)
-			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+			Fail(c, fmt.Errorf("userMiddlewareGetUserByID: %w", err))
 			return
 		}
 		SetUser(user, c)
+		c.Set(tokenKey, token)
+		c.Set(authMethodKey, method)
+		logging.With(c, "user_id", user.ID)
 		c.Next()
 	}
 }
 
+// AuthMethod reports how Authenticate identified the user, empty for
+// anonymous requests.
+func AuthMethod(c *gin.Context) string {
+	return c.GetString(authMethodKey)
+}
+
+// LookupToken returns the session Authenticate resolved, false for
+// anonymous requests.
+func LookupToken(c *gin.Context) (*store.Token, bool) {
+	token, ok := c.Keys[tokenKey].(*store.Token)
+	return token, ok
+}
+
+// RequireCSRF rejects state changing requests authenticated by the session
+// cookie unless the X-CSRF-Token header carries the csrf token issued with
+// that session. A cross site attacker can make the browser send the cookie
+// but cannot read the csrf cookie to copy it into the header. Bearer clients
+// are exempt since browsers never attach their token on their own.
+func (um *UserMiddleware) RequireCSRF() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			return
+		}
+		if AuthMethod(c) != AuthMethodCookie {
+			return
+		}
+		token := c.MustGet(tokenKey).(*store.Token)
+		header := c.GetHeader("X-CSRF-Token")
+		if header == "" || subtle.ConstantTimeCompare([]byte(utils.HashToken(header)), []byte(token.CSRFToken.Hash)) != 1 {
+			Fail(c, NewProblem(http.StatusForbidden, "csrf_failed", "missing or invalid X-CSRF-Token header"))
+			return
+		}
+	}
+}
+
 func (um *UserMiddleware) RequreLogin() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		user := GetUser(c)
 		if user.IsAnonymous() {
-			c.Abort()
-			c.IndentedJSON(http.StatusUnauthorized, gin.H{"error": "invalid session"})
+			Fail(c, NewProblem(http.StatusUnauthorized, "unauthenticated", "invalid session"))
 			return
 		}
 		c.Next()
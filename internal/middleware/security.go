@@ -0,0 +1,183 @@
+package middleware
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"todoapp/internal/logging"
+	"todoapp/internal/metrics"
+	"todoapp/internal/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SecurityPolicy is the set of security headers sent for a route group.
+type SecurityPolicy struct {
+	// CSP is the Content-Security-Policy, every "{nonce}" is replaced by a
+	// fresh 'nonce-...' source that handlers read with CSPNonce.
+	CSP string
+	// ReportOnly sends the CSP as Content-Security-Policy-Report-Only so
+	// violations are reported but nothing is blocked.
+	ReportOnly bool
+	// ReportURI receives violation reports, empty disables reporting.
+	ReportURI                 string
+	FrameOptions              string
+	ReferrerPolicy            string
+	CrossOriginResourcePolicy string
+	PermissionsPolicy         string
+	// HSTSMaxAge enables Strict-Transport-Security when above zero.
+	HSTSMaxAge time.Duration
+}
+
+const cspNonceKey = "cspNonce"
+
+// SecurityHeaders sets the headers of the policy. Route groups override the
+// global policy by adding their own SecurityHeaders, later calls win.
+func SecurityHeaders(policy SecurityPolicy) gin.HandlerFunc {
+	csp := policy.CSP
+	if csp != "" && policy.ReportURI != "" {
+		csp += "; report-uri " + policy.ReportURI + "; report-to csp"
+	}
+	cspHeader := "Content-Security-Policy"
+	if policy.ReportOnly {
+		cspHeader = "Content-Security-Policy-Report-Only"
+	}
+	hsts := ""
+	if policy.HSTSMaxAge > 0 {
+		hsts = "max-age=" + strconv.Itoa(int(policy.HSTSMaxAge.Seconds())) + "; includeSubDomains"
+	}
+	return func(c *gin.Context) {
+		header := c.Writer.Header()
+		header.Set("X-Content-Type-Options", "nosniff")
+		setOrDelete(header, "X-Frame-Options", policy.FrameOptions)
+		setOrDelete(header, "Referrer-Policy", policy.ReferrerPolicy)
+		setOrDelete(header, "Cross-Origin-Resource-Policy", policy.CrossOriginResourcePolicy)
+		setOrDelete(header, "Permissions-Policy", policy.PermissionsPolicy)
+		setOrDelete(header, "Strict-Transport-Security", hsts)
+		header.Del("Content-Security-Policy")
+		header.Del("Content-Security-Policy-Report-Only")
+		header.Del("Reporting-Endpoints")
+		if csp == "" {
+			return
+		}
+		value := csp
+		if strings.Contains(csp, "{nonce}") {
+			nonce, err := utils.GenerateToken(16)
+			if err != nil {
+				Fail(c, err)
+				return
+			}
+			c.Set(cspNonceKey, nonce)
+			value = strings.ReplaceAll(csp, "{nonce}", "'nonce-"+nonce+"'")
+		}
+		header.Set(cspHeader, value)
+		if policy.ReportURI != "" {
+			header.Set("Reporting-Endpoints", `csp="`+policy.ReportURI+`"`)
+		}
+	}
+}
+
+func setOrDelete(header http.Header, key string, value string) {
+	if value == "" {
+		header.Del(key)
+		return
+	}
+	header.Set(key, value)
+}
+
+// CSPNonce returns the nonce inline scripts and styles of the response have
+// to carry, empty when the policy has none.
+func CSPNonce(c *gin.Context) string {
+	return c.GetString(cspNonceKey)
+}
+
+type cspViolation struct {
+	DocumentURI        string `json:"document-uri"`
+	BlockedURI         string `json:"blocked-uri"`
+	ViolatedDirective  string `json:"violated-directive"`
+	EffectiveDirective string `json:"effective-directive"`
+	Disposition        string `json:"disposition"`
+}
+
+// reportingViolation is the body of a Reporting API csp-violation report.
+type reportingViolation struct {
+	DocumentURL        string `json:"documentURL"`
+	BlockedURL         string `json:"blockedURL"`
+	EffectiveDirective string `json:"effectiveDirective"`
+	Disposition        string `json:"disposition"`
+}
+
+var cspDirectives = map[string]bool{
+	"default-src": true, "script-src": true, "script-src-elem": true, "script-src-attr": true,
+	"style-src": true, "style-src-elem": true, "style-src-attr": true, "img-src": true,
+	"font-src": true, "connect-src": true, "media-src": true, "object-src": true,
+	"frame-src": true, "child-src": true, "worker-src": true, "manifest-src": true,
+	"form-action": true, "frame-ancestors": true, "base-uri": true, "sandbox": true,
+}
+
+// maxCSPReportBytes bounds report bodies, the endpoint is unauthenticated.
+const maxCSPReportBytes = 64 << 10
+
+// HandleCSPReport collects violation reports in both the legacy report-uri
+// format and the Reporting API format, logging and counting each one.
+func HandleCSPReport(c *gin.Context) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxCSPReportBytes))
+	if err != nil {
+		Fail(c, NewProblem(http.StatusBadRequest, "invalid_request", "unreadable report"))
+		return
+	}
+	violations := []cspViolation{}
+	switch c.ContentType() {
+	case "application/csp-report":
+		report := struct {
+			CSPReport cspViolation `json:"csp-report"`
+		}{}
+		err = json.Unmarshal(body, &report)
+		violations = append(violations, report.CSPReport)
+	case "application/reports+json":
+		reports := []struct {
+			Type string             `json:"type"`
+			Body reportingViolation `json:"body"`
+		}{}
+		err = json.Unmarshal(body, &reports)
+		for _, report := range reports {
+			if report.Type != "csp-violation" {
+				continue
+			}
+			violations = append(violations, cspViolation{
+				DocumentURI:        report.Body.DocumentURL,
+				BlockedURI:         report.Body.BlockedURL,
+				EffectiveDirective: report.Body.EffectiveDirective,
+				Disposition:        report.Body.Disposition,
+			})
+		}
+	default:
+		Fail(c, NewProblem(http.StatusUnsupportedMediaType, "unsupported_media_type", "expected application/csp-report or application/reports+json"))
+		return
+	}
+	if err != nil {
+		Fail(c, NewProblem(http.StatusBadRequest, "invalid_request", "malformed report"))
+		return
+	}
+	for _, violation := range violations {
+		directive := violation.EffectiveDirective
+		if directive == "" {
+			directive, _, _ = strings.Cut(violation.ViolatedDirective, " ")
+		}
+		if !cspDirectives[directive] {
+			// reports are unauthenticated, keep label values bounded
+			directive = "other"
+		}
+		metrics.CSPViolations.WithLabelValues(directive).Inc()
+		logging.FromContext(c).Warn("csp violation",
+			"document_uri", violation.DocumentURI,
+			"blocked_uri", violation.BlockedURI,
+			"directive", directive,
+			"disposition", violation.Disposition,
+		)
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,153 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"todoapp/internal/metrics"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSecurityHeadersNonce(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	nonce := ""
+	engine.Use(SecurityHeaders(SecurityPolicy{CSP: "script-src {nonce}; style-src {nonce}"}))
+	engine.GET("/", func(c *gin.Context) {
+		nonce = CSPNonce(c)
+		c.Status(http.StatusOK)
+	})
+
+	seen := map[string]bool{}
+	for range 2 {
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+		if nonce == "" || seen[nonce] {
+			t.Fatalf("nonce = %q, want a fresh one per request", nonce)
+		}
+		seen[nonce] = true
+		want := "script-src 'nonce-" + nonce + "'; style-src 'nonce-" + nonce + "'"
+		if got := recorder.Header().Get("Content-Security-Policy"); got != want {
+			t.Errorf("csp = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestSecurityHeadersOverride(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(SecurityHeaders(SecurityPolicy{
+		CSP:            "default-src 'none'",
+		ReportURI:      "/csp-report",
+		FrameOptions:   "DENY",
+		ReferrerPolicy: "no-referrer",
+		HSTSMaxAge:     365 * 24 * time.Hour,
+	}))
+	engine.GET("/api", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	engine.GET("/docs", SecurityHeaders(SecurityPolicy{
+		CSP:            "default-src 'self'",
+		ReportOnly:     true,
+		ReferrerPolicy: "same-origin",
+	}), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	tests := []struct {
+		path    string
+		headers map[string]string
+	}{
+		{"/api", map[string]string{
+			"Content-Security-Policy":             "default-src 'none'; report-uri /csp-report; report-to csp",
+			"Content-Security-Policy-Report-Only": "",
+			"Reporting-Endpoints":                 `csp="/csp-report"`,
+			"X-Frame-Options":                     "DENY",
+			"Referrer-Policy":                     "no-referrer",
+			"Strict-Transport-Security":           "max-age=31536000; includeSubDomains",
+			"X-Content-Type-Options":              "nosniff",
+		}},
+		{"/docs", map[string]string{
+			"Content-Security-Policy":             "",
+			"Content-Security-Policy-Report-Only": "default-src 'self'",
+			"Reporting-Endpoints":                 "",
+			"X-Frame-Options":                     "",
+			"Referrer-Policy":                     "same-origin",
+			"Strict-Transport-Security":           "",
+			"X-Content-Type-Options":              "nosniff",
+		}},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.path, nil))
+		for key, want := range test.headers {
+			if got := recorder.Header().Get(key); got != want {
+				t.Errorf("%v %v = %q, want %q", test.path, key, got, want)
+			}
+		}
+	}
+}
+
+func TestHandleCSPReport(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(ErrorHandler())
+	engine.POST("/csp-report", HandleCSPReport)
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+		// counted is the number of violations expected per directive label
+		counted map[string]float64
+	}{
+		{
+			"report-uri", "application/csp-report",
+			`{"csp-report": {"document-uri": "https://example.com/", "violated-directive": "script-src 'self'", "blocked-uri": "inline"}}`,
+			http.StatusNoContent, map[string]float64{"script-src": 1},
+		},
+		{
+			"report-uri effective directive", "application/csp-report",
+			`{"csp-report": {"violated-directive": "img-src 'self'", "effective-directive": "img-src"}}`,
+			http.StatusNoContent, map[string]float64{"img-src": 1},
+		},
+		{
+			"reporting api", "application/reports+json",
+			`[{"type": "csp-violation", "body": {"documentURL": "https://example.com/", "effectiveDirective": "style-src-elem"}},
+			  {"type": "deprecation", "body": {}},
+			  {"type": "csp-violation", "body": {"effectiveDirective": "connect-src"}}]`,
+			http.StatusNoContent, map[string]float64{"style-src-elem": 1, "connect-src": 1},
+		},
+		{
+			"unknown directive", "application/reports+json",
+			`[{"type": "csp-violation", "body": {"effectiveDirective": "made-up-directive-123"}}]`,
+			http.StatusNoContent, map[string]float64{"other": 1, "made-up-directive-123": 0},
+		},
+		{"malformed", "application/csp-report", `{"csp-report":`, http.StatusBadRequest, nil},
+		{"wrong content type", "application/json", `{}`, http.StatusUnsupportedMediaType, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before := map[string]float64{}
+			for directive := range test.counted {
+				before[directive] = testutil.ToFloat64(metrics.CSPViolations.WithLabelValues(directive))
+			}
+			request := httptest.NewRequest(http.MethodPost, "/csp-report", strings.NewReader(test.body))
+			request.Header.Set("Content-Type", test.contentType)
+			recorder := httptest.NewRecorder()
+			engine.ServeHTTP(recorder, request)
+			if recorder.Code != test.status {
+				t.Errorf("status = %v, want %v", recorder.Code, test.status)
+			}
+			for directive, want := range test.counted {
+				got := testutil.ToFloat64(metrics.CSPViolations.WithLabelValues(directive)) - before[directive]
+				if got != want {
+					t.Errorf("%v violations counted = %v, want %v", directive, got, want)
+				}
+			}
+		})
+	}
+}
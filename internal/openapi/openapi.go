@@ -0,0 +1,255 @@
+package openapi
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"todoapp/internal/middleware"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Document is the subset of an OpenAPI 3 document the api needs.
+type Document struct {
+	OpenAPI    string              `json:"openapi"`
+	Info       Info                `json:"info"`
+	Paths      map[string]PathItem `json:"paths"`
+	Components Components          `json:"components"`
+}
+
+type Info struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// PathItem maps lower case http methods to operations.
+type PathItem map[string]*Operation
+
+type Operation struct {
+	Summary     string                `json:"summary,omitempty"`
+	Description string                `json:"description,omitempty"`
+	Tags        []string              `json:"tags,omitempty"`
+	Parameters  []Parameter           `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]Response   `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required,omitempty"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type Response struct {
+	Description string               `json:"description"`
+	Headers     map[string]Header    `json:"headers,omitempty"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+type Header struct {
+	Description string  `json:"description,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+}
+
+type Components struct {
+	Schemas         map[string]*Schema        `json:"schemas,omitempty"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+type SecurityScheme struct {
+	Type        string `json:"type"`
+	Scheme      string `json:"scheme,omitempty"`
+	In          string `json:"in,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+func New(info Info) *Document {
+	return &Document{
+		OpenAPI: "3.0.3",
+		Info:    info,
+		Paths:   map[string]PathItem{},
+		Components: Components{
+			Schemas:         map[string]*Schema{},
+			SecuritySchemes: map[string]SecurityScheme{},
+		},
+	}
+}
+
+var ginParam = regexp.MustCompile(`[:*](\w+)`)
+
+// Add documents an operation under a gin route path such as /post/:id. Path
+// parameters the operation does not describe itself are added as strings.
+func (d *Document) Add(method string, path string, op *Operation) {
+	for _, match := range ginParam.FindAllStringSubmatch(path, -1) {
+		name := match[1]
+		described := slices.ContainsFunc(op.Parameters, func(p Parameter) bool {
+			return p.In == "path" && p.Name == name
+		})
+		if !described {
+			op.Parameters = append(op.Parameters, Parameter{Name: name, In: "path", Required: true, Schema: &Schema{Type: "string"}})
+		}
+	}
+	path = ginParam.ReplaceAllString(path, "{$1}")
+	item, ok := d.Paths[path]
+	if !ok {
+		item = PathItem{}
+		d.Paths[path] = item
+	}
+	item[strings.ToLower(method)] = op
+}
+
+// Schema registers the schema of v under name in the components and returns
+// a reference to it.
+func (d *Document) Schema(name string, v any) *Schema {
+	if _, ok := d.Components.Schemas[name]; !ok {
+		d.Components.Schemas[name] = SchemaOf(v)
+	}
+	return &Schema{Ref: "#/components/schemas/" + name}
+}
+
+// Missing lists the registered routes that have no operation in the
+// document, formatted as "METHOD /path".
+func (d *Document) Missing(routes gin.RoutesInfo) []string {
+	missing := []string{}
+	for _, route := range routes {
+		item := d.Paths[ginParam.ReplaceAllString(route.Path, "{$1}")]
+		if item[strings.ToLower(route.Method)] == nil {
+			missing = append(missing, fmt.Sprintf("%v %v", route.Method, route.Path))
+		}
+	}
+	return missing
+}
+
+func (d *Document) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, d)
+	}
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	uuidType = reflect.TypeOf(uuid.UUID{})
+)
+
+// SchemaOf describes the json encoding of v, following json tags. Fields with
+// a binding:"required" tag are listed as required.
+func SchemaOf(v any) *Schema {
+	return schemaOf(reflect.TypeOf(v))
+}
+
+func schemaOf(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t {
+	case timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case uuidType:
+		return &Schema{Type: "string", Format: "uuid"}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: schemaOf(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: schemaOf(t.Elem())}
+	case reflect.Struct:
+		schema := &Schema{Type: "object", Properties: map[string]*Schema{}}
+		for i := range t.NumField() {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if field.Anonymous && name == "" {
+				// embedded structs are flattened by encoding/json
+				embedded := schemaOf(field.Type)
+				for key, property := range embedded.Properties {
+					schema.Properties[key] = property
+				}
+				schema.Required = append(schema.Required, embedded.Required...)
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			schema.Properties[name] = schemaOf(field.Type)
+			if slices.Contains(strings.Split(field.Tag.Get("binding"), ","), "required") {
+				schema.Required = append(schema.Required, name)
+			}
+		}
+		return schema
+	default:
+		return &Schema{}
+	}
+}
+
+// UIHandler serves Swagger UI for the document at specURL. The UI assets are
+// loaded from a CDN so nothing has to be vendored, the scripts carry the csp
+// nonce of the response.
+func UIHandler(specURL string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		nonce := middleware.CSPNonce(c)
+		page := fmt.Sprintf(uiPage, nonce, nonce, specURL)
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(page))
+	}
+}
+
+const uiPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>API documentation</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script nonce="%s" src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js" crossorigin></script>
+  <script nonce="%s">
+    window.ui = SwaggerUIBundle({ url: %q, dom_id: "#swagger-ui", withCredentials: true });
+  </script>
+</body>
+</html>
+`
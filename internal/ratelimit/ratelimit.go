@@ -0,0 +1,294 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"todoapp/internal/logging"
+	"todoapp/internal/middleware"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Limit is a token bucket: Burst requests at once, refilled at Requests per
+// Period.
+type Limit struct {
+	Requests int
+	Period   time.Duration
+	Burst    int
+}
+
+// ParseLimit reads limits written as "<requests>/<period>" with an optional
+// ",<burst>", e.g. "10/1m" or "60/1m,20". "off" disables the limit.
+func ParseLimit(value string) (Limit, error) {
+	if value == "off" {
+		return Limit{}, nil
+	}
+	rate, burst, hasBurst := strings.Cut(value, ",")
+	requests, period, ok := strings.Cut(rate, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("ratelimit: invalid limit %q", value)
+	}
+	limit := Limit{}
+	var err error
+	limit.Requests, err = strconv.Atoi(requests)
+	if err != nil || limit.Requests <= 0 {
+		return Limit{}, fmt.Errorf("ratelimit: invalid requests in %q", value)
+	}
+	limit.Period, err = time.ParseDuration(period)
+	if err != nil || limit.Period <= 0 {
+		return Limit{}, fmt.Errorf("ratelimit: invalid period in %q", value)
+	}
+	limit.Burst = limit.Requests
+	if hasBurst {
+		limit.Burst, err = strconv.Atoi(burst)
+		if err != nil || limit.Burst <= 0 {
+			return Limit{}, fmt.Errorf("ratelimit: invalid burst in %q", value)
+		}
+	}
+	return limit, nil
+}
+
+func (l Limit) Enabled() bool {
+	return l.Requests > 0
+}
+
+// rate is the refill rate in tokens per second.
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / l.Period.Seconds()
+}
+
+// Policy formats the limit for the RateLimit-Policy header.
+func (l Limit) Policy() string {
+	return fmt.Sprintf("%d;w=%d", l.Requests, int(l.Period.Seconds()))
+}
+
+type Result struct {
+	Allowed   bool
+	Remaining int
+	// RetryAfter is how long until the next request is allowed, 0 if it is.
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+}
+
+func newResult(limit Limit, tokens float64, allowed bool) Result {
+	rate := limit.rate()
+	result := Result{
+		Allowed:   allowed,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     time.Duration((float64(limit.Burst) - tokens) / rate * float64(time.Second)),
+	}
+	if !allowed {
+		result.RetryAfter = time.Duration((1 - tokens) / rate * float64(time.Second))
+	}
+	return result
+}
+
+// Store keeps the buckets. The memory store is for single instances, the
+// redis store shares buckets between instances.
+type Store interface {
+	Allow(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// OpenStore picks the backend from RATE_LIMIT_BACKEND ("memory" or "redis",
+// the latter connecting to REDIS_URL).
+func OpenStore() (Store, error) {
+	switch backend := os.Getenv("RATE_LIMIT_BACKEND"); backend {
+	case "", "memory":
+		return NewMemoryStore(), nil
+	case "redis":
+		options, err := redis.ParseURL(os.Getenv("REDIS_URL"))
+		if err != nil {
+			return nil, fmt.Errorf("ratelimit: redis url with %w", err)
+		}
+		return NewRedisStore(redis.NewClient(options)), nil
+	default:
+		return nil, fmt.Errorf("ratelimit: unknown backend %q", backend)
+	}
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// full is when the bucket has refilled completely under its own limit
+	full time.Time
+}
+
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets:   map[string]*bucket{},
+		lastSweep: time.Now(),
+	}
+}
+
+// sweepInterval is how often buckets that have refilled completely, and
+// are therefore no different from a missing bucket, are dropped.
+const sweepInterval = time.Minute
+
+func (ms *MemoryStore) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(ms.lastSweep) > sweepInterval {
+		ms.sweep(now)
+	}
+	b, ok := ms.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		ms.buckets[key] = b
+	}
+	rate := limit.rate()
+	b.tokens = min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	b.full = now.Add(time.Duration((float64(limit.Burst) - b.tokens) / rate * float64(time.Second)))
+	return newResult(limit, b.tokens, allowed), nil
+}
+
+// sweep drops the buckets that have refilled completely, they are no
+// different from a missing bucket.
+func (ms *MemoryStore) sweep(now time.Time) {
+	for key, b := range ms.buckets {
+		if !now.Before(b.full) {
+			delete(ms.buckets, key)
+		}
+	}
+	ms.lastSweep = now
+}
+
+// tokenBucketScript refills and takes from the bucket atomically, using the
+// redis clock so instances with skewed clocks agree.
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local state = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil((burst - tokens) / rate) + 1000)
+return {allowed, tostring(tokens)}
+`)
+
+type RedisStore struct {
+	client redis.UniversalClient
+}
+
+func NewRedisStore(client redis.UniversalClient) *RedisStore {
+	return &RedisStore{
+		client: client,
+	}
+}
+
+func (rs *RedisStore) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	ratePerMs := limit.rate() / 1000
+	values, err := tokenBucketScript.Run(ctx, rs.client, []string{key}, ratePerMs, limit.Burst).Slice()
+	if err != nil {
+		return Result{}, fmt.Errorf("ratelimit: redis with %w", err)
+	}
+	if len(values) != 2 {
+		return Result{}, fmt.Errorf("ratelimit: unexpected redis reply %v", values)
+	}
+	allowed, _ := values[0].(int64)
+	tokensText, _ := values[1].(string)
+	tokens, err := strconv.ParseFloat(tokensText, 64)
+	if err != nil {
+		return Result{}, fmt.Errorf("ratelimit: unexpected redis reply %v", values)
+	}
+	return newResult(limit, tokens, allowed == 1), nil
+}
+
+func (rs *RedisStore) Ping(ctx context.Context) error {
+	return rs.client.Ping(ctx).Err()
+}
+
+// KeyFunc identifies who a request is counted against.
+type KeyFunc func(c *gin.Context) string
+
+func ByIP(c *gin.Context) string {
+	return "ip:" + c.ClientIP()
+}
+
+// ByUser counts logged in users by id and everyone else by ip, it has to run
+// after Authenticate.
+func ByUser(c *gin.Context) string {
+	user, ok := middleware.LookupUser(c)
+	if !ok || user.IsAnonymous() {
+		return ByIP(c)
+	}
+	return "user:" + user.ID.String()
+}
+
+// ByToken counts bearer clients by the session they authenticated with, so
+// every api client of a user gets its own bucket. Cookie sessions and
+// anonymous requests are counted by ByUser. It has to run after Authenticate.
+func ByToken(c *gin.Context) string {
+	token, ok := middleware.LookupToken(c)
+	if !ok || middleware.AuthMethod(c) != middleware.AuthMethodBearer {
+		return ByUser(c)
+	}
+	return "token:" + strconv.Itoa(token.ID)
+}
+
+type Limiter struct {
+	store Store
+}
+
+func NewLimiter(store Store) *Limiter {
+	return &Limiter{
+		store: store,
+	}
+}
+
+// Middleware limits the requests of a route group. name keeps the buckets
+// of different groups apart. Requests are let through when the store fails,
+// an outage of the limiter should not take the api down with it.
+func (l *Limiter) Middleware(name string, limit Limit, key KeyFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !limit.Enabled() {
+			return
+		}
+		result, err := l.store.Allow(c.Request.Context(), "ratelimit:"+name+":"+key(c), limit)
+		if err != nil {
+			logging.FromContext(c).Error("rateLimitAllow", "error", err, "limit", name)
+			return
+		}
+		c.Header("RateLimit-Policy", limit.Policy())
+		c.Header("RateLimit-Limit", strconv.Itoa(limit.Burst))
+		c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		c.Header("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+		if !result.Allowed {
+			c.Header("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+			middleware.Fail(c, middleware.NewProblem(http.StatusTooManyRequests, "rate_limited", "too many requests, retry later"))
+		}
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
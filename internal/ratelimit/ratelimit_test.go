@@ -0,0 +1,184 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+	"todoapp/internal/middleware"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestMemoryStoreSweep(t *testing.T) {
+	ms := NewMemoryStore()
+	ctx := context.Background()
+	slow := Limit{Requests: 1, Period: time.Hour, Burst: 1}
+	fast := Limit{Requests: 10, Period: time.Second, Burst: 10}
+	ms.Allow(ctx, "slow", slow)
+	ms.Allow(ctx, "fast", fast)
+
+	ms.sweep(time.Now().Add(2 * time.Minute))
+	if _, ok := ms.buckets["fast"]; ok {
+		t.Error("the refilled fast bucket was kept")
+	}
+	result, _ := ms.Allow(ctx, "slow", slow)
+	if result.Allowed {
+		t.Error("sweeping on another limit's refill time reset the slow bucket")
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore(), "")
+}
+
+// TestRedisStore runs against the redis at REDIS_TEST_URL, by default
+// database 15 of a local redis, and is skipped when there is none.
+func TestRedisStore(t *testing.T) {
+	url := os.Getenv("REDIS_TEST_URL")
+	if url == "" {
+		url = "redis://localhost:6379/15"
+	}
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		t.Fatalf("REDIS_TEST_URL %q: %v", url, err)
+	}
+	conn, err := net.DialTimeout("tcp", options.Addr, time.Second)
+	if err != nil {
+		t.Skipf("no redis server at %v: %v", options.Addr, err)
+	}
+	conn.Close()
+	client := redis.NewClient(options)
+	defer client.Close()
+	rs := NewRedisStore(client)
+	err = rs.Ping(context.Background())
+	if err != nil {
+		t.Skipf("redis server at %v unusable: %v", options.Addr, err)
+	}
+	prefix := "ratelimit-test:" + time.Now().Format(time.RFC3339Nano) + ":"
+	testStore(t, rs, prefix)
+}
+
+// testStore checks the token bucket semantics every Store has to share.
+// prefix keeps the keys of different runs apart in shared backends.
+func testStore(t *testing.T, s Store, prefix string) {
+	t.Helper()
+	ctx := context.Background()
+	limit := Limit{Requests: 2, Period: time.Minute, Burst: 3}
+
+	for i, remaining := range []int{2, 1, 0} {
+		result, err := s.Allow(ctx, prefix+"burst", limit)
+		if err != nil {
+			t.Fatalf("Allow: %v", err)
+		}
+		if !result.Allowed || result.Remaining != remaining || result.RetryAfter != 0 {
+			t.Errorf("request %v = %+v, want allowed with %v remaining", i+1, result, remaining)
+		}
+	}
+	result, err := s.Allow(ctx, prefix+"burst", limit)
+	if err != nil {
+		t.Fatalf("Allow: %v", err)
+	}
+	if result.Allowed || result.Remaining != 0 {
+		t.Errorf("request over the burst = %+v, want it denied", result)
+	}
+	// one token takes 30s to refill, the bucket 90s
+	if result.RetryAfter <= 29*time.Second || result.RetryAfter > 30*time.Second {
+		t.Errorf("retry after = %v, want about 30s", result.RetryAfter)
+	}
+	if result.Reset <= 89*time.Second || result.Reset > 90*time.Second {
+		t.Errorf("reset = %v, want about 90s", result.Reset)
+	}
+
+	result, err = s.Allow(ctx, prefix+"other", limit)
+	if err != nil || !result.Allowed {
+		t.Errorf("another key = %+v, %v, want its own bucket", result, err)
+	}
+
+	fast := Limit{Requests: 20, Period: time.Second, Burst: 1}
+	s.Allow(ctx, prefix+"refill", fast)
+	result, _ = s.Allow(ctx, prefix+"refill", fast)
+	if result.Allowed {
+		t.Errorf("second request to a burst of one = %+v, want it denied", result)
+	}
+	time.Sleep(100 * time.Millisecond)
+	result, err = s.Allow(ctx, prefix+"refill", fast)
+	if err != nil || !result.Allowed {
+		t.Errorf("request after the refill = %+v, %v, want it allowed", result, err)
+	}
+}
+
+type failingStore struct{}
+
+func (failingStore) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	return Result{}, errors.New("connection refused")
+}
+
+func newTestEngine(store Store, limit Limit) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(middleware.ErrorHandler())
+	engine.GET("/posts", NewLimiter(store).Middleware("posts", limit, ByIP), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	return engine
+}
+
+func TestMiddlewareHeaders(t *testing.T) {
+	engine := newTestEngine(NewMemoryStore(), Limit{Requests: 2, Period: time.Minute, Burst: 2})
+	tests := []struct {
+		status     int
+		remaining  string
+		reset      string
+		retryAfter string
+	}{
+		{http.StatusOK, "1", "30", ""},
+		{http.StatusOK, "0", "60", ""},
+		{http.StatusTooManyRequests, "0", "60", "30"},
+	}
+	for i, test := range tests {
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/posts", nil))
+		headers := recorder.Header()
+		if recorder.Code != test.status {
+			t.Errorf("request %v status = %v, want %v", i+1, recorder.Code, test.status)
+		}
+		if headers.Get("RateLimit-Policy") != "2;w=60" || headers.Get("RateLimit-Limit") != "2" {
+			t.Errorf("request %v policy = %q, limit = %q, want 2;w=60 and 2", i+1, headers.Get("RateLimit-Policy"), headers.Get("RateLimit-Limit"))
+		}
+		if headers.Get("RateLimit-Remaining") != test.remaining || headers.Get("RateLimit-Reset") != test.reset {
+			t.Errorf("request %v remaining = %q, reset = %q, want %q and %q", i+1, headers.Get("RateLimit-Remaining"), headers.Get("RateLimit-Reset"), test.remaining, test.reset)
+		}
+		if headers.Get("Retry-After") != test.retryAfter {
+			t.Errorf("request %v Retry-After = %q, want %q", i+1, headers.Get("Retry-After"), test.retryAfter)
+		}
+	}
+}
+
+func TestMiddlewarePassThrough(t *testing.T) {
+	tests := []struct {
+		name  string
+		store Store
+		limit Limit
+	}{
+		{"off", NewMemoryStore(), Limit{}},
+		{"store failure", failingStore{}, Limit{Requests: 1, Period: time.Minute, Burst: 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			engine := newTestEngine(test.store, test.limit)
+			for range 3 {
+				recorder := httptest.NewRecorder()
+				engine.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/posts", nil))
+				if recorder.Code != http.StatusOK || recorder.Header().Get("RateLimit-Policy") != "" {
+					t.Fatalf("status = %v, headers = %v, want the request let through without headers", recorder.Code, recorder.Header())
+				}
+			}
+		})
+	}
+}
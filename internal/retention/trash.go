@@ -0,0 +1,158 @@
+package retention
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+	"todoapp/internal/export"
+	"todoapp/internal/media"
+	"todoapp/internal/store"
+	"todoapp/internal/worker"
+
+	"github.com/google/uuid"
+)
+
+// TrashReport summarises one purge pass.
+type TrashReport struct {
+	Posts int64
+	Users int
+}
+
+// TrashPurger permanently removes posts and accounts that have been in the
+// trash for longer than the retention period. A purged account takes its
+// images, account exports and any leftover uploads with it.
+type TrashPurger struct {
+	userStore  store.UserStore
+	postStore  store.PostStore
+	transactor store.Transactor
+	blobStore  store.BlobStore
+	// chunkStore holds the chunks of unfinished uploads
+	chunkStore store.BlobStore
+	exporter   *export.Exporter
+	logger     *slog.Logger
+	retention  time.Duration
+	stop       chan struct{}
+	wg         sync.WaitGroup
+}
+
+func NewTrashPurger(userStore store.UserStore, postStore store.PostStore, transactor store.Transactor, blobStore store.BlobStore, chunkStore store.BlobStore, exporter *export.Exporter, logger *slog.Logger, retention time.Duration) *TrashPurger {
+	return &TrashPurger{
+		userStore:  userStore,
+		postStore:  postStore,
+		transactor: transactor,
+		blobStore:  blobStore,
+		chunkStore: chunkStore,
+		exporter:   exporter,
+		logger:     logger,
+		retention:  retention,
+		stop:       make(chan struct{}),
+	}
+}
+
+func (tp *TrashPurger) Run(ctx context.Context) (*TrashReport, error) {
+	report := &TrashReport{}
+	cutoff := time.Now().Add(-tp.retention)
+	var err error
+	report.Posts, err = tp.postStore.PurgePostsDeletedBefore(ctx, cutoff)
+	if err != nil {
+		return report, err
+	}
+	users, err := tp.userStore.GetUsersDeletedBefore(ctx, cutoff)
+	if err != nil {
+		return report, err
+	}
+	for _, user := range users {
+		err = tp.purgeUser(ctx, user.ID)
+		if err != nil {
+			return report, err
+		}
+		report.Users++
+	}
+	return report, nil
+}
+
+// purgeUser drops the account's rows in one transaction and its files after
+// the commit, a failure there leaves orphaned files but no rows pointing at
+// missing ones.
+func (tp *TrashPurger) purgeUser(ctx context.Context, userId uuid.UUID) error {
+	// exports are self contained archives, they go first so a failure
+	// leaves the account in the trash to be retried
+	err := tp.exporter.DeleteForUser(ctx, userId)
+	if err != nil {
+		return err
+	}
+	var orphanedKeys []string
+	var uploads []store.Upload
+	err = tp.transactor.WithinTransaction(ctx, func(stores store.Stores) error {
+		err := stores.Tokens.DeleteAllTokenForUser(ctx, userId)
+		if err != nil {
+			return err
+		}
+		err = stores.Posts.PurgePostsForUser(ctx, userId)
+		if err != nil {
+			return err
+		}
+		images, err := stores.Images.GetImagesForUser(ctx, userId)
+		if err != nil {
+			return err
+		}
+		for _, image := range images {
+			lastReference, err := stores.Images.DeleteImage(ctx, image.ID)
+			if err != nil {
+				return err
+			}
+			if lastReference {
+				orphanedKeys = append(orphanedKeys, image.Key)
+			}
+		}
+		uploads, err = stores.Uploads.GetUploadsForUser(ctx, userId)
+		if err != nil {
+			return err
+		}
+		for _, upload := range uploads {
+			err = stores.Uploads.DeleteUpload(ctx, upload.ID)
+			if err != nil {
+				return err
+			}
+		}
+		return stores.Users.PurgeUser(ctx, userId)
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range orphanedKeys {
+		err = media.DeleteBlobWithVariants(tp.blobStore, key)
+		if err != nil {
+			tp.logger.Error("trashPurgerDeleteBlob", "key", key, "error", err)
+		}
+	}
+	for _, upload := range uploads {
+		err = media.DeleteUploadChunks(tp.chunkStore, &upload)
+		if err != nil {
+			tp.logger.Error("trashPurgerDeleteChunks", "upload_id", upload.ID, "error", err)
+		}
+	}
+	return nil
+}
+
+// Start purges every interval until Stop, which also cancels a pass in
+// progress.
+func (tp *TrashPurger) Start(interval time.Duration) {
+	worker.Every(interval, tp.stop, &tp.wg, tp.purge)
+}
+
+func (tp *TrashPurger) purge(ctx context.Context) {
+	report, err := tp.Run(ctx)
+	if err != nil {
+		tp.logger.Error("trashPurger", "error", err)
+	}
+	if report != nil && (report.Posts > 0 || report.Users > 0) {
+		tp.logger.Info("trash purged", "posts", report.Posts, "users", report.Users)
+	}
+}
+
+func (tp *TrashPurger) Stop() {
+	close(tp.stop)
+	tp.wg.Wait()
+}
@@ -0,0 +1,415 @@
+package routes
+
+import (
+	"net/http"
+	"strconv"
+	"todoapp/internal/api"
+	"todoapp/internal/health"
+	"todoapp/internal/importer"
+	"todoapp/internal/middleware"
+	"todoapp/internal/openapi"
+	"todoapp/internal/store"
+)
+
+// sessionAuth is the security requirement of routes behind Authenticate:
+// either the session cookie set by /login together with the csrf token
+// echoed in a header, or the session token as a bearer token.
+var sessionAuth = []map[string][]string{{"sessionCookie": {}, "csrfHeader": {}}, {"bearerToken": {}}}
+
+func jsonBody(schema *openapi.Schema) *openapi.RequestBody {
+	return &openapi.RequestBody{
+		Required: true,
+		Content: map[string]openapi.MediaType{
+			"application/json":                  {Schema: schema},
+			"application/x-www-form-urlencoded": {Schema: schema},
+		},
+	}
+}
+
+func jsonResponse(description string, schema *openapi.Schema) openapi.Response {
+	return openapi.Response{
+		Description: description,
+		Content:     map[string]openapi.MediaType{"application/json": {Schema: schema}},
+	}
+}
+
+func headerParam(name string, description string, required bool, schema *openapi.Schema) openapi.Parameter {
+	return openapi.Parameter{Name: name, In: "header", Description: description, Required: required, Schema: schema}
+}
+
+func withHeaders(response openapi.Response, headers map[string]openapi.Header) openapi.Response {
+	response.Headers = headers
+	return response
+}
+
+// responses builds the response map of an operation, adding a problem
+// response for each of the error statuses.
+func responses(problem *openapi.Schema, ok map[string]openapi.Response, errorStatuses ...int) map[string]openapi.Response {
+	for _, status := range errorStatuses {
+		description := http.StatusText(status)
+		if description == "" {
+			description = "Checksum Mismatch"
+		}
+		ok[strconv.Itoa(status)] = openapi.Response{
+			Description: description,
+			Content:     map[string]openapi.MediaType{"application/problem+json": {Schema: problem}},
+		}
+	}
+	return ok
+}
+
+func newOpenAPI() *openapi.Document {
+	doc := openapi.New(openapi.Info{
+		Title:   "todoapp",
+		Version: "1.0.0",
+		Description: "Errors are returned as application/problem+json (RFC 7807) with a stable `code`. " +
+			"Authenticated routes take the session_token cookie set by /login, state changing requests made with it also need the csrf_token cookie value in the X-CSRF-Token header or fail with 403. " +
+			"Clients that log in with issue_token send the returned token as a bearer token instead and need no csrf header. " +
+			"Cookie names carry the configured prefix, e.g. __Host-session_token. " +
+			"Any route reading the database may fail with 503 and code `timeout` when a query exceeds the configured query timeout.",
+	})
+	doc.Components.SecuritySchemes["sessionCookie"] = openapi.SecurityScheme{
+		Type:        "apiKey",
+		In:          "cookie",
+		Name:        "session_token",
+		Description: "HttpOnly session cookie set by /login.",
+	}
+	doc.Components.SecuritySchemes["bearerToken"] = openapi.SecurityScheme{
+		Type:        "http",
+		Scheme:      "bearer",
+		Description: "Session token returned by /login with issue_token.",
+	}
+	doc.Components.SecuritySchemes["csrfHeader"] = openapi.SecurityScheme{
+		Type:        "apiKey",
+		In:          "header",
+		Name:        "X-CSRF-Token",
+		Description: "Value of the csrf_token cookie set by /login, required on POST, PUT, PATCH and DELETE with cookie authentication.",
+	}
+
+	problem := doc.Schema("Problem", middleware.Problem{})
+	user := doc.Schema("User", api.UserResponse{})
+	post := doc.Schema("Post", store.Post{})
+	postID := openapi.Parameter{Name: "id", In: "path", Required: true, Schema: &openapi.Schema{Type: "string", Format: "uuid"}}
+	uploadImage := doc.Schema("UploadImageResponse", api.UploadImageResponse{})
+	healthReport := doc.Schema("HealthReport", health.Report{})
+	text := map[string]openapi.MediaType{"text/plain": {Schema: &openapi.Schema{Type: "string"}}}
+	tusResumable := headerParam("Tus-Resumable", "Protocol version, 1.0.0.", false, &openapi.Schema{Type: "string"})
+	postValidators := map[string]openapi.Header{
+		"ETag":          {Description: "Strong validator of the post version.", Schema: &openapi.Schema{Type: "string"}},
+		"Last-Modified": {Description: "When the post was last updated.", Schema: &openapi.Schema{Type: "string"}},
+	}
+	uploadHeaders := map[string]openapi.Header{
+		"Tus-Resumable":  {Schema: &openapi.Schema{Type: "string"}},
+		"Upload-Offset":  {Description: "Bytes received so far.", Schema: &openapi.Schema{Type: "integer", Format: "int64"}},
+		"Upload-Length":  {Description: "Total size of the upload.", Schema: &openapi.Schema{Type: "integer", Format: "int64"}},
+		"Upload-Expires": {Description: "When unfinished chunks are discarded.", Schema: &openapi.Schema{Type: "string"}},
+	}
+
+	doc.Add("GET", "/status", &openapi.Operation{
+		Summary:   "Simple status message",
+		Tags:      []string{"operations"},
+		Responses: map[string]openapi.Response{"200": {Description: "Server is up", Content: text}},
+	})
+	doc.Add("GET", "/healthz", &openapi.Operation{
+		Summary:   "Liveness probe",
+		Tags:      []string{"operations"},
+		Responses: map[string]openapi.Response{"200": {Description: "Process is alive"}},
+	})
+	doc.Add("GET", "/readyz", &openapi.Operation{
+		Summary: "Readiness probe, checks the database, migrations and blob storage",
+		Tags:    []string{"operations"},
+		Responses: map[string]openapi.Response{
+			"200": jsonResponse("Ready to serve traffic", healthReport),
+			"503": jsonResponse("A dependency is failing or the server is draining", healthReport),
+		},
+	})
+	doc.Add("GET", "/metrics", &openapi.Operation{
+		Summary:   "Prometheus metrics",
+		Tags:      []string{"operations"},
+		Responses: map[string]openapi.Response{"200": {Description: "Metrics in the Prometheus text format", Content: text}},
+	})
+	doc.Add("GET", "/openapi.json", &openapi.Operation{
+		Summary:   "This document",
+		Tags:      []string{"operations"},
+		Responses: map[string]openapi.Response{"200": jsonResponse("OpenAPI document", &openapi.Schema{Type: "object"})},
+	})
+	doc.Add("GET", "/docs", &openapi.Operation{
+		Summary:   "Swagger UI for this document",
+		Tags:      []string{"operations"},
+		Responses: map[string]openapi.Response{"200": {Description: "HTML page"}},
+	})
+
+	doc.Add("POST", "/csp-report", &openapi.Operation{
+		Summary: "Collect content security policy violation reports",
+		Tags:    []string{"operations"},
+		RequestBody: &openapi.RequestBody{
+			Required: true,
+			Content: map[string]openapi.MediaType{
+				"application/csp-report":   {Schema: &openapi.Schema{Type: "object"}},
+				"application/reports+json": {Schema: &openapi.Schema{Type: "array", Items: &openapi.Schema{Type: "object"}}},
+			},
+		},
+		Responses: responses(problem, map[string]openapi.Response{"204": {Description: "Report recorded"}}, 400, 415, 429),
+	})
+
+	doc.Add("POST", "/register", &openapi.Operation{
+		Summary:     "Create an account and log in to it",
+		Tags:        []string{"users"},
+		RequestBody: jsonBody(doc.Schema("RegisterUserRequest", api.RegisterUserRequest{})),
+		Responses: responses(problem, map[string]openapi.Response{"201": {
+			Description: "User created",
+			Headers: map[string]openapi.Header{"Set-Cookie": {
+				Description: "session_token (HttpOnly) and csrf_token cookies.",
+				Schema:      &openapi.Schema{Type: "string"},
+			}},
+			Content: map[string]openapi.MediaType{"application/json": {Schema: user}},
+		}}, 400, 429),
+	})
+	loginResponse := doc.Schema("LoginResponse", api.LoginResponse{})
+	doc.Add("POST", "/login", &openapi.Operation{
+		Summary:     "Log in and receive the session and csrf cookies",
+		Tags:        []string{"users"},
+		RequestBody: jsonBody(doc.Schema("LoginRequest", api.LoginRequest{})),
+		Responses: responses(problem, map[string]openapi.Response{"200": {
+			Description: "Logged in",
+			Headers: map[string]openapi.Header{"Set-Cookie": {
+				Description: "session_token (HttpOnly) and csrf_token cookies.",
+				Schema:      &openapi.Schema{Type: "string"},
+			}},
+			Content: map[string]openapi.MediaType{"application/json": {Schema: loginResponse}},
+		}}, 400, 401, 429),
+	})
+	doc.Add("POST", "/user/restore", &openapi.Operation{
+		Summary:     "Restore a deleted account and log in",
+		Description: "Works until the account is purged after the trash retention period. Posts deleted with the account stay in the trash.",
+		Tags:        []string{"users"},
+		RequestBody: jsonBody(doc.Schema("LoginRequest", api.LoginRequest{})),
+		Responses: responses(problem, map[string]openapi.Response{"200": {
+			Description: "Restored and logged in",
+			Headers: map[string]openapi.Header{"Set-Cookie": {
+				Description: "session_token (HttpOnly) and csrf_token cookies.",
+				Schema:      &openapi.Schema{Type: "string"},
+			}},
+			Content: map[string]openapi.MediaType{"application/json": {Schema: loginResponse}},
+		}}, 400, 401, 404, 429),
+	})
+	doc.Add("POST", "/logout", &openapi.Operation{
+		Summary:     "Log out of every session and clear the cookies",
+		Description: "Succeeds without a session as well.",
+		Tags:        []string{"users"},
+		Security:    sessionAuth,
+		Responses:   responses(problem, map[string]openapi.Response{"204": {Description: "Logged out"}}, 403),
+	})
+	doc.Add("GET", "/user", &openapi.Operation{
+		Summary:   "The logged in user",
+		Tags:      []string{"users"},
+		Security:  sessionAuth,
+		Responses: responses(problem, map[string]openapi.Response{"200": jsonResponse("Current user", user)}, 401),
+	})
+	doc.Add("DELETE", "/user", &openapi.Operation{
+		Summary:     "Delete the account",
+		Description: "Moves the user and their posts to the trash and ends all sessions, unfinished uploads are dropped. The account, its posts and images are purged after the trash retention period.",
+		Tags:        []string{"users"},
+		Security:    sessionAuth,
+		Responses:   responses(problem, map[string]openapi.Response{"204": {Description: "Account deleted"}}, 401, 403),
+	})
+	doc.Add("GET", "/protected", &openapi.Operation{
+		Summary:  "Check the session is valid",
+		Tags:     []string{"users"},
+		Security: sessionAuth,
+		Responses: responses(problem, map[string]openapi.Response{"200": jsonResponse("Session is valid", &openapi.Schema{
+			Type:       "object",
+			Properties: map[string]*openapi.Schema{"message": {Type: "string"}},
+		})}, 401),
+	})
+
+	doc.Add("GET", "/posts", &openapi.Operation{
+		Summary:   "List posts, without their content",
+		Tags:      []string{"posts"},
+		Responses: responses(problem, map[string]openapi.Response{"200": jsonResponse("Posts", &openapi.Schema{Type: "array", Items: post})}),
+	})
+	doc.Add("GET", "/post/:id", &openapi.Operation{
+		Summary:     "Get a post",
+		Description: "Responses carry an ETag and Last-Modified, a request whose If-None-Match or If-Modified-Since still matches gets 304 without a body.",
+		Tags:        []string{"posts"},
+		Parameters: []openapi.Parameter{
+			postID,
+			headerParam("If-None-Match", "ETags of the copies the client has.", false, &openapi.Schema{Type: "string"}),
+			headerParam("If-Modified-Since", "Last-Modified of the client's copy.", false, &openapi.Schema{Type: "string"}),
+		},
+		Responses: responses(problem, map[string]openapi.Response{
+			"200": withHeaders(jsonResponse("Post", post), postValidators),
+			"304": {Description: "The client's copy is current", Headers: postValidators},
+		}, 404),
+	})
+	doc.Add("POST", "/posts/new", &openapi.Operation{
+		Summary:     "Create a post",
+		Tags:        []string{"posts"},
+		Security:    sessionAuth,
+		RequestBody: jsonBody(doc.Schema("CreatePostRequest", api.CreatePostRequest{})),
+		Responses:   responses(problem, map[string]openapi.Response{"201": withHeaders(jsonResponse("Post created", post), postValidators)}, 400, 401, 403, 429),
+	})
+	doc.Add("POST", "/posts/import", &openapi.Operation{
+		Summary: "Import posts from Markdown files or a WordPress export",
+		Description: "Takes a zip of Markdown files with YAML front matter (title, date, updated or lastmod, tags, slug, draft) or a WordPress WXR file, bare or zipped together with its uploads folder. " +
+			"Embedded images found in the zip are uploaded and the references rewritten, remote ones only when the server fetches images. " +
+			"Drafts, private posts and posts whose slug you already have are skipped, so an import can be repeated. " +
+			"Every item is listed in the report, a failing item does not stop the others.",
+		Tags:     []string{"posts"},
+		Security: sessionAuth,
+		RequestBody: &openapi.RequestBody{
+			Required: true,
+			Content: map[string]openapi.MediaType{"multipart/form-data": {Schema: &openapi.Schema{
+				Type:       "object",
+				Properties: map[string]*openapi.Schema{"file": {Type: "string", Format: "binary"}},
+				Required:   []string{"file"},
+			}}},
+		},
+		Responses: responses(problem, map[string]openapi.Response{"200": jsonResponse("What happened to each item", doc.Schema("ImportReport", importer.Report{}))}, 400, 401, 403, 413, 429),
+	})
+	doc.Add("PUT", "/post/:id", &openapi.Operation{
+		Summary:     "Update one of your posts",
+		Description: "If-Match must carry the ETag of the version the edit is based on, 412 means someone else changed the post in the meantime.",
+		Tags:        []string{"posts"},
+		Security:    sessionAuth,
+		Parameters: []openapi.Parameter{
+			postID,
+			headerParam("If-Match", "ETag of the post as last read.", true, &openapi.Schema{Type: "string"}),
+		},
+		RequestBody: jsonBody(doc.Schema("UpdatePostRequest", api.UpdatePostRequest{})),
+		Responses:   responses(problem, map[string]openapi.Response{"200": withHeaders(jsonResponse("Post updated", post), postValidators)}, 400, 401, 403, 404, 412, 428, 429),
+	})
+	doc.Add("DELETE", "/post/:id", &openapi.Operation{
+		Summary:     "Move one of your posts to the trash",
+		Description: "The post can be restored from the trash until the retention period ends.",
+		Tags:        []string{"posts"},
+		Security:    sessionAuth,
+		Parameters:  []openapi.Parameter{postID},
+		Responses:   responses(problem, map[string]openapi.Response{"204": {Description: "Post deleted"}}, 401, 403, 404, 429),
+	})
+	doc.Add("GET", "/trash", &openapi.Operation{
+		Summary:  "List your deleted posts",
+		Tags:     []string{"posts"},
+		Security: sessionAuth,
+		Responses: responses(problem, map[string]openapi.Response{"200": jsonResponse("Deleted posts, most recent first", &openapi.Schema{
+			Type:  "array",
+			Items: doc.Schema("TrashedPost", api.TrashedPost{}),
+		})}, 401),
+	})
+	doc.Add("POST", "/trash/posts/:id/restore", &openapi.Operation{
+		Summary:    "Restore a deleted post",
+		Tags:       []string{"posts"},
+		Security:   sessionAuth,
+		Parameters: []openapi.Parameter{postID},
+		Responses:  responses(problem, map[string]openapi.Response{"200": withHeaders(jsonResponse("Post restored", post), postValidators)}, 401, 403, 404, 429),
+	})
+
+	doc.Add("POST", "/posts/image/upload", &openapi.Operation{
+		Summary:     "Upload an image or video in one request",
+		Description: "Images get resized variants and a thumbnail generated in the background.",
+		Tags:        []string{"media"},
+		Security:    sessionAuth,
+		RequestBody: &openapi.RequestBody{
+			Required: true,
+			Content: map[string]openapi.MediaType{"multipart/form-data": {Schema: &openapi.Schema{
+				Type:       "object",
+				Properties: map[string]*openapi.Schema{"file": {Type: "string", Format: "binary"}},
+				Required:   []string{"file"},
+			}}},
+		},
+		Responses: responses(problem, map[string]openapi.Response{"200": jsonResponse("Stored", uploadImage)}, 400, 401, 403, 413, 429),
+	})
+	doc.Add("GET", "/static/images/:key", &openapi.Operation{
+		Summary: "Download an uploaded file or one of its variants",
+		Tags:    []string{"media"},
+		Responses: responses(problem, map[string]openapi.Response{
+			"200": {Description: "File contents"},
+			"307": {Description: "Redirect to a presigned storage url"},
+		}, 404),
+	})
+
+	doc.Add("POST", "/uploads", &openapi.Operation{
+		Summary: "Start a resumable upload (tus creation)",
+		Tags:    []string{"uploads"},
+		Parameters: []openapi.Parameter{
+			tusResumable,
+			headerParam("Upload-Length", "Total size in bytes.", true, &openapi.Schema{Type: "integer", Format: "int64"}),
+			headerParam("Upload-Metadata", "tus metadata, stored as is.", false, &openapi.Schema{Type: "string"}),
+		},
+		Security: sessionAuth,
+		Responses: responses(problem, map[string]openapi.Response{"201": {
+			Description: "Upload created, Location points at it",
+			Headers:     map[string]openapi.Header{"Location": {Schema: &openapi.Schema{Type: "string"}}},
+		}}, 400, 401, 403, 413, 429),
+	})
+	doc.Add("HEAD", "/uploads/:id", &openapi.Operation{
+		Summary:    "Current offset of a resumable upload",
+		Tags:       []string{"uploads"},
+		Parameters: []openapi.Parameter{tusResumable},
+		Security:   sessionAuth,
+		Responses:  responses(problem, map[string]openapi.Response{"200": {Description: "Upload state", Headers: uploadHeaders}}, 401, 404, 410, 429),
+	})
+	doc.Add("PATCH", "/uploads/:id", &openapi.Operation{
+		Summary: "Append a chunk at the current offset",
+		Tags:    []string{"uploads"},
+		Parameters: []openapi.Parameter{
+			tusResumable,
+			headerParam("Upload-Offset", "Must match the current offset.", true, &openapi.Schema{Type: "integer", Format: "int64"}),
+			headerParam("Upload-Checksum", "sha256 followed by the base64 digest of the chunk.", false, &openapi.Schema{Type: "string"}),
+		},
+		Security: sessionAuth,
+		RequestBody: &openapi.RequestBody{
+			Required: true,
+			Content:  map[string]openapi.MediaType{"application/offset+octet-stream": {Schema: &openapi.Schema{Type: "string", Format: "binary"}}},
+		},
+		Responses: responses(problem, map[string]openapi.Response{"204": {Description: "Chunk stored", Headers: uploadHeaders}}, 400, 401, 403, 404, 409, 410, 413, 415, 429, 460),
+	})
+	doc.Add("DELETE", "/uploads/:id", &openapi.Operation{
+		Summary:    "Abort a resumable upload",
+		Tags:       []string{"uploads"},
+		Parameters: []openapi.Parameter{tusResumable},
+		Security:   sessionAuth,
+		Responses:  responses(problem, map[string]openapi.Response{"204": {Description: "Upload removed"}}, 401, 403, 404, 410, 429),
+	})
+	doc.Add("POST", "/uploads/:id/finalize", &openapi.Operation{
+		Summary:   "Store a completed resumable upload",
+		Tags:      []string{"uploads"},
+		Security:  sessionAuth,
+		Responses: responses(problem, map[string]openapi.Response{"200": jsonResponse("Stored", uploadImage)}, 400, 401, 403, 404, 409, 410, 413, 429),
+	})
+
+	exportResponse := doc.Schema("Export", api.ExportResponse{})
+	doc.Add("POST", "/user/exports", &openapi.Operation{
+		Summary: "Request an archive of your account data",
+		Description: "The zip holds the profile, posts as JSON and as Markdown with front matter, deleted posts, images and open sessions, with a manifest.json describing the files. " +
+			"It is built in the background, poll the export or wait for the notification, and is deleted once it expires.",
+		Tags:     []string{"users"},
+		Security: sessionAuth,
+		Responses: responses(problem, map[string]openapi.Response{"202": withHeaders(jsonResponse("Export queued", exportResponse), map[string]openapi.Header{
+			"Location": {Description: "Where to poll the export.", Schema: &openapi.Schema{Type: "string"}},
+		})}, 401, 403, 429, 503),
+	})
+	doc.Add("GET", "/user/exports/:id", &openapi.Operation{
+		Summary:     "Status of one of your exports",
+		Description: "Once ready it carries a signed download_url, valid for a limited time.",
+		Tags:        []string{"users"},
+		Security:    sessionAuth,
+		Parameters:  []openapi.Parameter{postID},
+		Responses:   responses(problem, map[string]openapi.Response{"200": jsonResponse("Export", exportResponse)}, 401, 404),
+	})
+	doc.Add("GET", "/exports/:id/download", &openapi.Operation{
+		Summary:     "Download an export archive through a signed link",
+		Description: "Needs no session, the expires and signature parameters are the authorization.",
+		Tags:        []string{"users"},
+		Parameters: []openapi.Parameter{
+			postID,
+			{Name: "expires", In: "query", Required: true, Schema: &openapi.Schema{Type: "integer", Format: "int64"}},
+			{Name: "signature", In: "query", Required: true, Schema: &openapi.Schema{Type: "string"}},
+		},
+		Responses: responses(problem, map[string]openapi.Response{
+			"200": {Description: "The zip archive", Content: map[string]openapi.MediaType{"application/zip": {Schema: &openapi.Schema{Type: "string", Format: "binary"}}}},
+			"307": {Description: "Redirect to a presigned storage url"},
+		}, 403, 404),
+	})
+	return doc
+}
@@ -3,47 +3,119 @@ package routes
 import (
 	"net/http"
 	"os"
+	"strings"
 	"todoapp/internal/app"
+	"todoapp/internal/logging"
+	"todoapp/internal/metrics"
+	"todoapp/internal/middleware"
+	"todoapp/internal/openapi"
+	"todoapp/internal/ratelimit"
+	"todoapp/internal/tracing"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 )
 
 func SetupRoutes(app *app.Application) http.Handler {
-	r := gin.Default()
+	r := gin.New()
+	// ClientIP only believes X-Forwarded-For from these, rate limits by ip
+	// would be trivial to dodge otherwise
+	err := r.SetTrustedProxies(trustedProxies())
+	if err != nil {
+		panic(err)
+	}
+	r.Use(
+		otelgin.Middleware(tracing.ServiceName()),
+		logging.RequestLogger(app.Logger),
+		metrics.Middleware(),
+		gin.Recovery(),
+		middleware.ErrorHandler(),
+		middleware.SecurityHeaders(app.Security.API),
+	)
 	frontendURL := os.Getenv("FRONTEND_URL")
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{frontendURL}, // Add your frontend URL
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "PATCH"},
-		AllowHeaders:     []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "PATCH", "HEAD"},
+		AllowHeaders:     []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Checksum", "Upload-Metadata", "If-Match", "If-None-Match", "If-Modified-Since"},
+		ExposeHeaders:    []string{"Location", "ETag", "Last-Modified", "Tus-Resumable", "Upload-Offset", "Upload-Length", "Upload-Expires", "RateLimit-Policy", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After"},
 		AllowCredentials: true, // Enable cookies/auth
 	}))
+	if app.Replicas != nil {
+		r.Use(middleware.ReadYourWrites(app.Middleware.Cookies, app.ReadPrimaryFor))
+	}
+
+	r.NoRoute(func(c *gin.Context) {
+		middleware.Fail(c, middleware.NewProblem(http.StatusNotFound, "not_found", "route not found"))
+	})
 
 	r.GET("/status", func(c *gin.Context) {
 		c.String(http.StatusOK, "Hello World!")
 	})
+	r.GET("/healthz", app.Health.HandleLiveness)
+	r.GET("/readyz", app.Health.HandleReadiness)
+	r.GET("/metrics", gin.WrapH(metrics.Handler()))
+
+	spec := newOpenAPI()
+	r.GET("/openapi.json", spec.Handler())
+	r.GET("/docs", middleware.SecurityHeaders(app.Security.Docs), openapi.UIHandler("/openapi.json"))
+	r.POST("/csp-report", app.RateLimiter.Middleware("csp_reports", app.RateLimits.CSPReports, ratelimit.ByIP), middleware.HandleCSPReport)
 
 	r.MaxMultipartMemory = 8 << 20 // 8 MiB
-	r.Static("/static/images", "./files/static/images/")
+	r.GET("/static/images/:key", middleware.SecurityHeaders(app.Security.Static), app.PostHandler.HandleServeImage)
 
-	r.POST("/register", app.UserHandler.HandleRegister)
-	r.POST("/login", app.UserHandler.HandleLogin)
+	authLimit := app.RateLimiter.Middleware("auth", app.RateLimits.Auth, ratelimit.ByIP)
+	postsLimit := app.RateLimiter.Middleware("posts", app.RateLimits.Posts, ratelimit.ByToken)
+	uploadsLimit := app.RateLimiter.Middleware("uploads", app.RateLimits.Uploads, ratelimit.ByToken)
+	exportsLimit := app.RateLimiter.Middleware("exports", app.RateLimits.Exports, ratelimit.ByToken)
+	importsLimit := app.RateLimiter.Middleware("imports", app.RateLimits.Imports, ratelimit.ByToken)
+
+	r.POST("/register", authLimit, app.UserHandler.HandleRegister)
+	r.POST("/login", authLimit, app.UserHandler.HandleLogin)
+	r.POST("/user/restore", authLimit, app.UserHandler.HandleRestoreAccount)
 	{
 		auth := r.Group("/")
-		auth.Use(app.Middleware.Authenticate())
+		auth.Use(app.Middleware.Authenticate(), app.Middleware.RequireCSRF())
 		auth.POST("/logout", app.UserHandler.HandleLogout)
 		{
 			reqlogin := auth.Group("/")
 			reqlogin.Use(app.Middleware.RequreLogin())
 			reqlogin.GET("/user", app.UserHandler.HandleGetuser)
+			reqlogin.DELETE("/user", app.UserHandler.HandleDeleteAccount)
 			reqlogin.GET("/protected", app.UserHandler.HandleProtected)
+			reqlogin.POST("/user/exports", exportsLimit, app.ExportHandler.HandleCreateExport)
+			reqlogin.GET("/user/exports/:id", app.ExportHandler.HandleGetExport)
 
-			reqlogin.POST("/posts/image/upload", app.PostHandler.HandleUploadImage)
-			reqlogin.POST("/posts/new", app.PostHandler.HandleCreatePost)
+			reqlogin.POST("/posts/new", postsLimit, app.PostHandler.HandleCreatePost)
+			reqlogin.POST("/posts/import", importsLimit, app.ImportHandler.HandleImport)
+			reqlogin.PUT("/post/:id", postsLimit, app.PostHandler.HandleUpdatePost)
+			reqlogin.DELETE("/post/:id", postsLimit, app.PostHandler.HandleDeletePost)
+			reqlogin.GET("/trash", app.PostHandler.HandleGetTrash)
+			reqlogin.POST("/trash/posts/:id/restore", postsLimit, app.PostHandler.HandleRestorePost)
+			{
+				uploads := reqlogin.Group("/")
+				uploads.Use(uploadsLimit)
+				uploads.POST("/posts/image/upload", app.PostHandler.HandleUploadImage)
+				uploads.POST("/uploads", app.UploadHandler.HandleCreateUpload)
+				uploads.HEAD("/uploads/:id", app.UploadHandler.HandleGetUploadOffset)
+				uploads.PATCH("/uploads/:id", app.UploadHandler.HandlePatchUpload)
+				uploads.POST("/uploads/:id/finalize", app.UploadHandler.HandleFinalizeUpload)
+				uploads.DELETE("/uploads/:id", app.UploadHandler.HandleDeleteUpload)
+			}
 		}
 	}
 	r.GET("/posts", app.PostHandler.HandleGetAllPosts)
 	r.GET("/post/:id", app.PostHandler.HandleGetPostByID)
-	
+	r.GET("/exports/:id/download", app.ExportHandler.HandleDownloadExport)
 	return r
 }
+
+// trustedProxies reads TRUSTED_PROXIES, a comma separated list of proxy ips
+// or cidrs. None are trusted by default.
+func trustedProxies() []string {
+	value := os.Getenv("TRUSTED_PROXIES")
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
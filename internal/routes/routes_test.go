@@ -0,0 +1,264 @@
+package routes
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"todoapp/internal/app"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTestEngine sets up the routes of an application on the memory store,
+// env overrides the configuration read from the environment.
+func newTestEngine(t *testing.T, env map[string]string) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	t.Setenv("BLOB_BACKEND", "local")
+	t.Setenv("BLOB_LOCAL_DIR", t.TempDir())
+	t.Setenv("BLOB_PRIVATE_DIR", t.TempDir())
+	t.Setenv("FRONTEND_URL", "http://localhost:3000")
+	t.Setenv("RATE_LIMIT_POSTS", "off")
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	application, err := app.NewApplication(app.Options{Store: "memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(application.Close)
+	return SetupRoutes(application).(*gin.Engine)
+}
+
+// serve runs one request through the engine, headers are name, value pairs.
+func serve(engine *gin.Engine, method string, path string, body string, headers ...string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	request := httptest.NewRequest(method, path, reader)
+	if body != "" {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		request.Header.Add(headers[i], headers[i+1])
+	}
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// session is a signed in user, either through cookies or a bearer token.
+type session struct {
+	cookies []*http.Cookie
+	csrf    string
+	bearer  string
+}
+
+// headers returns the headers authenticating a request of the session, csrf
+// adds the X-CSRF-Token header cookie sessions need for unsafe methods.
+func (s session) headers(csrf bool) []string {
+	if s.bearer != "" {
+		return []string{"Authorization", "Bearer " + s.bearer}
+	}
+	headers := []string{}
+	for _, cookie := range s.cookies {
+		headers = append(headers, "Cookie", cookie.Name+"="+cookie.Value)
+	}
+	if csrf {
+		headers = append(headers, "X-CSRF-Token", s.csrf)
+	}
+	return headers
+}
+
+// register signs up username, returning the cookie session it starts.
+func register(t *testing.T, engine *gin.Engine, username string) session {
+	t.Helper()
+	body := `{"username": "` + username + `", "email": "` + username + `@example.com", "password": "correct horse"}`
+	recorder := serve(engine, http.MethodPost, "/register", body)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("register %v = %v %v", username, recorder.Code, recorder.Body)
+	}
+	s := session{cookies: recorder.Result().Cookies()}
+	for _, cookie := range s.cookies {
+		if strings.HasSuffix(cookie.Name, "csrf_token") {
+			s.csrf = cookie.Value
+		}
+	}
+	return s
+}
+
+// login signs in username with a bearer token.
+func login(t *testing.T, engine *gin.Engine, username string) session {
+	t.Helper()
+	body := `{"username": "` + username + `", "password": "correct horse", "issue_token": true}`
+	recorder := serve(engine, http.MethodPost, "/login", body)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("login %v = %v %v", username, recorder.Code, recorder.Body)
+	}
+	response := struct {
+		Token string `json:"token"`
+	}{}
+	err := json.Unmarshal(recorder.Body.Bytes(), &response)
+	if err != nil || response.Token == "" {
+		t.Fatalf("login %v returned no token: %v %v", username, recorder.Body, err)
+	}
+	return session{bearer: response.Token}
+}
+
+// TestRoutesDocumented keeps the spec honest, a route without documentation
+// is a bug.
+func TestRoutesDocumented(t *testing.T) {
+	engine := newTestEngine(t, nil)
+	for _, route := range newOpenAPI().Missing(engine.Routes()) {
+		t.Errorf("%v is missing from the openapi spec", route)
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	engine := newTestEngine(t, nil)
+	cookie := register(t, engine, "csrfuser")
+	bearer := login(t, engine, "csrfuser")
+	post := `{"title": "Hello", "content": "World"}`
+	tests := []struct {
+		name    string
+		headers []string
+		status  int
+	}{
+		{"missing header", cookie.headers(false), http.StatusForbidden},
+		{"wrong header", append(cookie.headers(false), "X-CSRF-Token", "not-the-token"), http.StatusForbidden},
+		{"session token as header", append(cookie.headers(false), "X-CSRF-Token", cookie.cookies[0].Value), http.StatusForbidden},
+		{"valid header", cookie.headers(true), http.StatusCreated},
+		{"bearer", bearer.headers(false), http.StatusCreated},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := serve(engine, http.MethodPost, "/posts/new", post, test.headers...)
+			if recorder.Code != test.status {
+				t.Errorf("status = %v, want %v: %v", recorder.Code, test.status, recorder.Body)
+			}
+			if test.status == http.StatusForbidden && !strings.Contains(recorder.Body.String(), `"csrf_failed"`) {
+				t.Errorf("body = %v, want the csrf_failed problem", recorder.Body)
+			}
+		})
+	}
+	// safe methods need no csrf header
+	recorder := serve(engine, http.MethodGet, "/user", "", cookie.headers(false)...)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("GET /user without csrf header = %v, want 200", recorder.Code)
+	}
+}
+
+func TestSessionCookies(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        map[string]string
+		prefix     string
+		secure     bool
+		domain     string
+		sameSite   http.SameSite
+		wantConfig bool
+	}{
+		{"tls defaults", map[string]string{"DOMAIN": "example.com"}, "", true, "example.com", http.SameSiteLaxMode, true},
+		{"without tls", map[string]string{"COOKIE_SECURE": "false"}, "", false, "", http.SameSiteLaxMode, true},
+		{"host prefix", map[string]string{"COOKIE_PREFIX": "__Host-", "DOMAIN": "example.com"}, "__Host-", true, "", http.SameSiteLaxMode, true},
+		{"secure prefix", map[string]string{"COOKIE_PREFIX": "__Secure-", "COOKIE_DOMAIN": "example.com", "COOKIE_SAMESITE": "strict"}, "__Secure-", true, "example.com", http.SameSiteStrictMode, true},
+		{"host prefix without tls", map[string]string{"COOKIE_PREFIX": "__Host-", "COOKIE_SECURE": "false"}, "", false, "", 0, false},
+		{"host prefix with domain", map[string]string{"COOKIE_PREFIX": "__Host-", "COOKIE_DOMAIN": "example.com"}, "", false, "", 0, false},
+		{"secure prefix without tls", map[string]string{"COOKIE_PREFIX": "__Secure-", "COOKIE_SECURE": "false"}, "", false, "", 0, false},
+		{"samesite none without tls", map[string]string{"COOKIE_SAMESITE": "none", "COOKIE_SECURE": "false"}, "", false, "", 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if !test.wantConfig {
+				t.Setenv("BLOB_BACKEND", "local")
+				t.Setenv("BLOB_LOCAL_DIR", t.TempDir())
+				t.Setenv("BLOB_PRIVATE_DIR", t.TempDir())
+				t.Setenv("FRONTEND_URL", "http://localhost:3000")
+				for key, value := range test.env {
+					t.Setenv(key, value)
+				}
+				application, err := app.NewApplication(app.Options{Store: "memory"})
+				if err == nil {
+					application.Close()
+					t.Fatal("NewApplication accepted cookies browsers would drop")
+				}
+				if !strings.Contains(err.Error(), "cookies:") {
+					t.Errorf("NewApplication = %v, want a cookie configuration error", err)
+				}
+				return
+			}
+			engine := newTestEngine(t, test.env)
+			s := register(t, engine, "cookieuser")
+			cookies := map[string]*http.Cookie{}
+			for _, cookie := range s.cookies {
+				cookies[cookie.Name] = cookie
+			}
+			for name, httpOnly := range map[string]bool{"session_token": true, "csrf_token": false} {
+				cookie, ok := cookies[test.prefix+name]
+				if !ok {
+					t.Fatalf("no %v cookie in %v", test.prefix+name, s.cookies)
+				}
+				if cookie.Secure != test.secure || cookie.HttpOnly != httpOnly || cookie.Domain != test.domain || cookie.Path != "/" || cookie.SameSite != test.sameSite {
+					t.Errorf("%v = %+v, want secure %v, httponly %v, domain %q, path / and samesite %v", cookie.Name, cookie, test.secure, httpOnly, test.domain, test.sameSite)
+				}
+			}
+			// the prefixed cookies have to authenticate the following requests
+			recorder := serve(engine, http.MethodGet, "/user", "", s.headers(false)...)
+			if recorder.Code != http.StatusOK {
+				t.Errorf("GET /user = %v, want 200", recorder.Code)
+			}
+		})
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	engine := newTestEngine(t, nil)
+	register(t, engine, "etaguser")
+	auth := login(t, engine, "etaguser").headers(false)
+	recorder := serve(engine, http.MethodPost, "/posts/new", `{"title": "Hello", "content": "World"}`, auth...)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("create post = %v %v", recorder.Code, recorder.Body)
+	}
+	post := struct {
+		ID string `json:"id"`
+	}{}
+	json.Unmarshal(recorder.Body.Bytes(), &post)
+	path := "/post/" + post.ID
+
+	recorder = serve(engine, http.MethodGet, path, "")
+	etag, lastModified := recorder.Header().Get("ETag"), recorder.Header().Get("Last-Modified")
+	if recorder.Code != http.StatusOK || etag == "" || lastModified == "" {
+		t.Fatalf("GET %v = %v with ETag %q and Last-Modified %q", path, recorder.Code, etag, lastModified)
+	}
+	edit := `{"title": "Hello", "content": "Edited"}`
+	tests := []struct {
+		name    string
+		method  string
+		body    string
+		headers []string
+		status  int
+	}{
+		{"if-none-match", http.MethodGet, "", []string{"If-None-Match", etag}, http.StatusNotModified},
+		{"weak if-none-match", http.MethodGet, "", []string{"If-None-Match", "W/" + etag}, http.StatusNotModified},
+		{"if-none-match other", http.MethodGet, "", []string{"If-None-Match", `"other"`}, http.StatusOK},
+		{"if-modified-since", http.MethodGet, "", []string{"If-Modified-Since", lastModified}, http.StatusNotModified},
+		{"missing if-match", http.MethodPut, edit, auth, http.StatusPreconditionRequired},
+		{"current if-match", http.MethodPut, edit, append([]string{"If-Match", etag}, auth...), http.StatusOK},
+		// the edit above changed the post, its old ETag is stale now
+		{"stale if-match", http.MethodPut, edit, append([]string{"If-Match", etag}, auth...), http.StatusPreconditionFailed},
+		{"stale if-none-match", http.MethodGet, "", []string{"If-None-Match", etag}, http.StatusOK},
+	}
+	for _, test := range tests {
+		recorder := serve(engine, test.method, path, test.body, test.headers...)
+		if recorder.Code != test.status {
+			t.Errorf("%v: status = %v, want %v: %v", test.name, recorder.Code, test.status, recorder.Body)
+		}
+		if test.status == http.StatusNotModified && recorder.Body.Len() != 0 {
+			t.Errorf("%v: 304 with a body %q", test.name, recorder.Body)
+		}
+	}
+}
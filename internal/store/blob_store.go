@@ -0,0 +1,280 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"todoapp/internal/tracing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+var ErrBlobNotFound = errors.New("blob not found")
+
+// ErrPresignUnsupported is returned by backends that cannot hand out direct
+// download links, in which case the caller has to stream the blob itself.
+var ErrPresignUnsupported = errors.New("presigned urls not supported")
+
+type BlobInfo struct {
+	Key         string
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+}
+
+// MaxPresignExpiry is the longest expiry S3 accepts for a presigned url.
+const MaxPresignExpiry = 7 * 24 * time.Hour
+
+type BlobStore interface {
+	Put(key string, r io.Reader, size int64, contentType string) error
+	Get(key string) (io.ReadSeekCloser, *BlobInfo, error)
+	Delete(key string) error
+	PresignedURL(key string, expiry time.Duration) (string, error)
+	// Ping checks the storage is reachable without writing to it.
+	Ping(ctx context.Context) error
+}
+
+// OpenBlobStore picks the backend from BLOB_BACKEND ("local" or "s3"). Every
+// key in it may be served by GET /static/images/:key.
+func OpenBlobStore() (BlobStore, error) {
+	return openBlobStore("BLOB_LOCAL_DIR", "./files/static/images/", "")
+}
+
+// OpenPrivateBlobStore opens the store for files that are never served by
+// key, such as the chunks of unfinished uploads and account exports. It uses
+// the same backend as OpenBlobStore, in BLOB_PRIVATE_DIR or under the
+// private/ prefix of the bucket.
+func OpenPrivateBlobStore() (BlobStore, error) {
+	return openBlobStore("BLOB_PRIVATE_DIR", "./files/private/", "private/")
+}
+
+func openBlobStore(dirEnv string, defaultDir string, prefix string) (BlobStore, error) {
+	switch backend := os.Getenv("BLOB_BACKEND"); backend {
+	case "", "local":
+		dir := os.Getenv(dirEnv)
+		if dir == "" {
+			dir = defaultDir
+		}
+		return NewLocalBlobStore(dir)
+	case "s3":
+		return NewS3BlobStore(S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			UseSSL:    os.Getenv("S3_USE_SSL") == "true",
+			Prefix:    prefix,
+		})
+	default:
+		return nil, fmt.Errorf("blob: unknown backend %q", backend)
+	}
+}
+
+type LocalBlobStore struct {
+	dir string
+}
+
+func NewLocalBlobStore(dir string) (*LocalBlobStore, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("blob: create dir with %w", err)
+	}
+	return &LocalBlobStore{
+		dir: dir,
+	}, nil
+}
+
+func (ls *LocalBlobStore) Dir() string {
+	return ls.dir
+}
+
+func (ls *LocalBlobStore) Ping(context.Context) error {
+	info, err := os.Stat(ls.dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("blob: %v is not a directory", ls.dir)
+	}
+	return nil
+}
+
+func (ls *LocalBlobStore) path(key string) (string, error) {
+	if key == "" || strings.ContainsAny(key, `/\`) || key == "." || key == ".." {
+		return "", ErrBlobNotFound
+	}
+	return filepath.Join(ls.dir, key), nil
+}
+
+func (ls *LocalBlobStore) Put(key string, r io.Reader, size int64, contentType string) error {
+	path, err := ls.path(key)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first so readers never see a partial blob
+	tmp, err := os.CreateTemp(ls.dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (ls *LocalBlobStore) Get(key string) (io.ReadSeekCloser, *BlobInfo, error) {
+	path, err := ls.path(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil, ErrBlobNotFound
+		}
+		return nil, nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, &BlobInfo{
+		Key:     key,
+		Size:    stat.Size(),
+		ModTime: stat.ModTime(),
+	}, nil
+}
+
+func (ls *LocalBlobStore) Delete(key string) error {
+	path, err := ls.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (ls *LocalBlobStore) PresignedURL(key string, expiry time.Duration) (string, error) {
+	return "", ErrPresignUnsupported
+}
+
+type S3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+	// Prefix is put in front of every key, so several stores can share a
+	// bucket.
+	Prefix string
+}
+
+// S3BlobStore works against AWS S3 and any S3-compatible server such as MinIO.
+type S3BlobStore struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func NewS3BlobStore(cfg S3Config) (*S3BlobStore, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("blob: S3_ENDPOINT and S3_BUCKET are required")
+	}
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:     credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure:    cfg.UseSSL,
+		Region:    cfg.Region,
+		Transport: tracing.Transport(nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("blob: s3 client with %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("blob: s3 bucket check with %w", err)
+	}
+	if !exists {
+		err = client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{Region: cfg.Region})
+		if err != nil {
+			return nil, fmt.Errorf("blob: s3 make bucket with %w", err)
+		}
+	}
+	return &S3BlobStore{
+		client: client,
+		bucket: cfg.Bucket,
+		prefix: cfg.Prefix,
+	}, nil
+}
+
+func (s3 *S3BlobStore) Ping(ctx context.Context) error {
+	exists, err := s3.client.BucketExists(ctx, s3.bucket)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("blob: bucket %v does not exist", s3.bucket)
+	}
+	return nil
+}
+
+func (s3 *S3BlobStore) Put(key string, r io.Reader, size int64, contentType string) error {
+	_, err := s3.client.PutObject(context.Background(), s3.bucket, s3.prefix+key, r, size, minio.PutObjectOptions{
+		ContentType: contentType,
+	})
+	return err
+}
+
+func (s3 *S3BlobStore) Get(key string) (io.ReadSeekCloser, *BlobInfo, error) {
+	obj, err := s3.client.GetObject(context.Background(), s3.bucket, s3.prefix+key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	stat, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, nil, ErrBlobNotFound
+		}
+		return nil, nil, err
+	}
+	return obj, &BlobInfo{
+		Key:         key,
+		Size:        stat.Size,
+		ContentType: stat.ContentType,
+		ModTime:     stat.LastModified,
+	}, nil
+}
+
+func (s3 *S3BlobStore) Delete(key string) error {
+	return s3.client.RemoveObject(context.Background(), s3.bucket, s3.prefix+key, minio.RemoveObjectOptions{})
+}
+
+func (s3 *S3BlobStore) PresignedURL(key string, expiry time.Duration) (string, error) {
+	u, err := s3.client.PresignedGetObject(context.Background(), s3.bucket, s3.prefix+key, expiry, url.Values{})
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
@@ -0,0 +1,198 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// testS3Config points at the docker-compose MinIO unless S3_TEST_ENDPOINT
+// says otherwise.
+func testS3Config() S3Config {
+	cfg := S3Config{
+		Endpoint:  os.Getenv("S3_TEST_ENDPOINT"),
+		Region:    "us-east-1",
+		Bucket:    "todoapp-test",
+		AccessKey: "minioadmin",
+		SecretKey: "minioadmin",
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "localhost:9000"
+	}
+	if value := os.Getenv("S3_TEST_ACCESS_KEY"); value != "" {
+		cfg.AccessKey = value
+		cfg.SecretKey = os.Getenv("S3_TEST_SECRET_KEY")
+	}
+	return cfg
+}
+
+func TestS3BlobStore(t *testing.T) {
+	cfg := testS3Config()
+	conn, err := net.DialTimeout("tcp", cfg.Endpoint, time.Second)
+	if err != nil {
+		t.Skipf("no S3 server at %v: %v", cfg.Endpoint, err)
+	}
+	conn.Close()
+	blobStore, err := NewS3BlobStore(cfg)
+	if err != nil {
+		t.Skipf("S3 server at %v unusable: %v", cfg.Endpoint, err)
+	}
+	testBlobStore(t, blobStore)
+
+	t.Run("presign", func(t *testing.T) {
+		key := "test_" + uuid.NewString()
+		err := blobStore.Put(key, strings.NewReader("presigned"), 9, "text/plain")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer blobStore.Delete(key)
+		url, err := blobStore.PresignedURL(key, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		if response.StatusCode != http.StatusOK || string(body) != "presigned" {
+			t.Fatalf("presigned get = %v %q", response.Status, body)
+		}
+		if response.Header.Get("Content-Type") != "text/plain" {
+			t.Errorf("content type = %q", response.Header.Get("Content-Type"))
+		}
+	})
+
+	t.Run("prefix", func(t *testing.T) {
+		prefixed := cfg
+		prefixed.Prefix = "private/"
+		privateStore, err := NewS3BlobStore(prefixed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := "test_" + uuid.NewString()
+		err = privateStore.Put(key, strings.NewReader("private"), 7, "text/plain")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer privateStore.Delete(key)
+		_, _, err = blobStore.Get(key)
+		if !errors.Is(err, ErrBlobNotFound) {
+			t.Errorf("get from the unprefixed store = %v, want ErrBlobNotFound", err)
+		}
+		blob, _, err := blobStore.Get("private/" + key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blob.Close()
+	})
+}
+
+func TestLocalBlobStore(t *testing.T) {
+	blobStore, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlobStore(t, blobStore)
+
+	_, err = blobStore.PresignedURL("key", time.Minute)
+	if !errors.Is(err, ErrPresignUnsupported) {
+		t.Errorf("presign = %v, want ErrPresignUnsupported", err)
+	}
+	_, _, err = blobStore.Get("../escape")
+	if !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("get with a path = %v, want ErrBlobNotFound", err)
+	}
+}
+
+// testBlobStore runs the behaviour every backend shares.
+func testBlobStore(t *testing.T, blobStore BlobStore) {
+	t.Run("put get delete", func(t *testing.T) {
+		key := "test_" + uuid.NewString()
+		data := bytes.Repeat([]byte("blob"), 1000)
+		err := blobStore.Put(key, bytes.NewReader(data), int64(len(data)), "application/octet-stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		blob, info, err := blobStore.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(blob)
+		blob.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("read %v bytes, want the %v written", len(got), len(data))
+		}
+		if info.Size != int64(len(data)) || info.Key != key {
+			t.Errorf("info = %+v", info)
+		}
+
+		err = blobStore.Delete(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = blobStore.Get(key)
+		if !errors.Is(err, ErrBlobNotFound) {
+			t.Fatalf("get after delete = %v, want ErrBlobNotFound", err)
+		}
+		err = blobStore.Delete(key)
+		if err != nil {
+			t.Errorf("deleting a missing blob = %v, want nil", err)
+		}
+	})
+
+	t.Run("overwrite", func(t *testing.T) {
+		key := "test_" + uuid.NewString()
+		defer blobStore.Delete(key)
+		for _, value := range []string{"first", "second"} {
+			err := blobStore.Put(key, strings.NewReader(value), int64(len(value)), "text/plain")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		blob, _, err := blobStore.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer blob.Close()
+		got, _ := io.ReadAll(blob)
+		if string(got) != "second" {
+			t.Errorf("read %q, want the last write", got)
+		}
+	})
+
+	t.Run("seek", func(t *testing.T) {
+		key := "test_" + uuid.NewString()
+		defer blobStore.Delete(key)
+		err := blobStore.Put(key, strings.NewReader("0123456789"), 10, "text/plain")
+		if err != nil {
+			t.Fatal(err)
+		}
+		blob, _, err := blobStore.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer blob.Close()
+		// ServeContent answers range requests by seeking
+		_, err = blob.Seek(6, io.SeekStart)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(blob)
+		if string(got) != "6789" {
+			t.Errorf("read %q after seeking, want 6789", got)
+		}
+	})
+}
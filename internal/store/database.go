@@ -2,18 +2,138 @@ package store
 
 import (
 	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+	"todoapp/internal/tracing"
 
+	"github.com/glebarez/sqlite"
+	"github.com/google/uuid"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
-func Open() (*gorm.DB, error) {
-	dsn := "host=localhost user=postgres password=postgres dbname=postgres port=5432 sslmode=disable"
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+// DatabaseConfig selects the sql database behind the stores. The stores are
+// written against gorm and work with either driver.
+type DatabaseConfig struct {
+	// Driver is "postgres" or "sqlite".
+	Driver string
+	// DSN defaults to the docker-compose postgres database or todoapp.db in
+	// the working directory.
+	DSN string
+	// QueryTimeout bounds every statement, zero leaves them unbounded.
+	QueryTimeout time.Duration
+	// Replica skips the connection check on open, an unavailable replica is
+	// taken out of rotation by the ReplicaRouter instead of failing startup.
+	Replica bool
+}
+
+func Open(logger *slog.Logger, config DatabaseConfig) (*gorm.DB, error) {
+	var dialector gorm.Dialector
+	var system string
+	switch config.Driver {
+	case "postgres":
+		dsn := config.DSN
+		if dsn == "" {
+			dsn = "host=localhost user=postgres password=postgres dbname=postgres port=5432 sslmode=disable"
+		}
+		dialector = postgres.Open(dsn)
+		system = "postgresql"
+	case "sqlite":
+		dialector = sqlite.Open(sqliteDSN(config.DSN))
+		system = "sqlite"
+	default:
+		return nil, fmt.Errorf("db: unknown driver %q, use postgres or sqlite", config.Driver)
+	}
+	db, err := gorm.Open(dialector, &gorm.Config{
+		Logger:               newGormLogger(logger),
+		TranslateError:       true,
+		DisableAutomaticPing: config.Replica,
+		// postgres keeps microseconds, timestamps are cut to that so the
+		// value a write returns equals the one read back, ETags depend on it
+		NowFunc: func() time.Time {
+			return time.Now().Truncate(time.Microsecond)
+		},
+	})
 
 	if err != nil {
 		return nil, fmt.Errorf("db: open with %w", err)
 	}
-	fmt.Println("Connected to Database...")
+	if config.Driver == "sqlite" {
+		sqlDB, err := db.DB()
+		if err != nil {
+			return nil, fmt.Errorf("db: open with %w", err)
+		}
+		// sqlite allows a single writer, one connection serializes the
+		// stores' transactions instead of failing them
+		sqlDB.SetMaxOpenConns(1)
+	}
+	err = db.Use(&tracing.GormPlugin{System: system})
+	if err != nil {
+		return nil, fmt.Errorf("db: tracing plugin with %w", err)
+	}
+	if config.QueryTimeout > 0 {
+		err = db.Use(&QueryTimeoutPlugin{Timeout: config.QueryTimeout})
+		if err != nil {
+			return nil, fmt.Errorf("db: timeout plugin with %w", err)
+		}
+	}
+	if !config.Replica {
+		logger.Info("connected to database", "driver", config.Driver)
+	}
 	return db, nil
-}
\ No newline at end of file
+}
+
+// sqlitePragmas turn on foreign keys, which are off by default in sqlite,
+// and make concurrent writers wait instead of failing with SQLITE_BUSY.
+const sqlitePragmas = "_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+
+// sqliteDSN adds sqlitePragmas to the query of dsn. They go first, pragmas
+// run in order so the ones the DSN sets itself win.
+func sqliteDSN(dsn string) string {
+	if dsn == "" {
+		dsn = "todoapp.db"
+	}
+	path, query, _ := strings.Cut(dsn, "?")
+	if query == "" {
+		return path + "?" + sqlitePragmas
+	}
+	return path + "?" + sqlitePragmas + "&" + query
+}
+
+// assignID gives a new row a random id. Ids are generated here rather than
+// by a column default so every driver creates them the same way.
+func assignID(id *uuid.UUID) {
+	if *id == uuid.Nil {
+		*id = uuid.New()
+	}
+}
+
+// Models lists every table the stores migrate, used to verify the schema is
+// current.
+var Models = []any{&User{}, &Token{}, &Post{}, &PostImage{}, &Blob{}, &Image{}, &Upload{}, &Export{}}
+
+// CheckMigrations reports the first table or column the models expect that
+// is missing from the database.
+func CheckMigrations(db *gorm.DB) error {
+	migrator := db.Migrator()
+	for _, model := range Models {
+		stmt := &gorm.Statement{DB: db}
+		err := stmt.Parse(model)
+		if err != nil {
+			return err
+		}
+		if !migrator.HasTable(model) {
+			return fmt.Errorf("missing table %v", stmt.Schema.Table)
+		}
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName == "" || field.IgnoreMigration || !(field.Creatable || field.Updatable || field.Readable) {
+				continue
+			}
+			if !migrator.HasColumn(model, field.DBName) {
+				return fmt.Errorf("missing column %v.%v", stmt.Schema.Table, field.DBName)
+			}
+		}
+	}
+	return nil
+}
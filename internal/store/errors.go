@@ -0,0 +1,73 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Domain errors returned by the stores. Callers match them with errors.Is
+// instead of depending on gorm, the api maps each to a status code. Rows
+// owned by another user are reported as ErrNotFound so ids can't be probed.
+var (
+	ErrNotFound = errors.New("not found")
+	ErrConflict = errors.New("conflict")
+	// ErrTimeout is returned when a query runs past the query timeout.
+	ErrTimeout = errors.New("query timed out")
+)
+
+// QuotaExceededError is returned when a write would take a user over their
+// storage quota.
+type QuotaExceededError struct {
+	Quota int64
+	Used  int64
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("storage quota exceeded: %d of %d bytes used", e.Used, e.Quota)
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError collects every invalid field of a request so clients can
+// show them all at once.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Add(field string, message string) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Message: message})
+}
+
+// Err returns nil when no field was added, so it can be returned directly.
+func (e *ValidationError) Err() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, 0, len(e.Fields))
+	for _, field := range e.Fields {
+		messages = append(messages, field.Field+" "+field.Message)
+	}
+	return "validation failed: " + strings.Join(messages, ", ")
+}
+
+// translateError maps gorm errors to the domain errors above and passes
+// everything else through.
+func translateError(err error) error {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return ErrNotFound
+	case errors.Is(err, gorm.ErrDuplicatedKey), errors.Is(err, gorm.ErrForeignKeyViolated):
+		return ErrConflict
+	}
+	return err
+}
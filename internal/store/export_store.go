@@ -0,0 +1,121 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+// Export is an archive of a user's data, built in the background and kept
+// as a blob until ExpiresAt.
+type Export struct {
+	ID        uuid.UUID `gorm:"type:uuid;" json:"id"`
+	UserID    uuid.UUID `gorm:"not null;index;" json:"-"`
+	User      User      `gorm:"constraint:OnDelete:CASCADE;" json:"-"`
+	Status    string    `gorm:"not null;" json:"status"`
+	Size      int64     `gorm:"not null;default:0;" json:"size"`
+	ExpiresAt time.Time `gorm:"not null;index;" json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"-"`
+}
+
+func (export *Export) BeforeCreate(*gorm.DB) error {
+	assignID(&export.ID)
+	return nil
+}
+
+// BlobKey names the archive in the blob store.
+func (export *Export) BlobKey() string {
+	return "export_" + export.ID.String() + ".zip"
+}
+
+type PostgresExportStore struct {
+	db *gorm.DB
+}
+
+func NewPostgresExportStore(db *gorm.DB) *PostgresExportStore {
+	err := db.AutoMigrate(&Export{})
+	if err != nil {
+		panic(err)
+	}
+	return &PostgresExportStore{
+		db: db,
+	}
+}
+
+type ExportStore interface {
+	CreateExport(context.Context, *Export) error
+	GetExportByID(context.Context, uuid.UUID) (*Export, error)
+	GetExportForUser(ctx context.Context, id uuid.UUID, userId uuid.UUID) (*Export, error)
+	// UpdateExport saves the status, size and expiry.
+	UpdateExport(context.Context, *Export) error
+	GetPendingExports(context.Context) ([]Export, error)
+	GetExpiredExports(context.Context, time.Time) ([]Export, error)
+	GetExportsForUser(context.Context, uuid.UUID) ([]Export, error)
+	DeleteExport(context.Context, uuid.UUID) error
+}
+
+func (pg *PostgresExportStore) CreateExport(ctx context.Context, export *Export) error {
+	return pg.db.WithContext(ctx).Create(export).Error
+}
+
+func (pg *PostgresExportStore) GetExportByID(ctx context.Context, id uuid.UUID) (*Export, error) {
+	var export Export
+	result := pg.db.WithContext(ctx).First(&export, id)
+	if result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+	return &export, nil
+}
+
+func (pg *PostgresExportStore) GetExportForUser(ctx context.Context, id uuid.UUID, userId uuid.UUID) (*Export, error) {
+	var export Export
+	result := pg.db.WithContext(ctx).Where("id = ? AND user_id = ?", id, userId).First(&export)
+	if result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+	return &export, nil
+}
+
+func (pg *PostgresExportStore) UpdateExport(ctx context.Context, export *Export) error {
+	return pg.db.WithContext(ctx).Model(export).Select("status", "size", "expires_at").Updates(export).Error
+}
+
+func (pg *PostgresExportStore) GetPendingExports(ctx context.Context) ([]Export, error) {
+	var exports []Export
+	result := pg.db.WithContext(ctx).Where("status = ?", ExportPending).Order("created_at").Find(&exports)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return exports, nil
+}
+
+func (pg *PostgresExportStore) GetExpiredExports(ctx context.Context, now time.Time) ([]Export, error) {
+	var exports []Export
+	result := pg.db.WithContext(ctx).Where("expires_at < ?", now).Find(&exports)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return exports, nil
+}
+
+func (pg *PostgresExportStore) GetExportsForUser(ctx context.Context, userId uuid.UUID) ([]Export, error) {
+	var exports []Export
+	result := pg.db.WithContext(ctx).Where("user_id = ?", userId).Find(&exports)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return exports, nil
+}
+
+func (pg *PostgresExportStore) DeleteExport(ctx context.Context, id uuid.UUID) error {
+	return pg.db.WithContext(ctx).Delete(&Export{}, "id = ?", id).Error
+}
@@ -0,0 +1,76 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+	"todoapp/internal/logging"
+
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+const slowQueryThreshold = 200 * time.Millisecond
+
+// gormLogger sends GORM's query log through slog, using the request scoped
+// logger when the query runs with a request context.
+type gormLogger struct {
+	logger *slog.Logger
+	level  gormlogger.LogLevel
+}
+
+func newGormLogger(logger *slog.Logger) *gormLogger {
+	return &gormLogger{
+		logger: logger,
+		level:  gormlogger.Warn,
+	}
+}
+
+func (gl *gormLogger) loggerFor(ctx context.Context) *slog.Logger {
+	return logging.FromRequestContextOr(ctx, gl.logger)
+}
+
+func (gl *gormLogger) LogMode(level gormlogger.LogLevel) gormlogger.Interface {
+	return &gormLogger{
+		logger: gl.logger,
+		level:  level,
+	}
+}
+
+func (gl *gormLogger) Info(ctx context.Context, msg string, args ...any) {
+	if gl.level >= gormlogger.Info {
+		gl.loggerFor(ctx).InfoContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (gl *gormLogger) Warn(ctx context.Context, msg string, args ...any) {
+	if gl.level >= gormlogger.Warn {
+		gl.loggerFor(ctx).WarnContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (gl *gormLogger) Error(ctx context.Context, msg string, args ...any) {
+	if gl.level >= gormlogger.Error {
+		gl.loggerFor(ctx).ErrorContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (gl *gormLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	if gl.level <= gormlogger.Silent {
+		return
+	}
+	elapsed := time.Since(begin)
+	switch {
+	case err != nil && gl.level >= gormlogger.Error && !errors.Is(err, gorm.ErrRecordNotFound):
+		sql, rows := fc()
+		gl.loggerFor(ctx).ErrorContext(ctx, "query failed", "error", err, "sql", sql, "rows", rows, "elapsed", elapsed)
+	case elapsed > slowQueryThreshold && gl.level >= gormlogger.Warn:
+		sql, rows := fc()
+		gl.loggerFor(ctx).WarnContext(ctx, "slow query", "sql", sql, "rows", rows, "elapsed", elapsed)
+	case gl.level >= gormlogger.Info:
+		sql, rows := fc()
+		gl.loggerFor(ctx).DebugContext(ctx, "query", "sql", sql, "rows", rows, "elapsed", elapsed)
+	}
+}
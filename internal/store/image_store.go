@@ -0,0 +1,274 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Blob is a stored file addressed by the SHA-256 of its content. RefCount
+// tracks how many images point at it, the file is deleted with the last one.
+type Blob struct {
+	Key         string `gorm:"primaryKey;type:varchar(64);" json:"key"`
+	Size        int64  `gorm:"not null;" json:"size"`
+	ContentType string `gorm:"not null;" json:"content_type"`
+	RefCount    int    `gorm:"not null;default:0;" json:"-"`
+	// Pending is set until the file has been written to the blob store.
+	// Uploads of the same content meanwhile write it themselves instead of
+	// linking a file that may never arrive.
+	Pending   bool      `gorm:"not null;default:false;" json:"-"`
+	CreatedAt time.Time `json:"-"`
+	// Images is declared on this side so the foreign key is images.key
+	// referencing blobs.key and not the other way around.
+	Images []Image `gorm:"foreignKey:Key;references:Key;" json:"-"`
+}
+
+// Image records that a user uploaded a blob. Size counts against the user's
+// quota even when the blob is shared with other users, variants are free.
+type Image struct {
+	ID          uuid.UUID `gorm:"type:uuid;" json:"id"`
+	UserID      uuid.UUID `gorm:"not null;uniqueIndex:idx_images_user_key;" json:"-"`
+	User        User      `gorm:"constraint:OnDelete:CASCADE;" json:"-"`
+	Key         string    `gorm:"type:varchar(64);not null;uniqueIndex:idx_images_user_key;" json:"key"`
+	Size        int64     `gorm:"not null;" json:"size"`
+	ContentType string    `gorm:"not null;" json:"content_type"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func (image *Image) BeforeCreate(*gorm.DB) error {
+	assignID(&image.ID)
+	return nil
+}
+
+type PostgresImageStore struct {
+	db *gorm.DB
+}
+
+func NewPostgresImageStore(db *gorm.DB) *PostgresImageStore {
+	err := db.AutoMigrate(&Blob{}, &Image{})
+	if err != nil {
+		panic(err)
+	}
+	return &PostgresImageStore{
+		db: db,
+	}
+}
+
+type ImageStore interface {
+	GetImageForUser(ctx context.Context, userId uuid.UUID, key string) (*Image, error)
+	// CreateImage fails with a *QuotaExceededError when the image would take
+	// the user over quota, checked atomically with the insert. A quota of 0
+	// disables the check.
+	CreateImage(ctx context.Context, image *Image, quota int64) (pending bool, err error)
+	GetBlob(ctx context.Context, key string) (*Blob, error)
+	// MarkBlobWritten clears Pending once the file is in the blob store.
+	MarkBlobWritten(ctx context.Context, key string) error
+	GetUsageForUser(context.Context, uuid.UUID) (int64, error)
+	GetImagesCreatedBefore(context.Context, time.Time) ([]Image, error)
+	GetImagesForUser(context.Context, uuid.UUID) ([]Image, error)
+	IsImageReferenced(ctx context.Context, key string) (bool, error)
+	DeleteImage(context.Context, uuid.UUID) (lastReference bool, err error)
+	// DeleteImageIfUnreferenced is DeleteImage for the garbage collector,
+	// it fails with ErrConflict when a post references the image by the
+	// time the delete runs.
+	DeleteImageIfUnreferenced(context.Context, uuid.UUID) (lastReference bool, err error)
+}
+
+func (pg *PostgresImageStore) GetImageForUser(ctx context.Context, userId uuid.UUID, key string) (*Image, error) {
+	image := &Image{}
+	result := pg.db.WithContext(ctx).Where("user_id = ? AND key = ?", userId, key).Find(&image)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return nil, ErrNotFound
+	}
+	return image, nil
+}
+
+// CreateImage stores the image and takes a reference on its blob, pending
+// reports whether the file has not been written yet and the caller has to
+// write it.
+func (pg *PostgresImageStore) CreateImage(ctx context.Context, image *Image, quota int64) (bool, error) {
+	pending := false
+	err := pg.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := checkQuota(tx, image.UserID, image.Size, quota)
+		if err != nil {
+			return err
+		}
+		blob := &Blob{
+			Key:         image.Key,
+			Size:        image.Size,
+			ContentType: image.ContentType,
+			RefCount:    1,
+			Pending:     true,
+		}
+		result := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "key"}},
+			DoUpdates: clause.Assignments(map[string]any{"ref_count": gorm.Expr("blobs.ref_count + 1")}),
+		}).Create(blob)
+		if result.Error != nil {
+			return result.Error
+		}
+		result = tx.Model(&Blob{}).Where("key = ?", image.Key).Select("pending").Find(&pending)
+		if result.Error != nil {
+			return result.Error
+		}
+		return tx.Create(image).Error
+	})
+	if err != nil {
+		return false, translateError(err)
+	}
+	return pending, nil
+}
+
+func (pg *PostgresImageStore) GetBlob(ctx context.Context, key string) (*Blob, error) {
+	blob := &Blob{}
+	result := pg.db.WithContext(ctx).Where("key = ?", key).Find(blob)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return nil, ErrNotFound
+	}
+	return blob, nil
+}
+
+func (pg *PostgresImageStore) MarkBlobWritten(ctx context.Context, key string) error {
+	return pg.db.WithContext(ctx).Model(&Blob{}).Where("key = ?", key).Update("pending", false).Error
+}
+
+func (pg *PostgresImageStore) GetUsageForUser(ctx context.Context, userId uuid.UUID) (int64, error) {
+	return usageForUser(pg.db.WithContext(ctx), userId)
+}
+
+// usageForUser adds up the user's images and the lengths reserved by their
+// unexpired uploads.
+func usageForUser(db *gorm.DB, userId uuid.UUID) (int64, error) {
+	var images, reserved int64
+	result := db.Model(&Image{}).Where("user_id = ?", userId).Select("COALESCE(SUM(size), 0)").Find(&images)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	result = db.Model(&Upload{}).Where("user_id = ? AND expires_at > ?", userId, time.Now()).Select("COALESCE(SUM(length), 0)").Find(&reserved)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	return images + reserved, nil
+}
+
+// checkQuota locks the user's row so concurrent writes for the same user
+// check their quota one after the other, instead of all passing against the
+// same usage.
+func checkQuota(tx *gorm.DB, userId uuid.UUID, size int64, quota int64) error {
+	if quota <= 0 {
+		return nil
+	}
+	result := tx.Unscoped().Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").Where("id = ?", userId).Find(&User{})
+	if result.Error != nil {
+		return result.Error
+	}
+	used, err := usageForUser(tx, userId)
+	if err != nil {
+		return err
+	}
+	if used+size > quota {
+		return &QuotaExceededError{Quota: quota, Used: used}
+	}
+	return nil
+}
+
+func (pg *PostgresImageStore) GetImagesCreatedBefore(ctx context.Context, before time.Time) ([]Image, error) {
+	var images []Image
+	result := pg.db.WithContext(ctx).Where("created_at < ?", before).Find(&images)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return images, nil
+}
+
+func (pg *PostgresImageStore) GetImagesForUser(ctx context.Context, userId uuid.UUID) ([]Image, error) {
+	var images []Image
+	result := pg.db.WithContext(ctx).Where("user_id = ?", userId).Find(&images)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return images, nil
+}
+
+// IsImageReferenced reports whether any post links the blob key, directly
+// or through one of its variants. Posts in the trash count, they can still
+// be restored.
+func (pg *PostgresImageStore) IsImageReferenced(ctx context.Context, key string) (bool, error) {
+	return isImageReferenced(pg.db.WithContext(ctx), key)
+}
+
+func isImageReferenced(db *gorm.DB, key string) (bool, error) {
+	var count int64
+	result := db.Model(&PostImage{}).Where("key = ?", key).Limit(1).Count(&count)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return count > 0, nil
+}
+
+// DeleteImage drops the image and its blob reference, lastReference reports
+// whether the blob row is gone and the file should be deleted too.
+func (pg *PostgresImageStore) DeleteImage(ctx context.Context, id uuid.UUID) (bool, error) {
+	return pg.deleteImage(ctx, id, false)
+}
+
+// DeleteImageIfUnreferenced checks the references while holding the lock on
+// the blob row, posts linking the blob take a shared lock on it, so a post
+// saved concurrently is either seen here or waits until the delete is done.
+func (pg *PostgresImageStore) DeleteImageIfUnreferenced(ctx context.Context, id uuid.UUID) (bool, error) {
+	return pg.deleteImage(ctx, id, true)
+}
+
+func (pg *PostgresImageStore) deleteImage(ctx context.Context, id uuid.UUID, unreferencedOnly bool) (bool, error) {
+	lastReference := false
+	err := pg.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		image := &Image{}
+		result := tx.Where("id = ?", id).Find(image)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != 1 {
+			return ErrNotFound
+		}
+		blob := &Blob{}
+		result = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("key = ?", image.Key).Find(blob)
+		if result.Error != nil {
+			return result.Error
+		}
+		blobFound := result.RowsAffected == 1
+		if unreferencedOnly {
+			referenced, err := isImageReferenced(tx, image.Key)
+			if err != nil {
+				return err
+			}
+			if referenced {
+				return ErrConflict
+			}
+		}
+		result = tx.Delete(image)
+		if result.Error != nil {
+			return result.Error
+		}
+		if !blobFound {
+			return nil
+		}
+		if blob.RefCount > 1 {
+			return tx.Model(blob).Update("ref_count", gorm.Expr("ref_count - 1")).Error
+		}
+		lastReference = true
+		return tx.Delete(blob).Error
+	})
+	if err != nil {
+		return false, err
+	}
+	return lastReference, nil
+}
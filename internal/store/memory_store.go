@@ -0,0 +1,964 @@
+package store
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+	"todoapp/internal/utils"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// The memory stores keep everything in maps guarded by a mutex. They follow
+// the semantics of the postgres stores, including the domain errors, so
+// they can stand in for a database in local development. Values are copied
+// in and out so callers never share state with the store.
+//
+// Each store embeds a pointer to its state, the copies a MemoryTransactor
+// hands to a unit of work share it and log how to undo their writes.
+
+// MemoryStores are the memory stores related like the tables are: images
+// find their references in the posts, uploads count toward the image quota
+// and purging a user takes their rows in every store with it.
+type MemoryStores struct {
+	Users   *MemoryUserStore
+	Tokens  *MemoryTokenStore
+	Posts   *MemoryPostStore
+	Images  *MemoryImageStore
+	Uploads *MemoryUploadStore
+	Exports *MemoryExportStore
+}
+
+func NewMemoryStores() *MemoryStores {
+	stores := &MemoryStores{
+		Users:   &MemoryUserStore{memoryUsers: &memoryUsers{users: map[uuid.UUID]User{}}},
+		Tokens:  &MemoryTokenStore{memoryTokens: &memoryTokens{nextID: 1, tokens: map[int]Token{}}},
+		Posts:   &MemoryPostStore{memoryPosts: &memoryPosts{}},
+		Images:  &MemoryImageStore{memoryImages: &memoryImages{images: map[uuid.UUID]Image{}, blobs: map[string]Blob{}}},
+		Uploads: &MemoryUploadStore{memoryUploads: &memoryUploads{uploads: map[uuid.UUID]Upload{}}},
+		Exports: &MemoryExportStore{memoryExports: &memoryExports{exports: map[uuid.UUID]Export{}}},
+	}
+	stores.Users.stores = stores
+	stores.Images.posts = stores.Posts.memoryPosts
+	stores.Images.uploads = stores.Uploads.memoryUploads
+	stores.Uploads.images = stores.Images.memoryImages
+	return stores
+}
+
+// undoLog collects how to revert the writes of one unit of work.
+type undoLog struct {
+	steps []func()
+}
+
+// rollback reverts the writes, newest first.
+func (undo *undoLog) rollback() {
+	for i := len(undo.steps) - 1; i >= 0; i-- {
+		undo.steps[i]()
+	}
+}
+
+// saveRow records rows[key] as it is before a write, so a rollback puts it
+// back or removes it again. The caller holds mu.
+func saveRow[K comparable, V any](undo *undoLog, mu sync.Locker, rows map[K]V, key K) {
+	if undo == nil {
+		return
+	}
+	row, existed := rows[key]
+	undo.steps = append(undo.steps, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if existed {
+			rows[key] = row
+		} else {
+			delete(rows, key)
+		}
+	})
+}
+
+type MemoryUserStore struct {
+	*memoryUsers
+	undo *undoLog
+}
+
+type memoryUsers struct {
+	mu     sync.RWMutex
+	users  map[uuid.UUID]User
+	stores *MemoryStores
+}
+
+// deletedNow is the DeletedAt of a row moved to the trash.
+func deletedNow() gorm.DeletedAt {
+	return gorm.DeletedAt{Time: time.Now(), Valid: true}
+}
+
+func (ms *MemoryUserStore) DoesUsernameExist(_ context.Context, username string) (bool, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	for _, user := range ms.users {
+		if user.Username == username {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (ms *MemoryUserStore) GetUserByUsername(_ context.Context, username string) (*User, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	for _, user := range ms.users {
+		if user.Username == username && !user.DeletedAt.Valid {
+			return &user, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (ms *MemoryUserStore) GetUserByID(_ context.Context, userId uuid.UUID) (*User, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	user, ok := ms.users[userId]
+	if !ok || user.DeletedAt.Valid {
+		return nil, ErrNotFound
+	}
+	return &user, nil
+}
+
+func (ms *MemoryUserStore) CreateUser(_ context.Context, user *User) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for _, existing := range ms.users {
+		if existing.Username == user.Username {
+			return ErrConflict
+		}
+	}
+	assignID(&user.ID)
+	if _, ok := ms.users[user.ID]; ok {
+		return ErrConflict
+	}
+	now := time.Now()
+	user.CreatedAt, user.UpdatedAt = now, now
+	saveRow(ms.undo, &ms.mu, ms.users, user.ID)
+	ms.users[user.ID] = *user
+	return nil
+}
+
+func (ms *MemoryUserStore) DeleteUser(_ context.Context, userId uuid.UUID) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	user, ok := ms.users[userId]
+	if !ok || user.DeletedAt.Valid {
+		return ErrNotFound
+	}
+	saveRow(ms.undo, &ms.mu, ms.users, userId)
+	user.DeletedAt = deletedNow()
+	ms.users[userId] = user
+	return nil
+}
+
+func (ms *MemoryUserStore) GetDeletedUserByUsername(_ context.Context, username string) (*User, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	for _, user := range ms.users {
+		if user.Username == username && user.DeletedAt.Valid {
+			return &user, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (ms *MemoryUserStore) RestoreUser(_ context.Context, userId uuid.UUID) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	user, ok := ms.users[userId]
+	if !ok || !user.DeletedAt.Valid {
+		return ErrNotFound
+	}
+	saveRow(ms.undo, &ms.mu, ms.users, userId)
+	user.DeletedAt = gorm.DeletedAt{}
+	user.UpdatedAt = time.Now()
+	ms.users[userId] = user
+	return nil
+}
+
+func (ms *MemoryUserStore) GetUsersDeletedBefore(_ context.Context, before time.Time) ([]User, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	users := []User{}
+	for _, user := range ms.users {
+		if user.DeletedAt.Valid && user.DeletedAt.Time.Before(before) {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+// PurgeUser deletes the user with their posts, tokens, images, uploads and
+// exports, like the foreign keys cascade in postgres. As there, the blobs
+// of the images keep their reference counts.
+func (ms *MemoryUserStore) PurgeUser(_ context.Context, userId uuid.UUID) error {
+	ms.mu.Lock()
+	if _, ok := ms.users[userId]; !ok {
+		ms.mu.Unlock()
+		return ErrNotFound
+	}
+	saveRow(ms.undo, &ms.mu, ms.users, userId)
+	delete(ms.users, userId)
+	ms.mu.Unlock()
+	if ms.stores == nil {
+		return nil
+	}
+	ms.stores.Posts.withUndo(ms.undo).purgeForUser(userId)
+	ms.stores.Tokens.withUndo(ms.undo).deleteForUser(userId)
+	ms.stores.Images.withUndo(ms.undo).deleteForUser(userId)
+	ms.stores.Uploads.withUndo(ms.undo).deleteForUser(userId)
+	ms.stores.Exports.withUndo(ms.undo).deleteForUser(userId)
+	return nil
+}
+
+func (ms *MemoryUserStore) withUndo(undo *undoLog) *MemoryUserStore {
+	return &MemoryUserStore{memoryUsers: ms.memoryUsers, undo: undo}
+}
+
+type MemoryTokenStore struct {
+	*memoryTokens
+	undo *undoLog
+}
+
+type memoryTokens struct {
+	mu     sync.RWMutex
+	nextID int
+	tokens map[int]Token
+}
+
+func (ms *MemoryTokenStore) CreateToken(_ context.Context, userId uuid.UUID) (*Token, error) {
+	token := &Token{
+		UserID: userId,
+	}
+	var err error
+	token.SessionToken.PlainText, err = utils.GenerateToken(32)
+	if err != nil {
+		return nil, err
+	}
+	token.CSRFToken.PlainText, err = utils.GenerateToken(32)
+	if err != nil {
+		return nil, err
+	}
+	token.SessionToken.Hash = utils.HashToken(token.SessionToken.PlainText)
+	token.CSRFToken.Hash = utils.HashToken(token.CSRFToken.PlainText)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	token.ID = ms.nextID
+	ms.nextID++
+	now := time.Now()
+	token.CreatedAt, token.UpdatedAt = now, now
+	stored := *token
+	// like the database only the hashes are kept
+	stored.SessionToken.PlainText, stored.CSRFToken.PlainText = "", ""
+	saveRow(ms.undo, &ms.mu, ms.tokens, token.ID)
+	ms.tokens[token.ID] = stored
+	return token, nil
+}
+
+func (ms *MemoryTokenStore) GetTokenBySession(_ context.Context, session_token string) (*Token, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	for _, token := range ms.tokens {
+		if token.SessionToken.Hash == session_token {
+			return &token, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (ms *MemoryTokenStore) DeleteAllTokenForUser(_ context.Context, userId uuid.UUID) error {
+	ms.deleteForUser(userId)
+	return nil
+}
+
+func (ms *MemoryTokenStore) deleteForUser(userId uuid.UUID) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for id, token := range ms.tokens {
+		if token.UserID == userId {
+			saveRow(ms.undo, &ms.mu, ms.tokens, id)
+			delete(ms.tokens, id)
+		}
+	}
+}
+
+func (ms *MemoryTokenStore) GetTokensForUser(_ context.Context, userId uuid.UUID) ([]Token, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	tokens := []Token{}
+	for _, token := range ms.tokens {
+		if token.UserID == userId {
+			tokens = append(tokens, token)
+		}
+	}
+	slices.SortFunc(tokens, func(a, b Token) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return tokens, nil
+}
+
+func (ms *MemoryTokenStore) CountTokensCreatedSince(_ context.Context, since time.Time) (int64, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	var count int64
+	for _, token := range ms.tokens {
+		if token.CreatedAt.After(since) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (ms *MemoryTokenStore) withUndo(undo *undoLog) *MemoryTokenStore {
+	return &MemoryTokenStore{memoryTokens: ms.memoryTokens, undo: undo}
+}
+
+type MemoryPostStore struct {
+	*memoryPosts
+	undo *undoLog
+}
+
+type memoryPosts struct {
+	mu    sync.RWMutex
+	posts []Post
+}
+
+// savePost records the post as it is before a write, the caller holds mu.
+func (ms *MemoryPostStore) savePost(id uuid.UUID) {
+	if ms.undo == nil {
+		return
+	}
+	state := ms.memoryPosts
+	index := func() int {
+		return slices.IndexFunc(state.posts, func(post Post) bool { return post.ID == id })
+	}
+	var post Post
+	i := index()
+	existed := i >= 0
+	if existed {
+		post = state.posts[i]
+	}
+	ms.undo.steps = append(ms.undo.steps, func() {
+		state.mu.Lock()
+		defer state.mu.Unlock()
+		i := index()
+		switch {
+		case existed && i >= 0:
+			state.posts[i] = post
+		case existed:
+			state.posts = append(state.posts, post)
+		case i >= 0:
+			state.posts = slices.Delete(state.posts, i, i+1)
+		}
+	})
+}
+
+func (ms *MemoryPostStore) CreatePost(_ context.Context, post *Post) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	assignID(&post.ID)
+	// like gorm, timestamps given by the caller are kept
+	now := time.Now()
+	if post.CreatedAt.IsZero() {
+		post.CreatedAt = now
+	}
+	if post.UpdatedAt.IsZero() {
+		post.UpdatedAt = now
+	}
+	ms.savePost(post.ID)
+	ms.posts = append(ms.posts, *post)
+	return nil
+}
+
+// GetAllPosts leaves out everything but id and title, like the listing query.
+func (ms *MemoryPostStore) GetAllPosts(_ context.Context) ([]Post, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	posts := make([]Post, 0, len(ms.posts))
+	for _, post := range ms.posts {
+		if !post.DeletedAt.Valid {
+			posts = append(posts, Post{ID: post.ID, Title: post.Title})
+		}
+	}
+	return posts, nil
+}
+
+func (ms *MemoryPostStore) GetPostByID(_ context.Context, id uuid.UUID) (*Post, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	for _, post := range ms.posts {
+		if post.ID == id && !post.DeletedAt.Valid {
+			return &post, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (ms *MemoryPostStore) GetPostsForUser(_ context.Context, userId uuid.UUID) ([]Post, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	posts := []Post{}
+	for _, post := range ms.posts {
+		if post.UserID == userId && !post.DeletedAt.Valid {
+			posts = append(posts, post)
+		}
+	}
+	return posts, nil
+}
+
+func (ms *MemoryPostStore) GetPostBySlug(_ context.Context, userId uuid.UUID, slug string) (*Post, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	for _, post := range ms.posts {
+		if post.UserID == userId && post.Slug == slug && !post.DeletedAt.Valid {
+			return &post, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (ms *MemoryPostStore) UpdatePost(_ context.Context, post *Post, version time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for i, existing := range ms.posts {
+		if existing.ID == post.ID && existing.UserID == post.UserID && !existing.DeletedAt.Valid {
+			if !existing.UpdatedAt.Equal(version) {
+				return ErrConflict
+			}
+			ms.savePost(existing.ID)
+			existing.Title = post.Title
+			existing.Content = post.Content
+			existing.UpdatedAt = time.Now()
+			ms.posts[i] = existing
+			*post = existing
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (ms *MemoryPostStore) DeletePost(_ context.Context, id uuid.UUID, userId uuid.UUID) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for i, post := range ms.posts {
+		if post.ID == id && post.UserID == userId && !post.DeletedAt.Valid {
+			ms.savePost(post.ID)
+			ms.posts[i].DeletedAt = deletedNow()
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (ms *MemoryPostStore) DeletePostsForUser(_ context.Context, userId uuid.UUID) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	deletedAt := deletedNow()
+	for i, post := range ms.posts {
+		if post.UserID == userId && !post.DeletedAt.Valid {
+			ms.savePost(post.ID)
+			ms.posts[i].DeletedAt = deletedAt
+		}
+	}
+	return nil
+}
+
+func (ms *MemoryPostStore) GetDeletedPostsForUser(_ context.Context, userId uuid.UUID) ([]Post, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	posts := []Post{}
+	for _, post := range ms.posts {
+		if post.UserID == userId && post.DeletedAt.Valid {
+			posts = append(posts, post)
+		}
+	}
+	slices.SortFunc(posts, func(a, b Post) int {
+		return b.DeletedAt.Time.Compare(a.DeletedAt.Time)
+	})
+	return posts, nil
+}
+
+func (ms *MemoryPostStore) RestorePost(_ context.Context, id uuid.UUID, userId uuid.UUID) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for i, post := range ms.posts {
+		if post.ID == id && post.UserID == userId && post.DeletedAt.Valid {
+			ms.savePost(post.ID)
+			ms.posts[i].DeletedAt = gorm.DeletedAt{}
+			ms.posts[i].UpdatedAt = time.Now()
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (ms *MemoryPostStore) PurgePostsDeletedBefore(_ context.Context, before time.Time) (int64, error) {
+	return ms.purge(func(post Post) bool {
+		return post.DeletedAt.Valid && post.DeletedAt.Time.Before(before)
+	}), nil
+}
+
+func (ms *MemoryPostStore) PurgePostsForUser(_ context.Context, userId uuid.UUID) error {
+	ms.purgeForUser(userId)
+	return nil
+}
+
+func (ms *MemoryPostStore) purgeForUser(userId uuid.UUID) {
+	ms.purge(func(post Post) bool {
+		return post.UserID == userId
+	})
+}
+
+func (ms *MemoryPostStore) purge(match func(Post) bool) int64 {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for _, post := range ms.posts {
+		if match(post) {
+			ms.savePost(post.ID)
+		}
+	}
+	count := len(ms.posts)
+	ms.posts = slices.DeleteFunc(ms.posts, match)
+	return int64(count - len(ms.posts))
+}
+
+// links backs MemoryImageStore.IsImageReferenced, the caller holds mu.
+func (ms *memoryPosts) links(key string) bool {
+	return slices.ContainsFunc(ms.posts, func(post Post) bool {
+		return slices.Contains(imageKeys(post.Content), key)
+	})
+}
+
+func (ms *MemoryPostStore) withUndo(undo *undoLog) *MemoryPostStore {
+	return &MemoryPostStore{memoryPosts: ms.memoryPosts, undo: undo}
+}
+
+type MemoryImageStore struct {
+	*memoryImages
+	undo *undoLog
+}
+
+type memoryImages struct {
+	mu     sync.Mutex
+	images map[uuid.UUID]Image
+	blobs  map[string]Blob
+	// posts are searched for image references
+	posts *memoryPosts
+	// uploads reserve their length against the quota
+	uploads *memoryUploads
+}
+
+func (ms *MemoryImageStore) GetImageForUser(_ context.Context, userId uuid.UUID, key string) (*Image, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for _, image := range ms.images {
+		if image.UserID == userId && image.Key == key {
+			return &image, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (ms *MemoryImageStore) CreateImage(_ context.Context, image *Image, quota int64) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for _, existing := range ms.images {
+		if existing.UserID == image.UserID && existing.Key == image.Key {
+			return false, ErrConflict
+		}
+	}
+	if quota > 0 {
+		used := ms.usage(image.UserID)
+		if used+image.Size > quota {
+			return false, &QuotaExceededError{Quota: quota, Used: used}
+		}
+	}
+	now := time.Now()
+	blob, ok := ms.blobs[image.Key]
+	if !ok {
+		blob = Blob{Key: image.Key, Size: image.Size, ContentType: image.ContentType, Pending: true, CreatedAt: now}
+	}
+	blob.RefCount++
+	saveRow(ms.undo, &ms.mu, ms.blobs, image.Key)
+	ms.blobs[image.Key] = blob
+	assignID(&image.ID)
+	image.CreatedAt = now
+	saveRow(ms.undo, &ms.mu, ms.images, image.ID)
+	ms.images[image.ID] = *image
+	return blob.Pending, nil
+}
+
+func (ms *MemoryImageStore) GetBlob(_ context.Context, key string) (*Blob, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	blob, ok := ms.blobs[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &blob, nil
+}
+
+func (ms *MemoryImageStore) MarkBlobWritten(_ context.Context, key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	blob, ok := ms.blobs[key]
+	if ok {
+		saveRow(ms.undo, &ms.mu, ms.blobs, key)
+		blob.Pending = false
+		ms.blobs[key] = blob
+	}
+	return nil
+}
+
+func (ms *MemoryImageStore) GetUsageForUser(_ context.Context, userId uuid.UUID) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.usage(userId), nil
+}
+
+// usage is the quota the user has used, the caller holds mu.
+func (ms *memoryImages) usage(userId uuid.UUID) int64 {
+	var used int64
+	for _, image := range ms.images {
+		if image.UserID == userId {
+			used += image.Size
+		}
+	}
+	if ms.uploads != nil {
+		used += ms.uploads.reserved(userId)
+	}
+	return used
+}
+
+func (ms *MemoryImageStore) GetImagesCreatedBefore(_ context.Context, before time.Time) ([]Image, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	images := []Image{}
+	for _, image := range ms.images {
+		if image.CreatedAt.Before(before) {
+			images = append(images, image)
+		}
+	}
+	return images, nil
+}
+
+func (ms *MemoryImageStore) GetImagesForUser(_ context.Context, userId uuid.UUID) ([]Image, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	images := []Image{}
+	for _, image := range ms.images {
+		if image.UserID == userId {
+			images = append(images, image)
+		}
+	}
+	return images, nil
+}
+
+func (ms *MemoryImageStore) IsImageReferenced(_ context.Context, key string) (bool, error) {
+	ms.posts.mu.RLock()
+	defer ms.posts.mu.RUnlock()
+	return ms.posts.links(key), nil
+}
+
+func (ms *MemoryImageStore) DeleteImage(_ context.Context, id uuid.UUID) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.deleteImage(id, false)
+}
+
+// DeleteImageIfUnreferenced holds the post store's lock from the check to
+// the delete, so no post can link the image in between.
+func (ms *MemoryImageStore) DeleteImageIfUnreferenced(_ context.Context, id uuid.UUID) (bool, error) {
+	ms.posts.mu.RLock()
+	defer ms.posts.mu.RUnlock()
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.deleteImage(id, true)
+}
+
+func (ms *MemoryImageStore) deleteImage(id uuid.UUID, unreferencedOnly bool) (bool, error) {
+	image, ok := ms.images[id]
+	if !ok {
+		return false, ErrNotFound
+	}
+	if unreferencedOnly && ms.posts.links(image.Key) {
+		return false, ErrConflict
+	}
+	saveRow(ms.undo, &ms.mu, ms.images, id)
+	delete(ms.images, id)
+	blob, ok := ms.blobs[image.Key]
+	if !ok {
+		return false, nil
+	}
+	saveRow(ms.undo, &ms.mu, ms.blobs, image.Key)
+	if blob.RefCount > 1 {
+		blob.RefCount--
+		ms.blobs[image.Key] = blob
+		return false, nil
+	}
+	delete(ms.blobs, image.Key)
+	return true, nil
+}
+
+// deleteForUser drops the user's images without touching the blobs, like
+// the cascade from the users table.
+func (ms *MemoryImageStore) deleteForUser(userId uuid.UUID) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for id, image := range ms.images {
+		if image.UserID == userId {
+			saveRow(ms.undo, &ms.mu, ms.images, id)
+			delete(ms.images, id)
+		}
+	}
+}
+
+func (ms *MemoryImageStore) withUndo(undo *undoLog) *MemoryImageStore {
+	return &MemoryImageStore{memoryImages: ms.memoryImages, undo: undo}
+}
+
+type MemoryUploadStore struct {
+	*memoryUploads
+	undo *undoLog
+}
+
+type memoryUploads struct {
+	mu      sync.Mutex
+	uploads map[uuid.UUID]Upload
+	// images are locked before the uploads to check the quota
+	images *memoryImages
+}
+
+func (ms *MemoryUploadStore) CreateUpload(_ context.Context, upload *Upload, quota int64) error {
+	ms.images.mu.Lock()
+	defer ms.images.mu.Unlock()
+	if quota > 0 {
+		used := ms.images.usage(upload.UserID)
+		if used+upload.Length > quota {
+			return &QuotaExceededError{Quota: quota, Used: used}
+		}
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	assignID(&upload.ID)
+	now := time.Now()
+	upload.CreatedAt, upload.UpdatedAt = now, now
+	saveRow(ms.undo, &ms.mu, ms.uploads, upload.ID)
+	ms.uploads[upload.ID] = *upload
+	return nil
+}
+
+// reserved is the length of the user's unexpired uploads.
+func (ms *memoryUploads) reserved(userId uuid.UUID) int64 {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var reserved int64
+	now := time.Now()
+	for _, upload := range ms.uploads {
+		if upload.UserID == userId && upload.ExpiresAt.After(now) {
+			reserved += upload.Length
+		}
+	}
+	return reserved
+}
+
+func (ms *MemoryUploadStore) GetUploadForUser(_ context.Context, id uuid.UUID, userId uuid.UUID) (*Upload, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	upload, ok := ms.uploads[id]
+	if !ok || upload.UserID != userId {
+		return nil, ErrNotFound
+	}
+	return &upload, nil
+}
+
+func (ms *MemoryUploadStore) AdvanceUpload(_ context.Context, upload *Upload, chunkKey string, size int64, expiresAt time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	stored, ok := ms.uploads[upload.ID]
+	if !ok || stored.Offset != upload.Offset {
+		return ErrConflict
+	}
+	chunkKeys := chunkKey
+	if upload.ChunkKeys != "" {
+		chunkKeys = upload.ChunkKeys + "," + chunkKey
+	}
+	stored.Offset = upload.Offset + size
+	stored.ChunkKeys = chunkKeys
+	stored.ExpiresAt = expiresAt
+	stored.UpdatedAt = time.Now()
+	saveRow(ms.undo, &ms.mu, ms.uploads, upload.ID)
+	ms.uploads[upload.ID] = stored
+	upload.Offset = stored.Offset
+	upload.ChunkKeys = chunkKeys
+	upload.ExpiresAt = expiresAt
+	return nil
+}
+
+func (ms *MemoryUploadStore) DeleteUpload(_ context.Context, id uuid.UUID) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	saveRow(ms.undo, &ms.mu, ms.uploads, id)
+	delete(ms.uploads, id)
+	return nil
+}
+
+func (ms *MemoryUploadStore) GetExpiredUploads(_ context.Context, now time.Time) ([]Upload, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	uploads := []Upload{}
+	for _, upload := range ms.uploads {
+		if upload.ExpiresAt.Before(now) {
+			uploads = append(uploads, upload)
+		}
+	}
+	return uploads, nil
+}
+
+func (ms *MemoryUploadStore) GetUploadsForUser(_ context.Context, userId uuid.UUID) ([]Upload, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	uploads := []Upload{}
+	for _, upload := range ms.uploads {
+		if upload.UserID == userId {
+			uploads = append(uploads, upload)
+		}
+	}
+	return uploads, nil
+}
+
+func (ms *MemoryUploadStore) deleteForUser(userId uuid.UUID) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for id, upload := range ms.uploads {
+		if upload.UserID == userId {
+			saveRow(ms.undo, &ms.mu, ms.uploads, id)
+			delete(ms.uploads, id)
+		}
+	}
+}
+
+func (ms *MemoryUploadStore) withUndo(undo *undoLog) *MemoryUploadStore {
+	return &MemoryUploadStore{memoryUploads: ms.memoryUploads, undo: undo}
+}
+
+type MemoryExportStore struct {
+	*memoryExports
+	undo *undoLog
+}
+
+type memoryExports struct {
+	mu      sync.Mutex
+	exports map[uuid.UUID]Export
+}
+
+func (ms *MemoryExportStore) CreateExport(_ context.Context, export *Export) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	assignID(&export.ID)
+	now := time.Now()
+	export.CreatedAt, export.UpdatedAt = now, now
+	saveRow(ms.undo, &ms.mu, ms.exports, export.ID)
+	ms.exports[export.ID] = *export
+	return nil
+}
+
+func (ms *MemoryExportStore) GetExportByID(_ context.Context, id uuid.UUID) (*Export, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	export, ok := ms.exports[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &export, nil
+}
+
+func (ms *MemoryExportStore) GetExportForUser(ctx context.Context, id uuid.UUID, userId uuid.UUID) (*Export, error) {
+	export, err := ms.GetExportByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if export.UserID != userId {
+		return nil, ErrNotFound
+	}
+	return export, nil
+}
+
+func (ms *MemoryExportStore) UpdateExport(_ context.Context, export *Export) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	stored, ok := ms.exports[export.ID]
+	if !ok {
+		return nil
+	}
+	stored.Status = export.Status
+	stored.Size = export.Size
+	stored.ExpiresAt = export.ExpiresAt
+	stored.UpdatedAt = time.Now()
+	saveRow(ms.undo, &ms.mu, ms.exports, export.ID)
+	ms.exports[export.ID] = stored
+	return nil
+}
+
+func (ms *MemoryExportStore) GetPendingExports(_ context.Context) ([]Export, error) {
+	return ms.filter(func(export Export) bool {
+		return export.Status == ExportPending
+	}), nil
+}
+
+func (ms *MemoryExportStore) GetExpiredExports(_ context.Context, now time.Time) ([]Export, error) {
+	return ms.filter(func(export Export) bool {
+		return export.ExpiresAt.Before(now)
+	}), nil
+}
+
+func (ms *MemoryExportStore) GetExportsForUser(_ context.Context, userId uuid.UUID) ([]Export, error) {
+	return ms.filter(func(export Export) bool {
+		return export.UserID == userId
+	}), nil
+}
+
+func (ms *MemoryExportStore) filter(keep func(Export) bool) []Export {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	exports := []Export{}
+	for _, export := range ms.exports {
+		if keep(export) {
+			exports = append(exports, export)
+		}
+	}
+	slices.SortFunc(exports, func(a, b Export) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return exports
+}
+
+func (ms *MemoryExportStore) DeleteExport(_ context.Context, id uuid.UUID) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	saveRow(ms.undo, &ms.mu, ms.exports, id)
+	delete(ms.exports, id)
+	return nil
+}
+
+func (ms *MemoryExportStore) deleteForUser(userId uuid.UUID) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for id, export := range ms.exports {
+		if export.UserID == userId {
+			saveRow(ms.undo, &ms.mu, ms.exports, id)
+			delete(ms.exports, id)
+		}
+	}
+}
+
+func (ms *MemoryExportStore) withUndo(undo *undoLog) *MemoryExportStore {
+	return &MemoryExportStore{memoryExports: ms.memoryExports, undo: undo}
+}
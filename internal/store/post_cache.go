@@ -0,0 +1,255 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"time"
+	"todoapp/internal/cache"
+	"todoapp/internal/logging"
+	"todoapp/internal/metrics"
+
+	"github.com/google/uuid"
+	"golang.org/x/sync/singleflight"
+)
+
+const postListKey = "posts:all"
+
+func postKey(id uuid.UUID) string {
+	return "posts:" + id.String()
+}
+
+// CachedPostStore caches the public post reads, the listing and single
+// posts, in front of another PostStore. Writes through it invalidate what
+// they touched. Concurrent misses of a key share one query, and misses are
+// filled from the primary so a lagging replica never ends up in the cache.
+//
+// A read that misses while a write commits can still cache the old value,
+// the ttl bounds how long it is served. Reads with a context pinned to the
+// primary skip the cache, they must see the latest commit.
+type CachedPostStore struct {
+	PostStore
+	cache cache.Cache
+	ttl   time.Duration
+	group singleflight.Group
+}
+
+func NewCachedPostStore(posts PostStore, cache cache.Cache, ttl time.Duration) *CachedPostStore {
+	return &CachedPostStore{
+		PostStore: posts,
+		cache:     cache,
+		ttl:       ttl,
+	}
+}
+
+func (cs *CachedPostStore) GetAllPosts(ctx context.Context) ([]Post, error) {
+	if isPinned(ctx) {
+		return cs.PostStore.GetAllPosts(ctx)
+	}
+	posts := []Post{}
+	err := cs.load(ctx, postListKey, &posts, func(ctx context.Context) (any, error) {
+		return cs.PostStore.GetAllPosts(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
+
+func (cs *CachedPostStore) GetPostByID(ctx context.Context, id uuid.UUID) (*Post, error) {
+	if isPinned(ctx) {
+		return cs.PostStore.GetPostByID(ctx, id)
+	}
+	var post Post
+	err := cs.load(ctx, postKey(id), &post, func(ctx context.Context) (any, error) {
+		return cs.PostStore.GetPostByID(ctx, id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &post, nil
+}
+
+// load decodes key from the cache into value, fetching and caching it on a
+// miss. Cache failures are logged and treated as misses, the database is the
+// source of truth.
+func (cs *CachedPostStore) load(ctx context.Context, key string, value any, fetch func(context.Context) (any, error)) error {
+	logger := logging.FromRequestContext(ctx)
+	data, ok, err := cs.cache.Get(ctx, key)
+	if err != nil {
+		logger.Warn("post cache get failed", "key", key, "error", err)
+	}
+	if ok {
+		err = gob.NewDecoder(bytes.NewReader(data)).Decode(value)
+		if err == nil {
+			metrics.PostCacheRequests.WithLabelValues("hit").Inc()
+			return nil
+		}
+		logger.Warn("post cache entry unreadable", "key", key, "error", err)
+	}
+	metrics.PostCacheRequests.WithLabelValues("miss").Inc()
+
+	// the shared query must not fail because the caller that started it
+	// went away, the query timeout still bounds it
+	fillCtx := PinPrimary(context.WithoutCancel(ctx))
+	result := cs.group.DoChan(key, func() (any, error) {
+		fetched, err := fetch(fillCtx)
+		if err != nil {
+			return nil, err
+		}
+		var buffer bytes.Buffer
+		err = gob.NewEncoder(&buffer).Encode(fetched)
+		if err != nil {
+			return nil, err
+		}
+		err = cs.cache.Set(fillCtx, key, buffer.Bytes(), cs.ttl)
+		if err != nil {
+			logger.Warn("post cache set failed", "key", key, "error", err)
+		}
+		return buffer.Bytes(), nil
+	})
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case shared := <-result:
+		if shared.Err != nil {
+			return shared.Err
+		}
+		// every caller decodes its own copy
+		return gob.NewDecoder(bytes.NewReader(shared.Val.([]byte))).Decode(value)
+	}
+}
+
+func (cs *CachedPostStore) CreatePost(ctx context.Context, post *Post) error {
+	err := cs.PostStore.CreatePost(ctx, post)
+	if err != nil {
+		return err
+	}
+	cs.invalidate(ctx, postListKey)
+	return nil
+}
+
+func (cs *CachedPostStore) UpdatePost(ctx context.Context, post *Post, version time.Time) error {
+	err := cs.PostStore.UpdatePost(ctx, post, version)
+	if err != nil {
+		return err
+	}
+	cs.invalidate(ctx, postListKey, postKey(post.ID))
+	return nil
+}
+
+func (cs *CachedPostStore) DeletePost(ctx context.Context, id uuid.UUID, userId uuid.UUID) error {
+	err := cs.PostStore.DeletePost(ctx, id, userId)
+	if err != nil {
+		return err
+	}
+	cs.invalidate(ctx, postListKey, postKey(id))
+	return nil
+}
+
+func (cs *CachedPostStore) DeletePostsForUser(ctx context.Context, userId uuid.UUID) error {
+	keys, err := userPostKeys(ctx, cs.PostStore, userId)
+	if err != nil {
+		return err
+	}
+	err = cs.PostStore.DeletePostsForUser(ctx, userId)
+	if err != nil {
+		return err
+	}
+	cs.invalidate(ctx, keys...)
+	return nil
+}
+
+func (cs *CachedPostStore) RestorePost(ctx context.Context, id uuid.UUID, userId uuid.UUID) error {
+	err := cs.PostStore.RestorePost(ctx, id, userId)
+	if err != nil {
+		return err
+	}
+	cs.invalidate(ctx, postListKey, postKey(id))
+	return nil
+}
+
+func userPostKeys(ctx context.Context, posts PostStore, userId uuid.UUID) ([]string, error) {
+	userPosts, err := posts.GetPostsForUser(PinPrimary(ctx), userId)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{postListKey}
+	for _, post := range userPosts {
+		keys = append(keys, postKey(post.ID))
+	}
+	return keys, nil
+}
+
+// invalidate runs after the write succeeded, so a failure only leaves stale
+// entries until they expire.
+func (cs *CachedPostStore) invalidate(ctx context.Context, keys ...string) {
+	err := cs.cache.Delete(context.WithoutCancel(ctx), keys...)
+	if err != nil {
+		logging.FromRequestContext(ctx).Error("post cache invalidation failed", "keys", keys, "error", err)
+	}
+}
+
+// Transactor wraps inner so post writes made inside a transaction
+// invalidate the cache once it committed, a rolled back write changed
+// nothing.
+func (cs *CachedPostStore) Transactor(inner Transactor) Transactor {
+	return &cachingTransactor{inner: inner, cache: cs}
+}
+
+type cachingTransactor struct {
+	inner Transactor
+	cache *CachedPostStore
+}
+
+func (ct *cachingTransactor) WithinTransaction(ctx context.Context, fn func(Stores) error) error {
+	posts := &txPostStore{}
+	err := ct.inner.WithinTransaction(ctx, func(stores Stores) error {
+		posts.PostStore = stores.Posts
+		stores.Posts = posts
+		return fn(stores)
+	})
+	if err != nil {
+		return err
+	}
+	if len(posts.keys) > 0 {
+		ct.cache.invalidate(ctx, posts.keys...)
+	}
+	return nil
+}
+
+// txPostStore records the cache keys written inside a transaction, reads go
+// straight to the transaction.
+type txPostStore struct {
+	PostStore
+	keys []string
+}
+
+func (ts *txPostStore) CreatePost(ctx context.Context, post *Post) error {
+	ts.keys = append(ts.keys, postListKey)
+	return ts.PostStore.CreatePost(ctx, post)
+}
+
+func (ts *txPostStore) UpdatePost(ctx context.Context, post *Post, version time.Time) error {
+	ts.keys = append(ts.keys, postListKey, postKey(post.ID))
+	return ts.PostStore.UpdatePost(ctx, post, version)
+}
+
+func (ts *txPostStore) DeletePost(ctx context.Context, id uuid.UUID, userId uuid.UUID) error {
+	ts.keys = append(ts.keys, postListKey, postKey(id))
+	return ts.PostStore.DeletePost(ctx, id, userId)
+}
+
+func (ts *txPostStore) RestorePost(ctx context.Context, id uuid.UUID, userId uuid.UUID) error {
+	ts.keys = append(ts.keys, postListKey, postKey(id))
+	return ts.PostStore.RestorePost(ctx, id, userId)
+}
+
+func (ts *txPostStore) DeletePostsForUser(ctx context.Context, userId uuid.UUID) error {
+	keys, err := userPostKeys(ctx, ts.PostStore, userId)
+	if err != nil {
+		return err
+	}
+	ts.keys = append(ts.keys, keys...)
+	return ts.PostStore.DeletePostsForUser(ctx, userId)
+}
@@ -0,0 +1,260 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"todoapp/internal/cache"
+
+	"github.com/google/uuid"
+)
+
+type cacheTest struct {
+	ctx    context.Context
+	stores *MemoryStores
+	cache  *cache.MemoryCache
+	posts  *CachedPostStore
+	userID uuid.UUID
+}
+
+func newCacheTest() *cacheTest {
+	stores := NewMemoryStores()
+	memoryCache := cache.NewMemoryCache(100)
+	return &cacheTest{
+		ctx:    context.Background(),
+		stores: stores,
+		cache:  memoryCache,
+		posts:  NewCachedPostStore(stores.Posts, memoryCache, time.Minute),
+		userID: uuid.New(),
+	}
+}
+
+// warm reads the listing and post through the cache so both are cached.
+func (ct *cacheTest) warm(t *testing.T, post *Post) {
+	t.Helper()
+	_, err := ct.posts.GetAllPosts(ct.ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ct.posts.GetPostByID(ct.ctx, post.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{postListKey, postKey(post.ID)} {
+		if !ct.cached(key) {
+			t.Fatalf("%v is not cached after reading it", key)
+		}
+	}
+}
+
+func (ct *cacheTest) cached(key string) bool {
+	_, ok, _ := ct.cache.Get(ct.ctx, key)
+	return ok
+}
+
+func TestCachedPostStoreInvalidation(t *testing.T) {
+	tests := []struct {
+		name string
+		// prepare changes the store behind the cache's back before write
+		prepare func(ct *cacheTest, post *Post) error
+		write   func(ct *cacheTest, post *Post) error
+		// cleared are the keys the write has to drop, the post's key is
+		// passed as "post"
+		cleared []string
+	}{
+		{
+			name: "create",
+			write: func(ct *cacheTest, post *Post) error {
+				return ct.posts.CreatePost(ct.ctx, &Post{UserID: ct.userID, Title: "another"})
+			},
+			cleared: []string{postListKey},
+		},
+		{
+			name: "update",
+			write: func(ct *cacheTest, post *Post) error {
+				update := &Post{ID: post.ID, UserID: ct.userID, Title: "updated", Content: "updated"}
+				return ct.posts.UpdatePost(ct.ctx, update, post.UpdatedAt)
+			},
+			cleared: []string{postListKey, "post"},
+		},
+		{
+			name: "delete",
+			write: func(ct *cacheTest, post *Post) error {
+				return ct.posts.DeletePost(ct.ctx, post.ID, ct.userID)
+			},
+			cleared: []string{postListKey, "post"},
+		},
+		{
+			name: "restore",
+			prepare: func(ct *cacheTest, post *Post) error {
+				return ct.stores.Posts.DeletePost(ct.ctx, post.ID, ct.userID)
+			},
+			write: func(ct *cacheTest, post *Post) error {
+				return ct.posts.RestorePost(ct.ctx, post.ID, ct.userID)
+			},
+			cleared: []string{postListKey, "post"},
+		},
+		{
+			name: "delete for user",
+			write: func(ct *cacheTest, post *Post) error {
+				return ct.posts.DeletePostsForUser(ct.ctx, ct.userID)
+			},
+			cleared: []string{postListKey, "post"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ct := newCacheTest()
+			post := createTestPost(t, ct.stores.Posts, ct.userID, "content")
+			other := createTestPost(t, ct.stores.Posts, uuid.New(), "other")
+			ct.warm(t, post)
+			ct.warm(t, other)
+			if test.prepare != nil {
+				err := test.prepare(ct, post)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := test.write(ct, post)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range test.cleared {
+				if key == "post" {
+					key = postKey(post.ID)
+				}
+				if ct.cached(key) {
+					t.Errorf("%v is still cached", key)
+				}
+			}
+			if !ct.cached(postKey(other.ID)) {
+				t.Error("the post of another user was dropped from the cache")
+			}
+		})
+	}
+}
+
+func TestCachedPostStoreServesCached(t *testing.T) {
+	ct := newCacheTest()
+	post := createTestPost(t, ct.stores.Posts, ct.userID, "content")
+	ct.warm(t, post)
+	// a write that bypasses the cache stays invisible until invalidation,
+	// except to reads pinned to the primary
+	update := &Post{ID: post.ID, UserID: ct.userID, Title: "bypassed", Content: "bypassed"}
+	err := ct.stores.Posts.UpdatePost(ct.ctx, update, post.UpdatedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := ct.posts.GetPostByID(ct.ctx, post.ID)
+	if err != nil || found.Title != post.Title {
+		t.Errorf("cached read = %v, %v, want the cached title %q", found, err, post.Title)
+	}
+	found, err = ct.posts.GetPostByID(PinPrimary(ct.ctx), post.ID)
+	if err != nil || found.Title != "bypassed" {
+		t.Errorf("pinned read = %v, %v, want the stored title", found, err)
+	}
+}
+
+func TestCachedPostStoreTransactions(t *testing.T) {
+	rollback := errors.New("rollback")
+	tests := []struct {
+		name string
+		err  error
+		// cached is whether the post's entries survive the transaction
+		cached bool
+		title  string
+	}{
+		{"commit", nil, false, "updated"},
+		{"rollback", rollback, true, "title"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ct := newCacheTest()
+			post := createTestPost(t, ct.stores.Posts, ct.userID, "content")
+			ct.warm(t, post)
+			transactor := ct.posts.Transactor(NewMemoryTransactor(ct.stores))
+			err := transactor.WithinTransaction(ct.ctx, func(stores Stores) error {
+				update := &Post{ID: post.ID, UserID: ct.userID, Title: "updated", Content: "updated"}
+				err := stores.Posts.UpdatePost(ct.ctx, update, post.UpdatedAt)
+				if err != nil {
+					return err
+				}
+				// invalidating inside the transaction would let a
+				// concurrent read cache the uncommitted row
+				if !ct.cached(postKey(post.ID)) {
+					t.Error("invalidated before the transaction ended")
+				}
+				return test.err
+			})
+			if !errors.Is(err, test.err) {
+				t.Fatalf("WithinTransaction = %v, want %v", err, test.err)
+			}
+			for _, key := range []string{postListKey, postKey(post.ID)} {
+				if ct.cached(key) != test.cached {
+					t.Errorf("%v cached = %v, want %v", key, ct.cached(key), test.cached)
+				}
+			}
+			found, err := ct.posts.GetPostByID(ct.ctx, post.ID)
+			if err != nil || found.Title != test.title {
+				t.Errorf("read after the transaction = %v, %v, want title %q", found, err, test.title)
+			}
+		})
+	}
+}
+
+// countingPostStore counts listing queries and holds them until release is
+// closed.
+type countingPostStore struct {
+	PostStore
+	calls   atomic.Int32
+	release chan struct{}
+}
+
+func (cs *countingPostStore) GetAllPosts(ctx context.Context) ([]Post, error) {
+	cs.calls.Add(1)
+	<-cs.release
+	return cs.PostStore.GetAllPosts(ctx)
+}
+
+func TestCachedPostStoreCollapsesMisses(t *testing.T) {
+	ctx := context.Background()
+	stores := NewMemoryStores()
+	createTestPost(t, stores.Posts, uuid.New(), "content")
+	counting := &countingPostStore{PostStore: stores.Posts, release: make(chan struct{})}
+	posts := NewCachedPostStore(counting, cache.NewMemoryCache(100), time.Minute)
+
+	const readers = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, readers)
+	for range readers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			found, err := posts.GetAllPosts(ctx)
+			if err == nil && len(found) != 1 {
+				err = errors.New("wrong number of posts")
+			}
+			errs <- err
+		}()
+	}
+	// let every reader miss and join the query before it returns
+	time.Sleep(50 * time.Millisecond)
+	close(counting.release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if got := counting.calls.Load(); got != 1 {
+		t.Errorf("%v concurrent misses ran %v queries, want 1", readers, got)
+	}
+	posts.GetAllPosts(ctx)
+	if got := counting.calls.Load(); got != 1 {
+		t.Errorf("a read after the fill ran a query, %v in total", got)
+	}
+}
@@ -1,65 +1,255 @@
 package store
 
 import (
+	"context"
+	"regexp"
+	"slices"
 	"time"
 
 	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type Post struct {
-	ID        uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();" json:"id"`
+	ID        uuid.UUID `gorm:"type:uuid;" json:"id"`
 	UserID    uuid.UUID `gorm:"not null;" json:"-"`
 	User      User      `gorm:"constraint:OnDelete:CASCADE;" json:"-"`
 	Title     string    `json:"title"`
 	Content   string    `json:"content"`
 	CreatedAt time.Time `json:"-"`
 	UpdatedAt time.Time `json:"-"`
+	// Slug and Tags come from imported posts, the slug identifies a post
+	// of its author across imports.
+	Slug string   `gorm:"index;" json:"slug,omitempty"`
+	Tags []string `gorm:"type:text;serializer:json;" json:"tags,omitempty"`
+	// DeletedAt puts the post in its author's trash, hidden from every
+	// query but the trash ones until it is restored or purged.
+	DeletedAt gorm.DeletedAt `gorm:"index;" json:"-"`
+}
+
+func (post *Post) BeforeCreate(*gorm.DB) error {
+	assignID(&post.ID)
+	return nil
+}
+
+// PostImage records that a post links a blob, directly or through one of its
+// variants. It lets the garbage collector look references up by key instead
+// of searching the content of every post.
+type PostImage struct {
+	PostID uuid.UUID `gorm:"type:uuid;primaryKey;"`
+	Post   Post      `gorm:"constraint:OnDelete:CASCADE;"`
+	Key    string    `gorm:"type:varchar(64);primaryKey;index;"`
+}
+
+// blobKey matches the content hashes uploads are stored under, which is
+// all image links and their variants have in common.
+var blobKey = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// imageKeys lists the blob keys content links, each once.
+func imageKeys(content string) []string {
+	keys := blobKey.FindAllString(content, -1)
+	slices.Sort(keys)
+	return slices.Compact(keys)
+}
+
+// saveImageKeys replaces the references of the post. The blob rows are
+// share locked so the garbage collector, which locks them for update,
+// can't delete a blob between this check and the commit.
+func saveImageKeys(tx *gorm.DB, post *Post) error {
+	result := tx.Where("post_id = ?", post.ID).Delete(&PostImage{})
+	if result.Error != nil {
+		return result.Error
+	}
+	keys := imageKeys(post.Content)
+	if len(keys) == 0 {
+		return nil
+	}
+	var locked []string
+	result = tx.Clauses(clause.Locking{Strength: "SHARE"}).Model(&Blob{}).Where("key IN ?", keys).Pluck("key", &locked)
+	if result.Error != nil {
+		return result.Error
+	}
+	refs := make([]PostImage, 0, len(keys))
+	for _, key := range keys {
+		refs = append(refs, PostImage{PostID: post.ID, Key: key})
+	}
+	return tx.Omit(clause.Associations).Create(&refs).Error
+}
+
+// backfillImageKeys fills a newly created post_images table from the posts
+// written before it existed.
+func backfillImageKeys(db *gorm.DB) error {
+	posts := []Post{}
+	return db.Unscoped().Select("id", "content").FindInBatches(&posts, 500, func(tx *gorm.DB, _ int) error {
+		for _, post := range posts {
+			err := saveImageKeys(db, &post)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
 }
 
 type PostgresPostStore struct {
 	db *gorm.DB
+	// replicas serves the read-only methods, nil reads from db
+	replicas *ReplicaRouter
 }
 
-func NewPostgresPostStore(db *gorm.DB) *PostgresPostStore {
-	err := db.AutoMigrate(&Post{})
+func NewPostgresPostStore(db *gorm.DB, replicas *ReplicaRouter) *PostgresPostStore {
+	backfill := !db.Migrator().HasTable(&PostImage{})
+	err := db.AutoMigrate(&Post{}, &Blob{}, &PostImage{})
 	if err != nil {
 		panic(err)
 	}
+	if backfill {
+		err = backfillImageKeys(db)
+		if err != nil {
+			panic(err)
+		}
+	}
 	return &PostgresPostStore{
-		db: db,
+		db:       db,
+		replicas: replicas,
 	}
 }
 
 type PostStore interface {
-	CreatePost(*Post) error
-	GetAllPosts() ([]Post, error)
-	GetPostByID(uuid.UUID) (*Post, error)
+	CreatePost(context.Context, *Post) error
+	GetAllPosts(context.Context) ([]Post, error)
+	GetPostByID(context.Context, uuid.UUID) (*Post, error)
+	GetPostsForUser(context.Context, uuid.UUID) ([]Post, error)
+	// GetPostBySlug finds a post of the user by slug, ErrNotFound when
+	// there is none.
+	GetPostBySlug(ctx context.Context, userId uuid.UUID, slug string) (*Post, error)
+	// UpdatePost saves the title and content of a post owned by
+	// post.UserID, ErrNotFound when there is none and ErrConflict when it
+	// was updated after version, the UpdatedAt the caller read.
+	UpdatePost(ctx context.Context, post *Post, version time.Time) error
+	// DeletePost moves a post owned by the user to the trash, ErrNotFound
+	// when there is none.
+	DeletePost(ctx context.Context, id uuid.UUID, userId uuid.UUID) error
+	DeletePostsForUser(context.Context, uuid.UUID) error
+	GetDeletedPostsForUser(context.Context, uuid.UUID) ([]Post, error)
+	// RestorePost takes a post of the user out of the trash, ErrNotFound
+	// when it is not in there.
+	RestorePost(ctx context.Context, id uuid.UUID, userId uuid.UUID) error
+	PurgePostsDeletedBefore(context.Context, time.Time) (int64, error)
+	PurgePostsForUser(context.Context, uuid.UUID) error
 }
 
-func (pg *PostgresPostStore) CreatePost(post *Post) error {
-	result := pg.db.Create(post)
+func (pg *PostgresPostStore) CreatePost(ctx context.Context, post *Post) error {
+	return pg.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Create(post)
+		if result.Error != nil {
+			return result.Error
+		}
+		return saveImageKeys(tx, post)
+	})
+}
+
+func (pg *PostgresPostStore) GetAllPosts(ctx context.Context) ([]Post, error) {
+	var posts []Post
+	result := pg.replicas.Reader(ctx, pg.db).WithContext(ctx).Select("id", "title").Find(&posts)
 	if result.Error != nil {
-		return result.Error
+		return nil, result.Error
 	}
-	return nil
+	return posts, nil
 }
 
-func (pg *PostgresPostStore) GetAllPosts() ([]Post, error) {
+func (pg *PostgresPostStore) GetPostByID(ctx context.Context, id uuid.UUID) (*Post, error) {
+	var post Post
+	result := pg.replicas.Reader(ctx, pg.db).WithContext(ctx).First(&post, id)
+	if result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+	return &post, nil
+}
+
+func (pg *PostgresPostStore) GetPostsForUser(ctx context.Context, userId uuid.UUID) ([]Post, error) {
 	var posts []Post
-	result := pg.db.Select("id", "title").Find(&posts)
+	result := pg.replicas.Reader(ctx, pg.db).WithContext(ctx).Where("user_id = ?", userId).Find(&posts)
 	if result.Error != nil {
 		return nil, result.Error
 	}
 	return posts, nil
 }
 
-func (pg *PostgresPostStore) GetPostByID(id uuid.UUID) (*Post, error) {
+func (pg *PostgresPostStore) GetPostBySlug(ctx context.Context, userId uuid.UUID, slug string) (*Post, error) {
 	var post Post
-	result := pg.db.First(&post, id)
+	result := pg.db.WithContext(ctx).Where("user_id = ? AND slug = ?", userId, slug).First(&post)
 	if result.Error != nil {
-		return nil, result.Error
+		return nil, translateError(result.Error)
 	}
 	return &post, nil
 }
 
+func (pg *PostgresPostStore) UpdatePost(ctx context.Context, post *Post, version time.Time) error {
+	return pg.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// lock the row so a concurrent edit waits and then sees the new
+		// version instead of both passing the check
+		var current Post
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ? AND user_id = ?", post.ID, post.UserID).First(&current).Error
+		if err != nil {
+			return translateError(err)
+		}
+		if !current.UpdatedAt.Equal(version) {
+			return ErrConflict
+		}
+		post.CreatedAt = current.CreatedAt
+		err = tx.Model(post).Select("title", "content").Updates(post).Error
+		if err != nil {
+			return err
+		}
+		return saveImageKeys(tx, post)
+	})
+}
+
+func (pg *PostgresPostStore) DeletePost(ctx context.Context, id uuid.UUID, userId uuid.UUID) error {
+	result := pg.db.WithContext(ctx).Where("id = ? AND user_id = ?", id, userId).Delete(&Post{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (pg *PostgresPostStore) DeletePostsForUser(ctx context.Context, userId uuid.UUID) error {
+	return pg.db.WithContext(ctx).Where("user_id = ?", userId).Delete(&Post{}).Error
+}
+
+func (pg *PostgresPostStore) GetDeletedPostsForUser(ctx context.Context, userId uuid.UUID) ([]Post, error) {
+	var posts []Post
+	result := pg.db.WithContext(ctx).Unscoped().Where("user_id = ? AND deleted_at IS NOT NULL", userId).Order("deleted_at DESC").Find(&posts)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return posts, nil
+}
+
+func (pg *PostgresPostStore) RestorePost(ctx context.Context, id uuid.UUID, userId uuid.UUID) error {
+	result := pg.db.WithContext(ctx).Unscoped().Model(&Post{}).Where("id = ? AND user_id = ? AND deleted_at IS NOT NULL", id, userId).Update("deleted_at", nil)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (pg *PostgresPostStore) PurgePostsDeletedBefore(ctx context.Context, before time.Time) (int64, error) {
+	result := pg.db.WithContext(ctx).Unscoped().Where("deleted_at < ?", before).Delete(&Post{})
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	return result.RowsAffected, nil
+}
+
+func (pg *PostgresPostStore) PurgePostsForUser(ctx context.Context, userId uuid.UUID) error {
+	return pg.db.WithContext(ctx).Unscoped().Where("user_id = ?", userId).Delete(&Post{}).Error
+}
@@ -0,0 +1,132 @@
+package store
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"todoapp/internal/metrics"
+
+	"gorm.io/gorm"
+)
+
+type primaryKey struct{}
+
+// PinPrimary marks ctx so reads made with it go to the primary, past
+// replicas and caches, used right after a client wrote so it does not read a
+// lagging copy.
+func PinPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
+
+func isPinned(ctx context.Context) bool {
+	pinned, _ := ctx.Value(primaryKey{}).(bool)
+	return pinned
+}
+
+type replica struct {
+	name    string
+	db      *gorm.DB
+	healthy atomic.Bool
+	checked bool
+}
+
+// ReplicaRouter spreads read-only queries round robin over the replicas
+// that passed their last health check. Reads fall back to the primary when
+// no replica is healthy or the context is pinned. A nil router always picks
+// the primary.
+type ReplicaRouter struct {
+	replicas []*replica
+	next     atomic.Uint64
+	logger   *slog.Logger
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewReplicaRouter starts with every replica out of rotation until Start
+// checked them.
+func NewReplicaRouter(replicas []*gorm.DB, logger *slog.Logger) *ReplicaRouter {
+	router := &ReplicaRouter{
+		logger: logger,
+		stop:   make(chan struct{}),
+	}
+	for i, db := range replicas {
+		r := &replica{name: "replica-" + strconv.Itoa(i), db: db}
+		metrics.ReplicaHealthy.WithLabelValues(r.name).Set(0)
+		router.replicas = append(router.replicas, r)
+	}
+	return router
+}
+
+// Reader returns the database a read-only query with ctx runs on.
+func (rr *ReplicaRouter) Reader(ctx context.Context, primary *gorm.DB) *gorm.DB {
+	if rr == nil || len(rr.replicas) == 0 || isPinned(ctx) {
+		return primary
+	}
+	start := rr.next.Add(1)
+	for i := range len(rr.replicas) {
+		r := rr.replicas[(start+uint64(i))%uint64(len(rr.replicas))]
+		if r.healthy.Load() {
+			return r.db
+		}
+	}
+	return primary
+}
+
+// Check pings every replica once, bounded by timeout, and records which
+// ones answered.
+func (rr *ReplicaRouter) Check(ctx context.Context, timeout time.Duration) {
+	for _, r := range rr.replicas {
+		err := ping(ctx, r.db, timeout)
+		healthy := err == nil
+		changed := r.healthy.Swap(healthy) != healthy
+		if healthy && changed {
+			rr.logger.Info("replica in rotation", "replica", r.name)
+		}
+		if !healthy && (changed || !r.checked) {
+			rr.logger.Warn("replica out of rotation", "replica", r.name, "error", err)
+		}
+		r.checked = true
+		value := 0.0
+		if healthy {
+			value = 1
+		}
+		metrics.ReplicaHealthy.WithLabelValues(r.name).Set(value)
+	}
+}
+
+func ping(ctx context.Context, db *gorm.DB, timeout time.Duration) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return sqlDB.PingContext(ctx)
+}
+
+// Start checks the replicas right away and then every interval until Stop.
+func (rr *ReplicaRouter) Start(interval time.Duration) {
+	rr.Check(context.Background(), interval)
+	rr.wg.Add(1)
+	go func() {
+		defer rr.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-rr.stop:
+				return
+			case <-ticker.C:
+				rr.Check(context.Background(), interval)
+			}
+		}
+	}()
+}
+
+func (rr *ReplicaRouter) Stop() {
+	close(rr.stop)
+	rr.wg.Wait()
+}
@@ -0,0 +1,116 @@
+package store
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func openTestSqlite(t *testing.T, name string) *gorm.DB {
+	t.Helper()
+	db, err := Open(slog.New(slog.NewTextHandler(io.Discard, nil)), DatabaseConfig{
+		Driver: "sqlite",
+		DSN:    filepath.Join(t.TempDir(), name),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	return db
+}
+
+// TestReplicaRouter runs on two sqlite databases that hold different titles
+// for the same post, the title read tells which database answered.
+func TestReplicaRouter(t *testing.T) {
+	ctx := context.Background()
+	primary := openTestSqlite(t, "primary.db")
+	replica := openTestSqlite(t, "replica.db")
+	router := NewReplicaRouter([]*gorm.DB{replica}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	users := NewPostgresUserStore(primary, router)
+	posts := NewPostgresPostStore(primary, router)
+	NewPostgresPostStore(replica, nil)
+
+	user := &User{Username: "replicauser", Email: "replicauser@example.com", PasswordHash: "hash"}
+	err := users.CreateUser(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := &Post{UserID: user.ID, Title: "primary", Content: "content"}
+	err = posts.CreatePost(ctx, post)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replica.Create(user).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replica.Create(&Post{ID: post.ID, UserID: user.ID, Title: "replica", Content: "content"}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readTitle := func(ctx context.Context) string {
+		t.Helper()
+		found, err := posts.GetPostByID(ctx, post.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return found.Title
+	}
+	if got := readTitle(ctx); got != "primary" {
+		t.Errorf("read before the first check went to the %v, want the primary", got)
+	}
+	router.Check(ctx, time.Second)
+	if got := readTitle(ctx); got != "replica" {
+		t.Errorf("read went to the %v, want the replica", got)
+	}
+	if got := readTitle(PinPrimary(ctx)); got != "primary" {
+		t.Errorf("pinned read went to the %v, want the primary", got)
+	}
+
+	// writes go to the primary even when the replica is in rotation
+	written := &Post{UserID: user.ID, Title: "written", Content: "content"}
+	err = posts.CreatePost(ctx, written)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	primary.Model(&Post{}).Where("id = ?", written.ID).Count(&count)
+	if count != 1 {
+		t.Errorf("primary has %v copies of the written post, want 1", count)
+	}
+	replica.Model(&Post{}).Where("id = ?", written.ID).Count(&count)
+	if count != 0 {
+		t.Errorf("replica has %v copies of the written post, want 0", count)
+	}
+
+	// a replica that stops answering is taken out of rotation
+	sqlDB, err := replica.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.Close()
+	router.Check(ctx, time.Second)
+	if got := readTitle(ctx); got != "primary" {
+		t.Errorf("read with the replica down went to the %v, want the primary", got)
+	}
+
+	// without replicas configured everything runs on the primary
+	direct := NewPostgresPostStore(primary, nil)
+	found, err := direct.GetPostByID(ctx, post.ID)
+	if err != nil || found.Title != "primary" {
+		t.Errorf("read without a router = %v, %v, want the primary's post", found, err)
+	}
+	if got := NewReplicaRouter(nil, nil).Reader(ctx, primary); got != primary {
+		t.Error("a router without replicas did not pick the primary")
+	}
+}
@@ -0,0 +1,629 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// testStores is one backend's stores, every backend has to pass the same
+// tests.
+type testStores struct {
+	Stores
+	Exports    ExportStore
+	Transactor Transactor
+}
+
+func memoryTestStores(t *testing.T) testStores {
+	stores := NewMemoryStores()
+	return testStores{
+		Stores: Stores{
+			Users:   stores.Users,
+			Tokens:  stores.Tokens,
+			Posts:   stores.Posts,
+			Images:  stores.Images,
+			Uploads: stores.Uploads,
+		},
+		Exports:    stores.Exports,
+		Transactor: NewMemoryTransactor(stores),
+	}
+}
+
+func sqliteTestStores(t *testing.T) testStores {
+	db, err := Open(slog.New(slog.NewTextHandler(io.Discard, nil)), DatabaseConfig{
+		Driver: "sqlite",
+		DSN:    filepath.Join(t.TempDir(), "test.db"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	return testStores{
+		Stores: Stores{
+			Users:   NewPostgresUserStore(db, nil),
+			Tokens:  NewPostgresTokenStore(db),
+			Posts:   NewPostgresPostStore(db, nil),
+			Images:  NewPostgresImageStore(db),
+			Uploads: NewPostgresUploadStore(db),
+		},
+		Exports:    NewPostgresExportStore(db),
+		Transactor: NewPostgresTransactor(db),
+	}
+}
+
+func TestStores(t *testing.T) {
+	backends := []struct {
+		name string
+		open func(*testing.T) testStores
+	}{
+		{"memory", memoryTestStores},
+		{"sqlite", sqliteTestStores},
+	}
+	tests := []struct {
+		name string
+		run  func(*testing.T, testStores)
+	}{
+		{"users", testUsers},
+		{"purge user", testPurgeUser},
+		{"tokens", testTokens},
+		{"posts", testPosts},
+		{"images", testImages},
+		{"uploads", testUploads},
+		{"exports", testExports},
+		{"transactions", testTransactions},
+	}
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			for _, test := range tests {
+				t.Run(test.name, func(t *testing.T) {
+					test.run(t, backend.open(t))
+				})
+			}
+		})
+	}
+}
+
+func createTestUser(t *testing.T, s testStores) *User {
+	t.Helper()
+	user := &User{
+		Username:     "user_" + uuid.NewString()[:8],
+		Email:        "user@example.com",
+		PasswordHash: "hash",
+	}
+	err := s.Users.CreateUser(context.Background(), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func createTestPost(t *testing.T, s PostStore, userId uuid.UUID, content string) *Post {
+	t.Helper()
+	post := &Post{UserID: userId, Title: "title", Content: content}
+	err := s.CreatePost(context.Background(), post)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return post
+}
+
+func testKey(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func wantErr(t *testing.T, what string, err error, want error) {
+	t.Helper()
+	if !errors.Is(err, want) {
+		t.Errorf("%v = %v, want %v", what, err, want)
+	}
+}
+
+func wantLen[T any](t *testing.T, what string, rows []T, err error, want int) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%v: %v", what, err)
+	}
+	if len(rows) != want {
+		t.Errorf("%v has %v rows, want %v", what, len(rows), want)
+	}
+}
+
+func testUsers(t *testing.T, s testStores) {
+	ctx := context.Background()
+	user := createTestUser(t, s)
+	err := s.Users.CreateUser(ctx, &User{Username: user.Username, Email: "other@example.com", PasswordHash: "hash"})
+	wantErr(t, "creating a taken username", err, ErrConflict)
+
+	found, err := s.Users.GetUserByUsername(ctx, user.Username)
+	if err != nil || found.ID != user.ID {
+		t.Fatalf("get by username = %v, %v", found, err)
+	}
+	err = s.Users.DeleteUser(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Users.GetUserByID(ctx, user.ID)
+	wantErr(t, "get of a deleted user", err, ErrNotFound)
+	exists, err := s.Users.DoesUsernameExist(ctx, user.Username)
+	if err != nil || !exists {
+		t.Errorf("username of a deleted user exists = %v, %v, want it taken", exists, err)
+	}
+	deleted, err := s.Users.GetUsersDeletedBefore(ctx, time.Now().Add(time.Second))
+	wantLen(t, "deleted users", deleted, err, 1)
+	_, err = s.Users.GetDeletedUserByUsername(ctx, user.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Users.RestoreUser(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Users.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Users.RestoreUser(ctx, user.ID)
+	wantErr(t, "restoring an active user", err, ErrNotFound)
+	err = s.Users.PurgeUser(ctx, uuid.New())
+	wantErr(t, "purging a missing user", err, ErrNotFound)
+}
+
+// testPurgeUser checks purging takes every row of the user with it, like the
+// foreign keys cascade in postgres.
+func testPurgeUser(t *testing.T, s testStores) {
+	ctx := context.Background()
+	user := createTestUser(t, s)
+	other := createTestUser(t, s)
+	_, err := s.Tokens.CreateToken(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := testKey("purge")
+	createTestPost(t, s.Posts, user.ID, "![](/static/images/"+key+")")
+	trashed := createTestPost(t, s.Posts, user.ID, "trashed")
+	err = s.Posts.DeletePost(ctx, trashed.ID, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPost := createTestPost(t, s.Posts, other.ID, "kept")
+	_, err = s.Images.CreateImage(ctx, &Image{UserID: user.ID, Key: key, Size: 10, ContentType: "image/png"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Uploads.CreateUpload(ctx, &Upload{UserID: user.ID, Length: 10, ExpiresAt: time.Now().Add(time.Hour)}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Exports.CreateExport(ctx, &Export{UserID: user.ID, Status: ExportPending, ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Users.PurgeUser(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Users.GetUserByID(ctx, user.ID)
+	wantErr(t, "get of a purged user", err, ErrNotFound)
+	tokens, err := s.Tokens.GetTokensForUser(ctx, user.ID)
+	wantLen(t, "tokens", tokens, err, 0)
+	posts, err := s.Posts.GetPostsForUser(ctx, user.ID)
+	wantLen(t, "posts", posts, err, 0)
+	posts, err = s.Posts.GetDeletedPostsForUser(ctx, user.ID)
+	wantLen(t, "trashed posts", posts, err, 0)
+	images, err := s.Images.GetImagesForUser(ctx, user.ID)
+	wantLen(t, "images", images, err, 0)
+	uploads, err := s.Uploads.GetUploadsForUser(ctx, user.ID)
+	wantLen(t, "uploads", uploads, err, 0)
+	exports, err := s.Exports.GetExportsForUser(ctx, user.ID)
+	wantLen(t, "exports", exports, err, 0)
+	referenced, err := s.Images.IsImageReferenced(ctx, key)
+	if err != nil || referenced {
+		t.Errorf("image of a purged post referenced = %v, %v", referenced, err)
+	}
+	_, err = s.Posts.GetPostByID(ctx, otherPost.ID)
+	if err != nil {
+		t.Errorf("another user's post: %v", err)
+	}
+}
+
+func testTokens(t *testing.T, s testStores) {
+	ctx := context.Background()
+	user := createTestUser(t, s)
+	token, err := s.Tokens.CreateToken(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := s.Tokens.GetTokenBySession(ctx, token.SessionToken.Hash)
+	if err != nil || found.UserID != user.ID {
+		t.Fatalf("get by session = %v, %v", found, err)
+	}
+	if found.SessionToken.PlainText != "" {
+		t.Error("the plain text session token was stored")
+	}
+	count, err := s.Tokens.CountTokensCreatedSince(ctx, time.Now().Add(-time.Minute))
+	if err != nil || count != 1 {
+		t.Errorf("tokens created in the last minute = %v, %v, want 1", count, err)
+	}
+	err = s.Tokens.DeleteAllTokenForUser(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Tokens.GetTokenBySession(ctx, token.SessionToken.Hash)
+	wantErr(t, "get of a deleted token", err, ErrNotFound)
+}
+
+func testPosts(t *testing.T, s testStores) {
+	ctx := context.Background()
+	user := createTestUser(t, s)
+	other := createTestUser(t, s)
+	post := createTestPost(t, s.Posts, user.ID, "content")
+	stored, err := s.Posts.GetPostByID(ctx, post.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := stored.UpdatedAt
+
+	update := &Post{ID: post.ID, UserID: user.ID, Title: "new title", Content: "new content"}
+	err = s.Posts.UpdatePost(ctx, update, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := &Post{ID: post.ID, UserID: user.ID, Title: "stale", Content: "stale"}
+	err = s.Posts.UpdatePost(ctx, stale, version)
+	wantErr(t, "update with a stale version", err, ErrConflict)
+	foreign := &Post{ID: post.ID, UserID: other.ID, Title: "foreign", Content: "foreign"}
+	err = s.Posts.UpdatePost(ctx, foreign, update.UpdatedAt)
+	wantErr(t, "update of another user's post", err, ErrNotFound)
+	stored, err = s.Posts.GetPostByID(ctx, post.ID)
+	if err != nil || stored.Title != "new title" || !stored.UpdatedAt.Equal(update.UpdatedAt) {
+		t.Fatalf("post after update = %+v, %v", stored, err)
+	}
+
+	err = s.Posts.DeletePost(ctx, post.ID, other.ID)
+	wantErr(t, "delete of another user's post", err, ErrNotFound)
+	err = s.Posts.DeletePost(ctx, post.ID, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Posts.GetPostByID(ctx, post.ID)
+	wantErr(t, "get of a trashed post", err, ErrNotFound)
+	posts, err := s.Posts.GetAllPosts(ctx)
+	wantLen(t, "listed posts", posts, err, 0)
+	posts, err = s.Posts.GetDeletedPostsForUser(ctx, user.ID)
+	wantLen(t, "trash", posts, err, 1)
+	err = s.Posts.RestorePost(ctx, post.ID, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	posts, err = s.Posts.GetAllPosts(ctx)
+	wantLen(t, "listed posts after restoring", posts, err, 1)
+
+	err = s.Posts.DeletePost(ctx, post.ID, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := s.Posts.PurgePostsDeletedBefore(ctx, time.Now().Add(-time.Minute))
+	if err != nil || count != 0 {
+		t.Errorf("purging posts trashed a minute ago = %v, %v, want 0", count, err)
+	}
+	count, err = s.Posts.PurgePostsDeletedBefore(ctx, time.Now().Add(time.Second))
+	if err != nil || count != 1 {
+		t.Errorf("purging posts trashed until now = %v, %v, want 1", count, err)
+	}
+	err = s.Posts.RestorePost(ctx, post.ID, user.ID)
+	wantErr(t, "restoring a purged post", err, ErrNotFound)
+
+	imported := &Post{UserID: user.ID, Title: "imported", Content: "content", Slug: "imported", Tags: []string{"a", "b"}}
+	err = s.Posts.CreatePost(ctx, imported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := s.Posts.GetPostBySlug(ctx, user.ID, "imported")
+	if err != nil || found.ID != imported.ID || len(found.Tags) != 2 {
+		t.Errorf("get by slug = %+v, %v", found, err)
+	}
+	_, err = s.Posts.GetPostBySlug(ctx, other.ID, "imported")
+	wantErr(t, "get by another user's slug", err, ErrNotFound)
+}
+
+func testImages(t *testing.T, s testStores) {
+	ctx := context.Background()
+	user := createTestUser(t, s)
+	other := createTestUser(t, s)
+	key := testKey("image")
+
+	image := &Image{UserID: user.ID, Key: key, Size: 100, ContentType: "image/png"}
+	pending, err := s.Images.CreateImage(ctx, image, 150)
+	if err != nil || !pending {
+		t.Fatalf("first upload = %v, %v, want a pending blob", pending, err)
+	}
+	// the first upload has not written the file yet
+	otherImage := &Image{UserID: other.ID, Key: key, Size: 100, ContentType: "image/png"}
+	pending, err = s.Images.CreateImage(ctx, otherImage, 150)
+	if err != nil || !pending {
+		t.Fatalf("concurrent upload = %v, %v, want a pending blob", pending, err)
+	}
+	err = s.Images.MarkBlobWritten(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := s.Images.GetBlob(ctx, key)
+	if err != nil || blob.Pending || blob.RefCount != 2 {
+		t.Fatalf("blob = %+v, %v, want written with 2 references", blob, err)
+	}
+	_, err = s.Images.CreateImage(ctx, &Image{UserID: user.ID, Key: key, Size: 100, ContentType: "image/png"}, 0)
+	wantErr(t, "uploading the same image twice", err, ErrConflict)
+
+	_, err = s.Images.CreateImage(ctx, &Image{UserID: user.ID, Key: testKey("big"), Size: 60, ContentType: "image/png"}, 150)
+	quotaErr := &QuotaExceededError{}
+	if !errors.As(err, &quotaErr) || quotaErr.Used != 100 {
+		t.Errorf("upload over quota = %v, want a QuotaExceededError with 100 used", err)
+	}
+	used, err := s.Images.GetUsageForUser(ctx, user.ID)
+	if err != nil || used != 100 {
+		t.Errorf("usage = %v, %v, want 100", used, err)
+	}
+
+	// a variant link references the image as well
+	post := createTestPost(t, s.Posts, user.ID, "![](/static/images/"+key+"_thumb)")
+	referenced, err := s.Images.IsImageReferenced(ctx, key)
+	if err != nil || !referenced {
+		t.Errorf("referenced = %v, %v, want true", referenced, err)
+	}
+	_, err = s.Images.DeleteImageIfUnreferenced(ctx, image.ID)
+	wantErr(t, "collecting a linked image", err, ErrConflict)
+	err = s.Posts.DeletePost(ctx, post.ID, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Images.DeleteImageIfUnreferenced(ctx, image.ID)
+	wantErr(t, "collecting an image linked from the trash", err, ErrConflict)
+	err = s.Posts.PurgePostsForUser(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, err := s.Images.DeleteImageIfUnreferenced(ctx, image.ID)
+	if err != nil || last {
+		t.Errorf("collecting a shared image = %v, %v, want false, nil", last, err)
+	}
+	last, err = s.Images.DeleteImage(ctx, otherImage.ID)
+	if err != nil || !last {
+		t.Errorf("deleting the last reference = %v, %v, want true, nil", last, err)
+	}
+	_, err = s.Images.GetBlob(ctx, key)
+	wantErr(t, "get of an unreferenced blob", err, ErrNotFound)
+	_, err = s.Images.DeleteImage(ctx, image.ID)
+	wantErr(t, "deleting a deleted image", err, ErrNotFound)
+}
+
+func testUploads(t *testing.T, s testStores) {
+	ctx := context.Background()
+	user := createTestUser(t, s)
+	upload := &Upload{UserID: user.ID, Length: 100, ExpiresAt: time.Now().Add(time.Hour)}
+	err := s.Uploads.CreateUpload(ctx, upload, 150)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// uploads reserve their length, images and other uploads can't use it
+	quotaErr := &QuotaExceededError{}
+	err = s.Uploads.CreateUpload(ctx, &Upload{UserID: user.ID, Length: 100, ExpiresAt: time.Now().Add(time.Hour)}, 150)
+	if !errors.As(err, &quotaErr) || quotaErr.Used != 100 {
+		t.Errorf("upload over quota = %v, want a QuotaExceededError with 100 used", err)
+	}
+	_, err = s.Images.CreateImage(ctx, &Image{UserID: user.ID, Key: testKey("upload"), Size: 60, ContentType: "image/png"}, 150)
+	if !errors.As(err, &quotaErr) {
+		t.Errorf("image over the reserved quota = %v, want a QuotaExceededError", err)
+	}
+	expired := &Upload{UserID: user.ID, Length: 1000, ExpiresAt: time.Now().Add(-time.Minute)}
+	err = s.Uploads.CreateUpload(ctx, expired, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	used, err := s.Images.GetUsageForUser(ctx, user.ID)
+	if err != nil || used != 100 {
+		t.Errorf("usage = %v, %v, want 100 without the expired upload", used, err)
+	}
+	uploads, err := s.Uploads.GetExpiredUploads(ctx, time.Now())
+	wantLen(t, "expired uploads", uploads, err, 1)
+
+	stale := *upload
+	err = s.Uploads.AdvanceUpload(ctx, upload, "chunk_0", 10, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Uploads.AdvanceUpload(ctx, &stale, "chunk_racing", 10, time.Now().Add(time.Hour))
+	wantErr(t, "advancing from a stale offset", err, ErrConflict)
+	err = s.Uploads.AdvanceUpload(ctx, upload, "chunk_10", 20, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := s.Uploads.GetUploadForUser(ctx, upload.ID, user.ID)
+	if err != nil || stored.Offset != 30 || len(stored.Chunks()) != 2 {
+		t.Fatalf("upload = %+v, %v, want 2 chunks up to offset 30", stored, err)
+	}
+	_, err = s.Uploads.GetUploadForUser(ctx, upload.ID, uuid.New())
+	wantErr(t, "get of another user's upload", err, ErrNotFound)
+	err = s.Uploads.DeleteUpload(ctx, upload.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Uploads.GetUploadForUser(ctx, upload.ID, user.ID)
+	wantErr(t, "get of a deleted upload", err, ErrNotFound)
+}
+
+func testExports(t *testing.T, s testStores) {
+	ctx := context.Background()
+	user := createTestUser(t, s)
+	export := &Export{UserID: user.ID, Status: ExportPending, ExpiresAt: time.Now().Add(time.Hour)}
+	err := s.Exports.CreateExport(ctx, export)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exports, err := s.Exports.GetPendingExports(ctx)
+	wantLen(t, "pending exports", exports, err, 1)
+
+	export.Status = ExportReady
+	export.Size = 42
+	export.ExpiresAt = time.Now().Add(-time.Minute)
+	err = s.Exports.UpdateExport(ctx, export)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exports, err = s.Exports.GetPendingExports(ctx)
+	wantLen(t, "pending exports after the update", exports, err, 0)
+	exports, err = s.Exports.GetExpiredExports(ctx, time.Now())
+	wantLen(t, "expired exports", exports, err, 1)
+	stored, err := s.Exports.GetExportForUser(ctx, export.ID, user.ID)
+	if err != nil || stored.Status != ExportReady || stored.Size != 42 {
+		t.Fatalf("export = %+v, %v", stored, err)
+	}
+	_, err = s.Exports.GetExportForUser(ctx, export.ID, uuid.New())
+	wantErr(t, "get of another user's export", err, ErrNotFound)
+	err = s.Exports.DeleteExport(ctx, export.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Exports.GetExportByID(ctx, export.ID)
+	wantErr(t, "get of a deleted export", err, ErrNotFound)
+}
+
+var errRollback = errors.New("rollback")
+
+func testTransactions(t *testing.T, s testStores) {
+	ctx := context.Background()
+	user := createTestUser(t, s)
+	post := createTestPost(t, s.Posts, user.ID, "content")
+	_, err := s.Tokens.CreateToken(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created *Post
+
+	t.Run("rollback", func(t *testing.T) {
+		err := s.Transactor.WithinTransaction(ctx, func(tx Stores) error {
+			created = createTestPost(t, tx.Posts, user.ID, "created")
+			update := &Post{ID: post.ID, UserID: user.ID, Title: "updated", Content: "updated"}
+			err := tx.Posts.UpdatePost(ctx, update, post.UpdatedAt)
+			if err != nil {
+				return err
+			}
+			err = tx.Users.PurgeUser(ctx, user.ID)
+			if err != nil {
+				return err
+			}
+			return errRollback
+		})
+		wantErr(t, "transaction", err, errRollback)
+		_, err = s.Users.GetUserByID(ctx, user.ID)
+		if err != nil {
+			t.Errorf("user after rollback: %v", err)
+		}
+		_, err = s.Posts.GetPostByID(ctx, created.ID)
+		wantErr(t, "get of a post created in a rolled back transaction", err, ErrNotFound)
+		stored, err := s.Posts.GetPostByID(ctx, post.ID)
+		if err != nil || stored.Title != "title" {
+			t.Errorf("post after rollback = %+v, %v, want it unchanged", stored, err)
+		}
+		tokens, err := s.Tokens.GetTokensForUser(ctx, user.ID)
+		wantLen(t, "tokens after rollback", tokens, err, 1)
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("the panic was swallowed")
+				}
+			}()
+			s.Transactor.WithinTransaction(ctx, func(tx Stores) error {
+				created = createTestPost(t, tx.Posts, user.ID, "created")
+				panic("unit of work failed")
+			})
+		}()
+		_, err := s.Posts.GetPostByID(ctx, created.ID)
+		wantErr(t, "get of a post created before a panic", err, ErrNotFound)
+	})
+
+	t.Run("commit", func(t *testing.T) {
+		err := s.Transactor.WithinTransaction(ctx, func(tx Stores) error {
+			created = createTestPost(t, tx.Posts, user.ID, "created")
+			return tx.Tokens.DeleteAllTokenForUser(ctx, user.ID)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.Posts.GetPostByID(ctx, created.ID)
+		if err != nil {
+			t.Errorf("post after commit: %v", err)
+		}
+		tokens, err := s.Tokens.GetTokensForUser(ctx, user.ID)
+		wantLen(t, "tokens after commit", tokens, err, 0)
+	})
+}
+
+// TestMemoryTransactorKeepsOtherWrites checks a rollback only reverts what
+// the unit of work wrote. The sql backends can't be tested this way, sqlite
+// blocks writers outside of the open transaction.
+func TestMemoryTransactorKeepsOtherWrites(t *testing.T) {
+	s := memoryTestStores(t)
+	ctx := context.Background()
+	user := createTestUser(t, s)
+	var outside *Post
+	err := s.Transactor.WithinTransaction(ctx, func(tx Stores) error {
+		createTestPost(t, tx.Posts, user.ID, "inside")
+		outside = createTestPost(t, s.Posts, user.ID, "outside")
+		return errRollback
+	})
+	wantErr(t, "transaction", err, errRollback)
+	posts, err := s.Posts.GetPostsForUser(ctx, user.ID)
+	wantLen(t, "posts", posts, err, 1)
+	if len(posts) == 1 && posts[0].ID != outside.ID {
+		t.Errorf("kept %q, want the post written outside the transaction", posts[0].Content)
+	}
+}
+
+// TestOpenSqlitePragmas checks the pragmas apply when the DSN has a query of
+// its own, and that its own settings win.
+func TestOpenSqlitePragmas(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "test.db") + "?_pragma=journal_mode(DELETE)"
+	db, err := Open(slog.New(slog.NewTextHandler(io.Discard, nil)), DatabaseConfig{Driver: "sqlite", DSN: dsn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlDB.Close()
+	var foreignKeys int
+	var journalMode string
+	err = sqlDB.QueryRow("PRAGMA foreign_keys").Scan(&foreignKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sqlDB.QueryRow("PRAGMA journal_mode").Scan(&journalMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if foreignKeys != 1 {
+		t.Errorf("foreign_keys = %v, want 1", foreignKeys)
+	}
+	if journalMode != "delete" {
+		t.Errorf("journal_mode = %q, want the DSN's delete", journalMode)
+	}
+}
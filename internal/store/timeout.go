@@ -0,0 +1,76 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	queryCancelKey  = "timeout:cancel"
+	queryContextKey = "timeout:context"
+)
+
+// QueryTimeoutPlugin bounds every create, query, update, delete and raw
+// statement by Timeout, on top of any deadline the caller's context has.
+// Statements that outlive it fail with ErrTimeout. Row and Rows are left
+// alone since their results are read after the callbacks returned, the
+// stores do not use them.
+type QueryTimeoutPlugin struct {
+	Timeout time.Duration
+}
+
+func (p *QueryTimeoutPlugin) Name() string {
+	return "timeout"
+}
+
+func (p *QueryTimeoutPlugin) Initialize(db *gorm.DB) error {
+	register := func(operation string, before, after func(name string, fn func(*gorm.DB)) error) error {
+		err := before("timeout:before_"+operation, func(tx *gorm.DB) {
+			ctx, cancel := context.WithTimeout(tx.Statement.Context, p.Timeout)
+			tx.InstanceSet(queryContextKey, tx.Statement.Context)
+			tx.InstanceSet(queryCancelKey, cancel)
+			tx.Statement.Context = ctx
+		})
+		if err != nil {
+			return err
+		}
+		return after("timeout:after_"+operation, func(tx *gorm.DB) {
+			value, ok := tx.InstanceGet(queryCancelKey)
+			if !ok {
+				return
+			}
+			ctx := tx.Statement.Context
+			// the statement may be reused within a transaction, later ones
+			// must not inherit this deadline
+			parent, _ := tx.InstanceGet(queryContextKey)
+			tx.Statement.Context = parent.(context.Context)
+			if tx.Error != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) && !errors.Is(tx.Error, ErrTimeout) {
+				tx.Error = fmt.Errorf("%w: %w", ErrTimeout, tx.Error)
+			}
+			value.(context.CancelFunc)()
+		})
+	}
+
+	cb := db.Callback()
+	err := register("create", cb.Create().Before("gorm:create").Register, cb.Create().After("gorm:create").Register)
+	if err != nil {
+		return err
+	}
+	err = register("query", cb.Query().Before("gorm:query").Register, cb.Query().After("gorm:query").Register)
+	if err != nil {
+		return err
+	}
+	err = register("update", cb.Update().Before("gorm:update").Register, cb.Update().After("gorm:update").Register)
+	if err != nil {
+		return err
+	}
+	err = register("delete", cb.Delete().Before("gorm:delete").Register, cb.Delete().After("gorm:delete").Register)
+	if err != nil {
+		return err
+	}
+	return register("raw", cb.Raw().Before("gorm:raw").Register, cb.Raw().After("gorm:raw").Register)
+}
@@ -1,6 +1,7 @@
 package store
 
 import (
+	"context"
 	"time"
 	"todoapp/internal/utils"
 
@@ -38,12 +39,14 @@ func NewPostgresTokenStore(db *gorm.DB) *PostgresTokenStore {
 }
 
 type TokenStore interface {
-	CreateToken(uuid.UUID) (*Token, error)
-	GetToken(session_token string, csrf_token string) (*Token, error)
-	DeleteAllTokenForUser(uuid.UUID) error
+	CreateToken(context.Context, uuid.UUID) (*Token, error)
+	GetTokenBySession(ctx context.Context, session_token string) (*Token, error)
+	DeleteAllTokenForUser(context.Context, uuid.UUID) error
+	GetTokensForUser(context.Context, uuid.UUID) ([]Token, error)
+	CountTokensCreatedSince(context.Context, time.Time) (int64, error)
 }
 
-func (pg *PostgresTokenStore) CreateToken(userId uuid.UUID) (*Token, error) {
+func (pg *PostgresTokenStore) CreateToken(ctx context.Context, userId uuid.UUID) (*Token, error) {
 	token := &Token{
 		UserID: userId,
 	}
@@ -58,29 +61,47 @@ func (pg *PostgresTokenStore) CreateToken(userId uuid.UUID) (*Token, error) {
 	}
 	token.SessionToken.Hash = utils.HashToken(token.SessionToken.PlainText)
 	token.CSRFToken.Hash = utils.HashToken(token.CSRFToken.PlainText)
-	result := pg.db.Create(token)
+	result := pg.db.WithContext(ctx).Create(token)
 	if result.Error != nil {
 		return nil, result.Error
 	}
 	return token, nil
 }
 
-func (pg *PostgresTokenStore) GetToken(session_token string, csrf_token string) (*Token, error) {
+func (pg *PostgresTokenStore) GetTokenBySession(ctx context.Context, session_token string) (*Token, error) {
 	token := &Token{}
-	result := pg.db.Where("session_token_hash = ? AND csrf_token_hash = ?", session_token, csrf_token).Find(&token)
+	result := pg.db.WithContext(ctx).Where("session_token_hash = ?", session_token).Find(&token)
 	if result.Error != nil {
 		return nil, result.Error
 	}
 	if result.RowsAffected != 1 {
-		return nil, gorm.ErrRecordNotFound
+		return nil, ErrNotFound
 	}
 	return token, nil
 }
 
-func (pg *PostgresTokenStore) DeleteAllTokenForUser(userId uuid.UUID) error {
-	result := pg.db.Where("user_id = ?", userId).Delete(&Token{})
+func (pg *PostgresTokenStore) DeleteAllTokenForUser(ctx context.Context, userId uuid.UUID) error {
+	result := pg.db.WithContext(ctx).Where("user_id = ?", userId).Delete(&Token{})
 	if result.Error != nil {
 		return result.Error
 	}
 	return nil
 }
+
+func (pg *PostgresTokenStore) GetTokensForUser(ctx context.Context, userId uuid.UUID) ([]Token, error) {
+	var tokens []Token
+	result := pg.db.WithContext(ctx).Where("user_id = ?", userId).Order("created_at").Find(&tokens)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return tokens, nil
+}
+
+func (pg *PostgresTokenStore) CountTokensCreatedSince(ctx context.Context, since time.Time) (int64, error) {
+	var count int64
+	result := pg.db.WithContext(ctx).Model(&Token{}).Where("created_at > ?", since).Count(&count)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	return count, nil
+}
@@ -0,0 +1,85 @@
+package store
+
+import (
+	"context"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// Stores is the set of stores a unit of work runs against.
+type Stores struct {
+	Users   UserStore
+	Tokens  TokenStore
+	Posts   PostStore
+	Images  ImageStore
+	Uploads UploadStore
+}
+
+// Transactor runs units of work that span several stores.
+type Transactor interface {
+	// WithinTransaction calls fn with stores bound to one transaction. It
+	// commits when fn returns nil and rolls back when fn returns an error or
+	// panics, a panic is raised again after the rollback.
+	WithinTransaction(ctx context.Context, fn func(Stores) error) error
+}
+
+type PostgresTransactor struct {
+	db *gorm.DB
+}
+
+func NewPostgresTransactor(db *gorm.DB) *PostgresTransactor {
+	return &PostgresTransactor{
+		db: db,
+	}
+}
+
+func (pg *PostgresTransactor) WithinTransaction(ctx context.Context, fn func(Stores) error) error {
+	return pg.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// the tables were migrated by the constructors already
+		return fn(Stores{
+			Users:   &PostgresUserStore{db: tx},
+			Tokens:  &PostgresTokenStore{db: tx},
+			Posts:   &PostgresPostStore{db: tx},
+			Images:  &PostgresImageStore{db: tx},
+			Uploads: &PostgresUploadStore{db: tx},
+		})
+	})
+}
+
+// MemoryTransactor runs units of work one at a time against copies of the
+// memory stores that log how to undo each write. A rollback reverts the rows
+// the unit of work wrote and keeps the writes made outside of it, except
+// that without row locks an outside write to one of those same rows is
+// overwritten.
+type MemoryTransactor struct {
+	mu     sync.Mutex
+	stores *MemoryStores
+}
+
+func NewMemoryTransactor(stores *MemoryStores) *MemoryTransactor {
+	return &MemoryTransactor{
+		stores: stores,
+	}
+}
+
+func (mt *MemoryTransactor) WithinTransaction(_ context.Context, fn func(Stores) error) (err error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	undo := &undoLog{}
+	panicked := true
+	defer func() {
+		if panicked || err != nil {
+			undo.rollback()
+		}
+	}()
+	err = fn(Stores{
+		Users:   mt.stores.Users.withUndo(undo),
+		Tokens:  mt.stores.Tokens.withUndo(undo),
+		Posts:   mt.stores.Posts.withUndo(undo),
+		Images:  mt.stores.Images.withUndo(undo),
+		Uploads: mt.stores.Uploads.withUndo(undo),
+	})
+	panicked = false
+	return err
+}
@@ -0,0 +1,149 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Upload tracks a resumable upload in progress. Each accepted chunk is kept
+// as its own blob until the upload is finalized.
+type Upload struct {
+	ID        uuid.UUID `gorm:"type:uuid;" json:"id"`
+	UserID    uuid.UUID `gorm:"not null;index;" json:"-"`
+	User      User      `gorm:"constraint:OnDelete:CASCADE;" json:"-"`
+	Length    int64     `gorm:"not null;" json:"length"`
+	Offset    int64     `gorm:"column:upload_offset;not null;default:0;" json:"offset"`
+	ChunkKeys string    `gorm:"not null;default:'';" json:"-"`
+	Metadata  string    `json:"-"`
+	ExpiresAt time.Time `gorm:"not null;index;" json:"expires_at"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+}
+
+func (upload *Upload) BeforeCreate(*gorm.DB) error {
+	assignID(&upload.ID)
+	return nil
+}
+
+// NewChunkKey names the blob for a chunk starting at the current offset. The
+// random suffix keeps racing requests for the same offset from overwriting
+// each other's data.
+func (upload *Upload) NewChunkKey() string {
+	return fmt.Sprintf("upload_%s_%d_%s", upload.ID, upload.Offset, uuid.New())
+}
+
+// Chunks lists the chunk blob keys in upload order.
+func (upload *Upload) Chunks() []string {
+	if upload.ChunkKeys == "" {
+		return []string{}
+	}
+	return strings.Split(upload.ChunkKeys, ",")
+}
+
+func (upload *Upload) IsComplete() bool {
+	return upload.Offset == upload.Length
+}
+
+type PostgresUploadStore struct {
+	db *gorm.DB
+}
+
+func NewPostgresUploadStore(db *gorm.DB) *PostgresUploadStore {
+	err := db.AutoMigrate(&Upload{})
+	if err != nil {
+		panic(err)
+	}
+	return &PostgresUploadStore{
+		db: db,
+	}
+}
+
+type UploadStore interface {
+	CreateUpload(ctx context.Context, upload *Upload, quota int64) error
+	GetUploadForUser(ctx context.Context, id uuid.UUID, userId uuid.UUID) (*Upload, error)
+	AdvanceUpload(ctx context.Context, upload *Upload, chunkKey string, size int64, expiresAt time.Time) error
+	DeleteUpload(context.Context, uuid.UUID) error
+	GetExpiredUploads(context.Context, time.Time) ([]Upload, error)
+	GetUploadsForUser(context.Context, uuid.UUID) ([]Upload, error)
+}
+
+// CreateUpload reserves the upload's length against the user's quota, like
+// an image of that size, until the upload expires or is removed.
+func (pg *PostgresUploadStore) CreateUpload(ctx context.Context, upload *Upload, quota int64) error {
+	return pg.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := checkQuota(tx, upload.UserID, upload.Length, quota)
+		if err != nil {
+			return err
+		}
+		return tx.Create(upload).Error
+	})
+}
+
+func (pg *PostgresUploadStore) GetUploadForUser(ctx context.Context, id uuid.UUID, userId uuid.UUID) (*Upload, error) {
+	upload := &Upload{}
+	result := pg.db.WithContext(ctx).Where("id = ? AND user_id = ?", id, userId).Find(&upload)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return nil, ErrNotFound
+	}
+	return upload, nil
+}
+
+// AdvanceUpload records a chunk of size bytes written at upload.Offset. It
+// returns ErrConflict when another request moved the offset first.
+func (pg *PostgresUploadStore) AdvanceUpload(ctx context.Context, upload *Upload, chunkKey string, size int64, expiresAt time.Time) error {
+	chunkKeys := chunkKey
+	if upload.ChunkKeys != "" {
+		chunkKeys = upload.ChunkKeys + "," + chunkKey
+	}
+	result := pg.db.WithContext(ctx).Model(&Upload{}).
+		Where("id = ? AND upload_offset = ?", upload.ID, upload.Offset).
+		Updates(map[string]any{
+			"upload_offset": upload.Offset + size,
+			"chunk_keys":    chunkKeys,
+			"expires_at":    expiresAt,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != 1 {
+		return ErrConflict
+	}
+	upload.Offset += size
+	upload.ChunkKeys = chunkKeys
+	upload.ExpiresAt = expiresAt
+	return nil
+}
+
+func (pg *PostgresUploadStore) DeleteUpload(ctx context.Context, id uuid.UUID) error {
+	result := pg.db.WithContext(ctx).Where("id = ?", id).Delete(&Upload{})
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+func (pg *PostgresUploadStore) GetExpiredUploads(ctx context.Context, now time.Time) ([]Upload, error) {
+	var uploads []Upload
+	result := pg.db.WithContext(ctx).Where("expires_at < ?", now).Find(&uploads)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return uploads, nil
+}
+
+func (pg *PostgresUploadStore) GetUploadsForUser(ctx context.Context, userId uuid.UUID) ([]Upload, error) {
+	var uploads []Upload
+	result := pg.db.WithContext(ctx).Where("user_id = ?", userId).Find(&uploads)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return uploads, nil
+}
@@ -1,6 +1,7 @@
 package store
 
 import (
+	"context"
 	"errors"
 	"time"
 
@@ -9,12 +10,20 @@ import (
 )
 
 type User struct {
-	ID           uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();" json:"id"`
+	ID           uuid.UUID `gorm:"type:uuid;" json:"id"`
 	Username     string    `gorm:"unique; not null;" json:"username"`
 	Email        string    `gorm:"not null;" json:"email"`
 	PasswordHash string    `gorm:"not null;type:varchar(255)" json:"-"`
 	CreatedAt    time.Time `json:"-"`
 	UpdatedAt    time.Time `json:"-"`
+	// DeletedAt marks a deleted account, it is kept in the trash until the
+	// retention period ends and hidden from every query until then.
+	DeletedAt gorm.DeletedAt `gorm:"index;" json:"-"`
+}
+
+func (user *User) BeforeCreate(*gorm.DB) error {
+	assignID(&user.ID)
+	return nil
 }
 
 var AnonymousUser = &User{}
@@ -25,28 +34,40 @@ func (user *User) IsAnonymous() bool {
 
 type PostgresUserStore struct {
 	db *gorm.DB
+	// replicas serves the read-only methods, nil reads from db
+	replicas *ReplicaRouter
 }
 
-func NewPostgresUserStore(db *gorm.DB) *PostgresUserStore {
+func NewPostgresUserStore(db *gorm.DB, replicas *ReplicaRouter) *PostgresUserStore {
 	err := db.AutoMigrate(&User{})
 	if err != nil {
 		panic(err)
 	}
 	return &PostgresUserStore{
-		db: db,
+		db:       db,
+		replicas: replicas,
 	}
 }
 
 type UserStore interface {
-	DoesUsernameExist(string) (bool, error)
-	GetUserByUsername(string) (*User, error)
-	GetUserByID(uuid.UUID) (*User, error)
-	CreateUser(*User) error
+	DoesUsernameExist(context.Context, string) (bool, error)
+	GetUserByUsername(context.Context, string) (*User, error)
+	GetUserByID(context.Context, uuid.UUID) (*User, error)
+	CreateUser(context.Context, *User) error
+	// DeleteUser moves the user to the trash, RestoreUser brings them back
+	// until PurgeUser removes them for good.
+	DeleteUser(context.Context, uuid.UUID) error
+	GetDeletedUserByUsername(context.Context, string) (*User, error)
+	RestoreUser(context.Context, uuid.UUID) error
+	GetUsersDeletedBefore(context.Context, time.Time) ([]User, error)
+	PurgeUser(context.Context, uuid.UUID) error
 }
 
-func (pg *PostgresUserStore) DoesUsernameExist(username string) (bool, error) {
+// DoesUsernameExist counts deleted users as well, their name stays taken
+// while the account can still be restored.
+func (pg *PostgresUserStore) DoesUsernameExist(ctx context.Context, username string) (bool, error) {
 	user := User{}
-	result := pg.db.Where("username = ?", username).Find(&user)
+	result := pg.replicas.Reader(ctx, pg.db).WithContext(ctx).Unscoped().Where("username = ?", username).Find(&user)
 	if result.Error != nil {
 		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
 			return false, nil
@@ -60,34 +81,90 @@ func (pg *PostgresUserStore) DoesUsernameExist(username string) (bool, error) {
 	}
 }
 
-func (pg *PostgresUserStore) GetUserByUsername(username string) (*User, error) {
+func (pg *PostgresUserStore) GetUserByUsername(ctx context.Context, username string) (*User, error) {
+	user := &User{}
+	result := pg.replicas.Reader(ctx, pg.db).WithContext(ctx).Where("username = ?", username).Find(&user)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return nil, ErrNotFound
+	}
+	return user, nil
+}
+
+func (pg *PostgresUserStore) GetUserByID(ctx context.Context, userId uuid.UUID) (*User, error) {
 	user := &User{}
-	result := pg.db.Where("username = ?", username).Find(&user)
+	result := pg.replicas.Reader(ctx, pg.db).WithContext(ctx).Where("id = ?", userId).Find(&user)
 	if result.Error != nil {
 		return nil, result.Error
 	}
 	if result.RowsAffected != 1 {
-		return nil, gorm.ErrRecordNotFound
+		return nil, ErrNotFound
 	}
 	return user, nil
 }
 
-func (pg *PostgresUserStore) GetUserByID(userId uuid.UUID) (*User, error) {
+func (pg *PostgresUserStore) CreateUser(ctx context.Context, user *User) error {
+	result := pg.db.WithContext(ctx).Create(user)
+	if result.Error != nil {
+		return translateError(result.Error)
+	}
+	return nil
+}
+
+func (pg *PostgresUserStore) DeleteUser(ctx context.Context, userId uuid.UUID) error {
+	result := pg.db.WithContext(ctx).Delete(&User{}, "id = ?", userId)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != 1 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (pg *PostgresUserStore) GetDeletedUserByUsername(ctx context.Context, username string) (*User, error) {
 	user := &User{}
-	result := pg.db.Where("id = ?", userId).Find(&user)
+	result := pg.db.WithContext(ctx).Unscoped().Where("username = ? AND deleted_at IS NOT NULL", username).Find(&user)
 	if result.Error != nil {
 		return nil, result.Error
 	}
 	if result.RowsAffected != 1 {
-		return nil, gorm.ErrRecordNotFound
+		return nil, ErrNotFound
 	}
 	return user, nil
 }
 
-func (pg *PostgresUserStore) CreateUser(user *User) error {
-	result := pg.db.Create(user)
+func (pg *PostgresUserStore) RestoreUser(ctx context.Context, userId uuid.UUID) error {
+	result := pg.db.WithContext(ctx).Unscoped().Model(&User{}).Where("id = ? AND deleted_at IS NOT NULL", userId).Update("deleted_at", nil)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != 1 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (pg *PostgresUserStore) GetUsersDeletedBefore(ctx context.Context, before time.Time) ([]User, error) {
+	var users []User
+	result := pg.db.WithContext(ctx).Unscoped().Where("deleted_at < ?", before).Find(&users)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return users, nil
+}
+
+// PurgeUser deletes the user row, the database cascades to whatever still
+// points at it.
+func (pg *PostgresUserStore) PurgeUser(ctx context.Context, userId uuid.UUID) error {
+	result := pg.db.WithContext(ctx).Unscoped().Delete(&User{}, "id = ?", userId)
 	if result.Error != nil {
 		return result.Error
 	}
+	if result.RowsAffected != 1 {
+		return ErrNotFound
+	}
 	return nil
 }
@@ -0,0 +1,226 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile enables mutual TLS, client certificates are verified
+	// against the CAs in it. ClientAuth only decides whether one is
+	// required, "request" and "require" verify like "verify-if-given" and
+	// "require-and-verify" when a CA is set.
+	ClientCAFile string
+	ClientAuth   string
+	MinVersion   string
+	// CipherSuites are comma separated Go names such as
+	// TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256. They only apply to TLS 1.2,
+	// TLS 1.3 suites are not configurable.
+	CipherSuites   string
+	ReloadInterval time.Duration
+}
+
+func (cfg Config) Enabled() bool {
+	return cfg.CertFile != "" || cfg.KeyFile != ""
+}
+
+var versions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                   tls.NoClientCert,
+	"none":               tls.NoClientCert,
+	"request":            tls.RequestClientCert,
+	"require":            tls.RequireAnyClientCert,
+	"verify-if-given":    tls.VerifyClientCertIfGiven,
+	"require-and-verify": tls.RequireAndVerifyClientCert,
+}
+
+func parseCipherSuites(names string) ([]uint16, error) {
+	if names == "" {
+		return nil, nil
+	}
+	known := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	ids := []uint16{}
+	for _, name := range strings.Split(names, ",") {
+		id, ok := known[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("tls: unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// TLSConfig builds the server configuration. Certificates are served from
+// the reloader so replacing the files on disk takes effect without a
+// restart.
+func (cfg Config) TLSConfig(reloader *CertReloader) (*tls.Config, error) {
+	minVersion, ok := versions[cfg.MinVersion]
+	if !ok {
+		return nil, fmt.Errorf("tls: unsupported minimum version %q, use 1.2 or 1.3", cfg.MinVersion)
+	}
+	cipherSuites, err := parseCipherSuites(cfg.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	clientAuth, ok := clientAuthTypes[cfg.ClientAuth]
+	if !ok {
+		return nil, fmt.Errorf("tls: unknown client auth %q", cfg.ClientAuth)
+	}
+	config := &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   cipherSuites,
+		GetCertificate: reloader.GetCertificate,
+		ClientAuth:     clientAuth,
+	}
+	if cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: read client ca with %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("tls: no certificates in client ca file")
+		}
+		config.ClientCAs = pool
+		// a certificate that is not checked against the CA proves nothing,
+		// so the modes without verification verify once a CA is given
+		switch clientAuth {
+		case tls.NoClientCert, tls.RequireAnyClientCert:
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		case tls.RequestClientCert:
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	if config.ClientAuth >= tls.VerifyClientCertIfGiven && config.ClientCAs == nil {
+		return nil, errors.New("tls: verifying client certificates needs a client ca file")
+	}
+	return config, nil
+}
+
+// CertReloader serves a certificate and key pair from disk, reloading them
+// when either file changes. Polling rather than file events also picks up
+// the symlink swaps used by Kubernetes secret volumes.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	logger   *slog.Logger
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewCertReloader(certFile string, keyFile string, logger *slog.Logger) (*CertReloader, error) {
+	reloader := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger,
+		stop:     make(chan struct{}),
+	}
+	_, err := reloader.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// Reload loads the pair again if either file changed since the last load,
+// reporting whether it did. A broken pair keeps the current certificate.
+func (cr *CertReloader) Reload() (bool, error) {
+	modTimes := [2]time.Time{}
+	for i, file := range []string{cr.certFile, cr.keyFile} {
+		stat, err := os.Stat(file)
+		if err != nil {
+			return false, fmt.Errorf("tls: stat %v with %w", file, err)
+		}
+		modTimes[i] = stat.ModTime()
+	}
+	cr.mu.RLock()
+	unchanged := cr.cert != nil && modTimes == cr.modTimes
+	cr.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("tls: load key pair with %w", err)
+	}
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.modTimes = modTimes
+	cr.mu.Unlock()
+	return true, nil
+}
+
+// Start checks the files every interval until Stop.
+func (cr *CertReloader) Start(interval time.Duration) {
+	cr.wg.Add(1)
+	go func() {
+		defer cr.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-cr.stop:
+				return
+			case <-ticker.C:
+				reloaded, err := cr.Reload()
+				if err != nil {
+					cr.logger.Error("certReload", "error", err)
+					continue
+				}
+				if reloaded {
+					cr.logger.Info("reloaded tls certificate", "cert_file", cr.certFile)
+				}
+			}
+		}
+	}()
+}
+
+func (cr *CertReloader) Stop() {
+	close(cr.stop)
+	cr.wg.Wait()
+}
+
+// RedirectHandler sends plain http requests to the same url on https at
+// httpsPort.
+func RedirectHandler(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
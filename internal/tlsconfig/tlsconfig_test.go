@@ -0,0 +1,312 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue returns a PEM certificate and key for name, valid for 127.0.0.1 as
+// a server or as a client.
+func (ca *testCA) issue(t *testing.T, name string) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+func (ca *testCA) clientCert(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, name)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// writePair writes the files with a modification time of modTime, so a
+// rewrite within the file system's timestamp resolution still counts.
+func writePair(t *testing.T, certFile string, certPEM []byte, keyFile string, keyPEM []byte, modTime time.Time) {
+	t.Helper()
+	for file, data := range map[string][]byte{certFile: certPEM, keyFile: keyPEM} {
+		err := os.WriteFile(file, data, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(file, modTime, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// serve starts an https server answering "ok" with config.
+func serve(t *testing.T, config *tls.Config) string {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "ok")
+		}),
+		// rejected handshakes are expected
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return "https://" + listener.Addr().String()
+}
+
+// client presents cert, if any, even when the server asks for certificates
+// of other CAs, which Go clients otherwise answer with none.
+func client(roots *x509.CertPool, cert *tls.Certificate) *http.Client {
+	config := &tls.Config{RootCAs: roots}
+	if cert != nil {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert, nil
+		}
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   config,
+			DisableKeepAlives: true,
+		},
+		Timeout: 5 * time.Second,
+	}
+}
+
+// peerName connects to url and returns the common name the server presented.
+func peerName(t *testing.T, c *http.Client, url string) string {
+	t.Helper()
+	response, err := c.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	return response.TLS.PeerCertificates[0].Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	ca := newTestCA(t, "test ca")
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	certPEM, keyPEM := ca.issue(t, "first")
+	start := time.Now().Add(-time.Minute)
+	writePair(t, certFile, certPEM, keyFile, keyPEM, start)
+
+	reloader, err := NewCertReloader(certFile, keyFile, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := Config{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.2"}.TLSConfig(reloader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := serve(t, config)
+	c := client(ca.pool(), nil)
+	if name := peerName(t, c, url); name != "first" {
+		t.Fatalf("served %q, want first", name)
+	}
+
+	reloaded, err := reloader.Reload()
+	if err != nil || reloaded {
+		t.Fatalf("reload of unchanged files = %v, %v, want false, nil", reloaded, err)
+	}
+
+	certPEM, keyPEM = ca.issue(t, "second")
+	writePair(t, certFile, certPEM, keyFile, keyPEM, start.Add(time.Second))
+	reloaded, err = reloader.Reload()
+	if err != nil || !reloaded {
+		t.Fatalf("reload of replaced files = %v, %v, want true, nil", reloaded, err)
+	}
+	if name := peerName(t, c, url); name != "second" {
+		t.Fatalf("served %q after the reload, want second", name)
+	}
+
+	// a half written pair keeps the working certificate
+	writePair(t, certFile, []byte("broken"), keyFile, keyPEM, start.Add(2*time.Second))
+	_, err = reloader.Reload()
+	if err == nil {
+		t.Fatal("reloading a broken pair succeeded")
+	}
+	if name := peerName(t, c, url); name != "second" {
+		t.Fatalf("served %q after a failed reload, want second", name)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t, "server ca")
+	clientCA := newTestCA(t, "client ca")
+	otherCA := newTestCA(t, "other ca")
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	certPEM, keyPEM := ca.issue(t, "server")
+	writePair(t, certFile, certPEM, keyFile, keyPEM, time.Now())
+	clientCAFile := filepath.Join(dir, "client-ca.crt")
+	err := os.WriteFile(clientCAFile, clientCA.pem, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader, err := NewCertReloader(certFile, keyFile, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted := clientCA.clientCert(t, "trusted")
+	untrusted := otherCA.clientCert(t, "untrusted")
+
+	tests := []struct {
+		clientAuth string
+		mode       tls.ClientAuthType
+		// accepted lists which of no certificate, a trusted and an
+		// untrusted one get through
+		accepted [3]bool
+	}{
+		{"", tls.RequireAndVerifyClientCert, [3]bool{false, true, false}},
+		{"request", tls.VerifyClientCertIfGiven, [3]bool{true, true, false}},
+		{"require", tls.RequireAndVerifyClientCert, [3]bool{false, true, false}},
+		{"verify-if-given", tls.VerifyClientCertIfGiven, [3]bool{true, true, false}},
+		{"require-and-verify", tls.RequireAndVerifyClientCert, [3]bool{false, true, false}},
+	}
+	for _, test := range tests {
+		t.Run(test.clientAuth, func(t *testing.T) {
+			cfg := Config{
+				CertFile:     certFile,
+				KeyFile:      keyFile,
+				ClientCAFile: clientCAFile,
+				ClientAuth:   test.clientAuth,
+				MinVersion:   "1.2",
+			}
+			config, err := cfg.TLSConfig(reloader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.ClientAuth != test.mode {
+				t.Errorf("client auth = %v, want %v", config.ClientAuth, test.mode)
+			}
+			url := serve(t, config)
+			clients := []*http.Client{client(ca.pool(), nil), client(ca.pool(), &trusted), client(ca.pool(), &untrusted)}
+			for i, c := range clients {
+				response, err := c.Get(url)
+				if err == nil {
+					response.Body.Close()
+				}
+				if accepted := err == nil; accepted != test.accepted[i] {
+					t.Errorf("client %v accepted = %v, want %v (%v)", []string{"without a certificate", "trusted", "untrusted"}[i], accepted, test.accepted[i], err)
+				}
+			}
+		})
+	}
+
+	_, err = Config{CertFile: certFile, KeyFile: keyFile, ClientAuth: "require-and-verify", MinVersion: "1.2"}.TLSConfig(reloader)
+	if err == nil {
+		t.Error("verifying client certificates without a CA was accepted")
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		port     int
+		host     string
+		location string
+	}{
+		{8443, "example.com:8080", "https://example.com:8443/posts?page=2"},
+		{443, "example.com:8080", "https://example.com/posts?page=2"},
+		{443, "example.com", "https://example.com/posts?page=2"},
+		{8443, "[::1]:8080", "https://[::1]:8443/posts?page=2"},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodPost, "http://"+test.host+"/posts?page=2", nil)
+		recorder := httptest.NewRecorder()
+		RedirectHandler(test.port).ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusPermanentRedirect {
+			t.Errorf("%v: status = %v, want 308 so the method is kept", test.host, recorder.Code)
+		}
+		if location := recorder.Header().Get("Location"); location != test.location {
+			t.Errorf("%v: location = %q, want %q", test.host, location, test.location)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package tracing
+
+import (
+	"errors"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const gormSpanKey = "tracing:span"
+
+// GormPlugin starts a span around every query GORM runs, as a child of the
+// span in the statement's context.
+type GormPlugin struct {
+	// System is the database system reported on spans, e.g. "postgresql".
+	System string
+}
+
+func (p *GormPlugin) Name() string {
+	return "tracing"
+}
+
+func (p *GormPlugin) Initialize(db *gorm.DB) error {
+	tracer := otel.Tracer(tracerName)
+	register := func(operation string, before, after func(name string, fn func(*gorm.DB)) error) error {
+		err := before("tracing:before_"+operation, func(tx *gorm.DB) {
+			ctx, span := tracer.Start(tx.Statement.Context, "gorm."+operation,
+				trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(semconv.DBSystemKey.String(p.System)),
+			)
+			tx.Statement.Context = ctx
+			tx.InstanceSet(gormSpanKey, span)
+		})
+		if err != nil {
+			return err
+		}
+		return after("tracing:after_"+operation, func(tx *gorm.DB) {
+			value, ok := tx.InstanceGet(gormSpanKey)
+			if !ok {
+				return
+			}
+			span := value.(trace.Span)
+			defer span.End()
+			if tx.Statement.Table != "" {
+				span.SetName("gorm." + operation + " " + tx.Statement.Table)
+			}
+			span.SetAttributes(
+				semconv.DBQueryText(tx.Statement.SQL.String()),
+				attribute.String("db.collection.name", tx.Statement.Table),
+				attribute.Int64("db.rows_affected", tx.Statement.RowsAffected),
+			)
+			if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+				span.RecordError(tx.Error)
+				span.SetStatus(codes.Error, tx.Error.Error())
+			}
+		})
+	}
+
+	cb := db.Callback()
+	err := register("create", cb.Create().Before("gorm:create").Register, cb.Create().After("gorm:create").Register)
+	if err != nil {
+		return err
+	}
+	err = register("query", cb.Query().Before("gorm:query").Register, cb.Query().After("gorm:query").Register)
+	if err != nil {
+		return err
+	}
+	err = register("update", cb.Update().Before("gorm:update").Register, cb.Update().After("gorm:update").Register)
+	if err != nil {
+		return err
+	}
+	err = register("delete", cb.Delete().Before("gorm:delete").Register, cb.Delete().After("gorm:delete").Register)
+	if err != nil {
+		return err
+	}
+	err = register("row", cb.Row().Before("gorm:row").Register, cb.Row().After("gorm:row").Register)
+	if err != nil {
+		return err
+	}
+	return register("raw", cb.Raw().Before("gorm:raw").Register, cb.Raw().After("gorm:raw").Register)
+}
@@ -0,0 +1,88 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+const tracerName = "todoapp"
+
+// ServiceName is reported on every span, OTEL_SERVICE_NAME overrides it.
+func ServiceName() string {
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		return name
+	}
+	return "todoapp"
+}
+
+// Setup installs the global tracer provider and W3C trace-context
+// propagation. TRACING_EXPORTER selects "otlp" (configured through the
+// standard OTEL_EXPORTER_OTLP_* variables), "stdout" for local runs, or
+// nothing to only propagate incoming trace context. The returned function
+// flushes pending spans on shutdown.
+func Setup(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch backend := os.Getenv("TRACING_EXPORTER"); backend {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("tracing: unknown exporter %q", backend)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tracing: exporter with %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(ServiceName()),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("tracing: resource with %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Transport wraps base, http.DefaultTransport when nil, so outbound calls
+// get a span and carry the trace context to the remote side.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return otelhttp.NewTransport(base)
+}
+
+// HTTPClient is the client outbound calls should use, a traced client over
+// base with the given timeout.
+func HTTPClient(base http.RoundTripper, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: Transport(base),
+		Timeout:   timeout,
+	}
+}
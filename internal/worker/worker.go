@@ -0,0 +1,41 @@
+package worker
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Every calls fn every interval in a goroutine tracked by wg until stop is
+// closed. Closing stop also cancels the context of a run in progress.
+func Every(interval time.Duration, stop <-chan struct{}, wg *sync.WaitGroup, fn func(context.Context)) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ctx, cancel := Context(stop)
+		defer cancel()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				fn(ctx)
+			}
+		}
+	}()
+}
+
+// Context returns a context that is cancelled once stop is closed.
+func Context(stop <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
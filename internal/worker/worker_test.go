@@ -0,0 +1,41 @@
+package worker
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEvery(t *testing.T) {
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var runs atomic.Int32
+	started := make(chan struct{})
+	var cancelled atomic.Bool
+	Every(5*time.Millisecond, stop, &wg, func(ctx context.Context) {
+		if runs.Add(1) < 3 {
+			return
+		}
+		if runs.Load() == 3 {
+			close(started)
+		}
+		// a run in progress has to be cancelled by stop
+		<-ctx.Done()
+		cancelled.Store(true)
+	})
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatalf("ran %v times in a second, want 3", runs.Load())
+	}
+	close(stop)
+	wg.Wait()
+	if !cancelled.Load() {
+		t.Error("stop did not cancel the run in progress")
+	}
+	if got := runs.Load(); got != 3 {
+		t.Errorf("ran %v times, want no runs after stop", got)
+	}
+}
@@ -2,19 +2,25 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
 	"os/signal"
 	"syscall"
 	"time"
 	"todoapp/internal/app"
+	"todoapp/internal/health"
 	"todoapp/internal/routes"
+	"todoapp/internal/tlsconfig"
+	"todoapp/internal/tracing"
+
 	_ "github.com/joho/godotenv/autoload"
 )
 
-func gracefulShutdown(apiServer *http.Server, done chan bool) {
+func gracefulShutdown(servers []*http.Server, healthChecker *health.Checker, drainDelay time.Duration, done chan bool) {
 	// Create context that listens for the interrupt signal from the OS.
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
@@ -22,18 +28,25 @@ func gracefulShutdown(apiServer *http.Server, done chan bool) {
 	// Listen for the interrupt signal.
 	<-ctx.Done()
 
-	log.Println("Shutting down gracefully, press Ctrl+C again to force")
+	slog.Info("shutting down gracefully, press Ctrl+C again to force")
 	stop() // Allow Ctrl+C to force shutdown
 
+	// Fail readiness first and give load balancers time to notice before
+	// we stop accepting connections
+	healthChecker.SetDraining()
+	time.Sleep(drainDelay)
+
 	// The context is used to inform the server it has 5 seconds to finish
 	// the request it is currently handling
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	if err := apiServer.Shutdown(ctx); err != nil {
-		log.Printf("Server forced to shutdown with error: %v", err)
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Error("server forced to shutdown", "error", err, "addr", server.Addr)
+		}
 	}
 
-	log.Println("Server exiting")
+	slog.Info("server exiting")
 
 	// Notify the main goroutine that the shutdown is complete
 	done <- true
@@ -41,13 +54,52 @@ func gracefulShutdown(apiServer *http.Server, done chan bool) {
 
 func main() {
 	var port int
+	var imageGCReport bool
+	var drainDelay time.Duration
+	var redirectPort int
+	opts := app.Options{}
+	tlsCfg := tlsconfig.Config{}
 	flag.IntVar(&port, "port", 8080, "Go backend server port")
+	flag.StringVar(&tlsCfg.CertFile, "tls-cert", "", "TLS certificate file, serves https when set together with -tls-key")
+	flag.StringVar(&tlsCfg.KeyFile, "tls-key", "", "TLS private key file")
+	flag.StringVar(&tlsCfg.ClientCAFile, "tls-client-ca", "", "CA bundle to verify client certificates against (mutual TLS)")
+	flag.StringVar(&tlsCfg.ClientAuth, "tls-client-auth", "", "Client certificate policy: none, request, require, verify-if-given or require-and-verify")
+	flag.StringVar(&tlsCfg.MinVersion, "tls-min-version", "1.2", "Minimum TLS version, 1.2 or 1.3")
+	flag.StringVar(&tlsCfg.CipherSuites, "tls-ciphers", "", "Comma separated TLS 1.2 cipher suites, Go defaults when empty")
+	flag.DurationVar(&tlsCfg.ReloadInterval, "tls-reload-interval", 10*time.Second, "How often to check the certificate files for changes")
+	flag.IntVar(&redirectPort, "http-redirect-port", 0, "Port of a plain http listener redirecting to https, 0 disables it")
+	flag.DurationVar(&drainDelay, "drain-delay", 5*time.Second, "How long to report not ready before shutting down")
+	flag.StringVar(&opts.Store, "store", "postgres", "Store backend: postgres, sqlite, or memory for local development without a database")
+	flag.BoolVar(&imageGCReport, "image-gc-report", false, "Print the images the garbage collector would delete and exit")
 	flag.Parse()
 
-	app, err := app.NewApplication()
+	shutdownTracing, err := tracing.Setup(context.Background())
+	if err != nil {
+		panic(err)
+	}
+
+	app, err := app.NewApplication(opts)
 	if err != nil {
 		panic(err)
 	}
+
+	if flag.Arg(0) == "import" {
+		code := runImport(app, flag.Args()[1:])
+		app.Close()
+		os.Exit(code)
+	}
+
+	if imageGCReport {
+		report, err := app.ImageGC.Report(context.Background())
+		if err != nil {
+			app.Logger.Error("image gc report", "error", err)
+			os.Exit(1)
+		}
+		app.ImageGC.LogReport(report)
+		app.Close()
+		return
+	}
+	app.StartWorkers()
 	r := routes.SetupRoutes(app)
 
 	server := &http.Server{
@@ -58,20 +110,65 @@ func main() {
 		WriteTimeout: 30 * time.Second,
 	}
 
+	servers := []*http.Server{server}
+
+	var certReloader *tlsconfig.CertReloader
+	if tlsCfg.Enabled() {
+		certReloader, err = tlsconfig.NewCertReloader(tlsCfg.CertFile, tlsCfg.KeyFile, app.Logger)
+		if err != nil {
+			panic(err)
+		}
+		server.TLSConfig, err = tlsCfg.TLSConfig(certReloader)
+		if err != nil {
+			panic(err)
+		}
+		certReloader.Start(tlsCfg.ReloadInterval)
+
+		if redirectPort != 0 {
+			redirectServer := &http.Server{
+				Addr:              fmt.Sprintf(":%d", redirectPort),
+				Handler:           tlsconfig.RedirectHandler(port),
+				ReadHeaderTimeout: 5 * time.Second,
+			}
+			servers = append(servers, redirectServer)
+			go func() {
+				app.Logger.Info("redirecting http to https", "port", redirectPort)
+				err := redirectServer.ListenAndServe()
+				if err != nil && !errors.Is(err, http.ErrServerClosed) {
+					app.Logger.Error("redirect server stopped", "error", err)
+				}
+			}()
+		}
+	}
+
 	// Create a done channel to signal when the shutdown is complete
 	done := make(chan bool, 1)
 
 	// Run graceful shutdown in a separate goroutine
-	go gracefulShutdown(server, done)
+	go gracefulShutdown(servers, app.Health, drainDelay, done)
 
-	app.Logger.Printf("Server is running on port: %d\n", port)
+	app.Logger.Info("server is running", "port", port, "tls", tlsCfg.Enabled())
 
-	err = server.ListenAndServe()
-	if err != nil {
-		app.Logger.Fatal(err)
+	if tlsCfg.Enabled() {
+		// the certificate comes from TLSConfig.GetCertificate
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		app.Logger.Error("server stopped", "error", err)
+		os.Exit(1)
 	}
 
 	// Wait for the graceful shutdown to complete
 	<-done
-	log.Println("Graceful shutdown complete.")
+	if certReloader != nil {
+		certReloader.Stop()
+	}
+	app.Close()
+	err = shutdownTracing(context.Background())
+	if err != nil {
+		slog.Error("tracing shutdown", "error", err)
+	}
+	slog.Info("graceful shutdown complete")
 }